@@ -0,0 +1,90 @@
+// argreduce.go
+//
+// Argmax and Argmin for MPSEng: the index of the extreme element along an
+// axis, found by the argument kernels of the engine's backend, which
+// share the reductions' layout (see reduce.go). Results are int tensors
+// shaped as StdEng shapes them.
+
+package mps
+
+import (
+	"gorgonia.org/tensor"
+)
+
+// Argmax returns the indices of the maxima of t along axis, accelerating
+// float32 *tensor.Dense tensors of any rank and layout. With axis
+// tensor.AllAxes it returns the index of the maximum in row-major order,
+// as a scalar. Other inputs, and problems the engine's dispatch policy
+// rejects, defer to the configured fallback engine's Argmax, or
+// StdEng's.
+//
+// The result is a new int tensor shaped as StdEng.Argmax shapes it, a
+// scalar for 1-D tensors, and ties go to the first maximum. NaNs and
+// infinities count as in StdEng: the first NaN or +Inf after the first
+// element is returned wherever it is, and a NaN first element is
+// returned unless there is one.
+func (e *MPSEng) Argmax(t tensor.Tensor, axis int) (tensor.Tensor, error) {
+	return e.argReduce(OpArgmax, t, axis)
+}
+
+// Argmin returns the indices of the minima of t along axis, like Argmax,
+// with -Inf in place of +Inf.
+func (e *MPSEng) Argmin(t tensor.Tensor, axis int) (tensor.Tensor, error) {
+	return e.argReduce(OpArgmin, t, axis)
+}
+
+// argReduce computes the Argmax or Argmin op of t along axis.
+func (e *MPSEng) argReduce(op Op, t tensor.Tensor, axis int) (tensor.Tensor, error) {
+	if err := e.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	p, reason := e.planArg(op, t, axis)
+	if reason != ReasonNone {
+		return e.fallbackArg(reason, op, t, axis)
+	}
+	indices, reason := e.execArg(p)
+	if reason != ReasonNone {
+		return e.fallbackArg(reason, op, t, axis)
+	}
+
+	e.stats.recordAccelerated(op)
+	if len(p.shape) == 0 {
+		return tensor.New(tensor.FromScalar(indices[0]), tensor.WithEngine(e)), nil
+	}
+	return tensor.New(tensor.WithShape(p.shape.Clone()...), tensor.WithBacking(indices), tensor.WithEngine(e)), nil
+}
+
+// execArg computes a planned Argmax or Argmin on the engine's backend.
+// It returns the indices in row-major order and ReasonNone on success,
+// or the reason to fall back otherwise. Inputs that are not row-major
+// contiguous are gathered first.
+func (e *MPSEng) execArg(p argPlan) ([]int, FallbackReason) {
+	x := p.data
+	if !p.contiguous {
+		x = e.pool.get(p.a.Shape().TotalSize())
+		defer e.pool.put(x)
+		if err := gatherF32(x, p.a, p.data); err != nil {
+			return nil, ReasonLayout
+		}
+	}
+
+	idx := make([]int32, p.outer*p.inner)
+	reason := e.runBackend(func(be backend) int {
+		return be.argReduceAxisF32(reduceOps[p.op], x, idx, p.outer, p.n, p.inner)
+	})
+	if reason != ReasonNone {
+		return nil, reason
+	}
+
+	indices := make([]int, len(idx))
+	for i, j := range idx {
+		// An index out of range means the kernel did not run as it
+		// reported.
+		if j < 0 || int(j) >= p.n {
+			return nil, ReasonDeviceError
+		}
+		indices[i] = int(j)
+	}
+	return indices, ReasonNone
+}
@@ -0,0 +1,288 @@
+package mps
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// argReductions are Argmax and Argmin, with the StdEng method computing
+// each.
+var argReductions = []struct {
+	op  Op
+	run func(e *MPSEng, t tensor.Tensor, axis int) (tensor.Tensor, error)
+	std func(t tensor.Tensor, axis int) (tensor.Tensor, error)
+}{
+	{OpArgmax, (*MPSEng).Argmax, tensor.StdEng{}.Argmax},
+	{OpArgmin, (*MPSEng).Argmin, tensor.StdEng{}.Argmin},
+}
+
+// naiveArg returns the index along axis, or in row-major order for
+// tensor.AllAxes, of the extreme of every column of a as StdEng finds
+// it, one element at a time: the first NaN or infinity of the extreme's
+// sign after the first element, or otherwise the first extreme, where a
+// NaN first element is never displaced.
+func naiveArg(t *testing.T, op Op, a *tensor.Dense, axis int) []int {
+	t.Helper()
+	values, shape := denseValues(t, a), a.Shape()
+	outer, n, inner := 1, len(values), 1
+	if axis != tensor.AllAxes {
+		outer, n, inner = product(shape[:axis]), shape[axis], product(shape[axis+1:])
+	}
+
+	res := make([]int, outer*inner)
+	sign := 1
+	if op == OpArgmin {
+		sign = -1
+	}
+	for o := 0; o < outer; o++ {
+		for i := 0; i < inner; i++ {
+			arg := 0
+			for j := 1; j < n; j++ {
+				v := float64(values[(o*n+j)*inner+i])
+				if math.IsNaN(v) || math.IsInf(v, sign) {
+					arg = j
+					break
+				}
+				best := float64(values[(o*n+arg)*inner+i])
+				if op == OpArgmax && v > best || op == OpArgmin && v < best {
+					arg = j
+				}
+			}
+			res[o*inner+i] = arg
+		}
+	}
+	return res
+}
+
+// intValues returns the indices an Argmax or Argmin returned, in
+// row-major order.
+func intValues(t *testing.T, d tensor.Tensor) []int {
+	t.Helper()
+	dd, ok := d.(*tensor.Dense)
+	if !ok || dd.Dtype() != tensor.Int {
+		t.Fatalf("indices are a %T of %v, want a *tensor.Dense of int", d, d.Dtype())
+	}
+	// Ints, unlike Data, is a slice for scalars too, and keeps d alive
+	// while it reads it.
+	return dd.Ints()
+}
+
+// Test Argmax and Argmin along every axis and over all of them, from
+// scalars up to rank 4, on contiguous tensors, transposed views and strided slices
+// full of ties, against naiveArg and StdEng. All run on the device.
+func TestArgMatchesStdEng(t *testing.T) {
+	r := rand.New(rand.NewSource(111))
+	shapes := [][]int{
+		{},
+		{7}, {1},
+		{5, 6}, {1, 6}, {3, 300},
+		{3, 4, 5}, {3, 1, 4},
+		{2, 3, 4, 5}, {4, 1, 3, 2},
+	}
+	type input struct {
+		name string
+		a    *tensor.Dense
+	}
+	var inputs []input
+	for _, shape := range shapes {
+		data := make([]float32, product(shape))
+		for i := range data {
+			data[i] = float32(r.Intn(5) - 2)
+		}
+		x := tensor.New(tensor.WithShape(shape...), tensor.WithBacking(data))
+		inputs = append(inputs, input{"contiguous", x})
+		if len(shape) > 1 {
+			tr := x.Clone().(*tensor.Dense)
+			if err := tr.T(); err != nil {
+				t.Fatalf("T error: %v", err)
+			}
+			inputs = append(inputs, input{"transposed", tr})
+		}
+		if len(shape) > 0 && shape[0] >= 3 {
+			sl, err := x.Slice(tensor.S(0, shape[0], 2))
+			if err != nil {
+				t.Fatalf("Slice error: %v", err)
+			}
+			inputs = append(inputs, input{"strided", sl.(*tensor.Dense)})
+		}
+	}
+
+	for _, arg := range argReductions {
+		e := newRefEngine(t)
+		var calls uint64
+		for _, in := range inputs {
+			rank := in.a.Dims()
+			for axis := tensor.AllAxes; axis < rank; axis++ {
+				name := fmt.Sprintf("%v of %v %s along %d", arg.op, in.a.Shape(), in.name, axis)
+				wantShape := tensor.Shape{}
+				if axis != tensor.AllAxes && rank > 1 {
+					wantShape = slices.Delete(slices.Clone(in.a.Shape()), axis, axis+1)
+				}
+
+				got, err := arg.run(e, in.a, axis)
+				if err != nil {
+					t.Fatalf("%s error: %v", name, err)
+				}
+				calls++
+				if !got.Shape().Eq(wantShape) {
+					t.Fatalf("%s has shape %v, want %v", name, got.Shape(), wantShape)
+				}
+				gv := intValues(t, got)
+				if ref := naiveArg(t, arg.op, in.a, axis); !slices.Equal(gv, ref) {
+					t.Fatalf("%s differs from the reference\n got:  %v\n want: %v", name, gv, ref)
+				}
+
+				// StdEng's flat arguments index the backing data rather
+				// than the elements in row-major order.
+				if axis == tensor.AllAxes && in.name != "contiguous" {
+					continue
+				}
+				want, err := arg.std(in.a, axis)
+				if err != nil {
+					t.Fatalf("StdEng %s error: %v", name, err)
+				}
+				if !got.Shape().Eq(want.Shape()) {
+					t.Fatalf("%s has shape %v, StdEng's %v", name, got.Shape(), want.Shape())
+				}
+				if wv := intValues(t, want); !slices.Equal(gv, wv) {
+					t.Fatalf("%s differs from StdEng\n got:  %v\n want: %v", name, gv, wv)
+				}
+			}
+		}
+		if st := e.Stats().Ops[arg.op]; st.Accelerated != calls || st.TotalFallbacks() != 0 {
+			t.Fatalf("%v: expected %d accelerated calls and no fallbacks: %+v", arg.op, calls, st)
+		}
+		if st := e.Stats().Pool; st.BytesInUse != 0 {
+			t.Fatalf("%v: %d pool bytes still in use", arg.op, st.BytesInUse)
+		}
+	}
+}
+
+// Test that NaNs and infinities count as in StdEng wherever they are,
+// along every axis, with long rows taking the cooperative row kernel on
+// the device, against naiveArg and StdEng.
+func TestArgNaN(t *testing.T) {
+	nan, inf := float32(math.NaN()), float32(math.Inf(1))
+	e := newRefEngine(t)
+	for _, arg := range argReductions {
+		check := func(x *tensor.Dense, axis int) {
+			t.Helper()
+			name := fmt.Sprintf("%v along %d of %v", arg.op, axis, x.Float32s())
+			got, err := arg.run(e, x, axis)
+			if err != nil {
+				t.Fatalf("%s error: %v", name, err)
+			}
+			gv := intValues(t, got)
+			if ref := naiveArg(t, arg.op, x, axis); !slices.Equal(gv, ref) {
+				t.Fatalf("%s differs from the reference\n got:  %v\n want: %v", name, gv, ref)
+			}
+			want, err := arg.std(x, axis)
+			if err != nil {
+				t.Fatalf("StdEng %s error: %v", name, err)
+			}
+			if wv := intValues(t, want); !slices.Equal(gv, wv) {
+				t.Fatalf("%s differs from StdEng\n got:  %v\n want: %v", name, gv, wv)
+			}
+		}
+
+		for pos := 0; pos < 12; pos++ {
+			for _, special := range [][3]float32{{nan, inf, -inf}, {inf, -inf, nan}, {-inf, nan, inf}} {
+				data := make([]float32, 12)
+				for i := range data {
+					data[i] = float32(i%5) - 2
+				}
+				data[pos], data[(pos+5)%12], data[(pos+7)%12] = special[0], special[1], special[2]
+				x := tensor.New(tensor.WithShape(2, 3, 2), tensor.WithBacking(data))
+				for axis := tensor.AllAxes; axis < 3; axis++ {
+					check(x, axis)
+				}
+			}
+		}
+
+		// A NaN first element stays unless a NaN or infinity of the
+		// extreme's sign comes after it, and such an infinity after the
+		// first element wins even if the first is one too.
+		for _, data := range [][]float32{
+			{nan, 1, 3, 2}, {nan, 1, inf, 3}, {nan, 1, -inf, 3}, {1, 4, nan, inf},
+			{inf, 1, inf}, {-inf, 1, -inf}, {nan}, {2, 2, 1, 2},
+		} {
+			check(tensor.New(tensor.WithShape(len(data)), tensor.WithBacking(data)), 0)
+		}
+
+		x := randomF32(rand.New(rand.NewSource(113)), 4, 300)
+		data := x.Float32s()
+		for i, v := range map[int]float32{0: nan, 299: inf, 317: -inf, 423: nan, 610: inf, 611: -inf} {
+			data[i] = v
+		}
+		for axis := tensor.AllAxes; axis < 2; axis++ {
+			check(x, axis)
+		}
+	}
+}
+
+// argmaxerEngine is a fallback engine counting its Argmax calls.
+type argmaxerEngine struct {
+	tensor.StdEng
+	calls int
+}
+
+func (a *argmaxerEngine) Argmax(t tensor.Tensor, axis int) (tensor.Tensor, error) {
+	a.calls++
+	return a.StdEng.Argmax(t, axis)
+}
+
+// Test the fallbacks of Argmax and Argmin: inputs the device does not
+// take, failed and misbehaving devices, the fallback engine and strict
+// mode.
+func TestArgFallbacks(t *testing.T) {
+	r := rand.New(rand.NewSource(112))
+	x := randomF32(r, 4, 6)
+	want := naiveArg(t, OpArgmax, x, 1)
+
+	e := newRefEngine(t)
+	x64 := tensor.New(tensor.WithShape(2, 3), tensor.WithBacking([]float64{1, 7, 3, 9, 5, 9}))
+	got, err := e.Argmax(x64, 1)
+	if err != nil || !slices.Equal(intValues(t, got), []int{1, 0}) {
+		t.Fatalf("float64 Argmax = %v, %v; want [1 0]", got, err)
+	}
+	if _, err := e.Argmin(x, 2); err == nil {
+		t.Fatalf("Argmin accepted an axis out of range")
+	}
+	st := e.Stats()
+	if st.Ops[OpArgmax].Fallbacks[ReasonDtype] != 1 || st.Ops[OpArgmin].Fallbacks[ReasonAxis] != 1 {
+		t.Fatalf("unexpected fallbacks: %+v, %+v", st.Ops[OpArgmax], st.Ops[OpArgmin])
+	}
+
+	// Failing devices, and devices that report success without writing
+	// valid indices, fall back to StdEng.
+	for _, f := range []fault{{status: -8}, {corrupt: true}} {
+		e := newRefEngine(t, withBackend(newFailingBackend(f)))
+		got, err := e.Argmax(x, 1)
+		if err != nil || !slices.Equal(intValues(t, got), want) {
+			t.Fatalf("Argmax on a device failing with %+v = %v, %v; want %v", f, got, err, want)
+		}
+		if st := e.Stats().Ops[OpArgmax]; st.Fallbacks[ReasonDeviceError] != 1 {
+			t.Fatalf("expected a device error fallback for %+v: %+v", f, st)
+		}
+	}
+
+	ae := &argmaxerEngine{}
+	ef := NewMPSEng(WithFallbackEngine(ae), WithOpEnabled(OpArgmax, false))
+	defer ef.Close()
+	if got, err := ef.Argmax(x, 1); err != nil || !slices.Equal(intValues(t, got), want) || ae.calls != 1 {
+		t.Fatalf("Argmax with a fallback Argmaxer = %v, %v after %d calls", got, err, ae.calls)
+	}
+
+	var fe *FallbackError
+	strict := NewMPSEng(WithStrict(true))
+	defer strict.Close()
+	if _, err := strict.Argmin(x64, 0); !errors.As(err, &fe) || fe.Op != OpArgmin || fe.Reason != ReasonDtype {
+		t.Fatalf("strict Argmin: expected a dtype FallbackError, got %v", err)
+	}
+}
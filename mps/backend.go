@@ -0,0 +1,100 @@
+// backend.go
+//
+// The device backend interface. MPSEng plans, stages and falls back in
+// portable Go; only the kernels themselves run behind a backend: Metal
+// on darwin (backend_darwin.go), or the pure-Go reference backend
+// (backend_ref.go) that implements the same kernels on every platform.
+
+package mps
+
+// backend executes float32 kernels on a device. All buffers are
+// contiguous and row-major. Like the C bridge, every kernel returns 0 on
+// success and a non-zero, backend-specific status on failure, in which
+// case the engine falls back to the CPU.
+//
+// Backends must be safe for concurrent use; the engine guarantees that
+// release is not called while a kernel is running.
+type backend interface {
+	// deviceName identifies the device, e.g. for tuning profiles.
+	deviceName() string
+
+	// maxBufferBytes is the size of the largest buffer the device
+	// accepts, or 0 if it has no limit. The engine tiles matrix products
+	// whose operands would exceed it.
+	maxBufferBytes() int64
+
+	// matMulF32 computes g.c = g.alpha * g.a x g.b + g.beta * g.c,
+	// followed by g's epilogue.
+	matMulF32(g gemmArgs) int
+
+	// batchedMatMulF32 computes batch independent products of the shape
+	// described by g. g.a, g.b and g.c each hold batch matrices stored
+	// back to back.
+	batchedMatMulF32(g gemmArgs, batch int) int
+
+	// reduceAxisF32 reduces the middle axis of the outer x n x inner
+	// array x with op into the outer x inner array y: y[o, i] is op over
+	// j of x[o, j, i], in order as reduceOp.combine folds them. With
+	// inner 1 it reduces the rows of an outer x n matrix. y must not
+	// overlap x.
+	reduceAxisF32(op reduceOp, x, y []float32, outer, n, inner int) int
+
+	// argReduceAxisF32 is reduceAxisF32 for arguments: idx[o, i] is the
+	// j of the first maximum (op reduceMax) or minimum (reduceMin) of
+	// x[o, j, i], with NaNs and infinities treated as StdEng treats them
+	// (see reduceOp.better and reduceOp.ends).
+	argReduceAxisF32(op reduceOp, x []float32, idx []int32, outer, n, inner int) int
+
+	// release frees the backend's native resources.
+	release()
+}
+
+// gemmArgs describes C = alpha * A x B + beta * C for an (m x k) matrix
+// A, a (k x n) matrix B and an (m x n) matrix C. When beta is 0 the
+// previous contents of c are ignored, NaNs included, as in BLAS; a plain
+// product therefore has alpha 1 and beta 0.
+//
+// When transA is set, a holds the (k x m) transpose of A row-major
+// instead of A itself, and likewise for transB; MPS reads such operands
+// in place through its transpose flags.
+//
+// The epilogue then adds bias, if not nil, to every row of C and applies
+// act, in the same submission. Only matMulF32 honors the transpose flags
+// and the epilogue.
+type gemmArgs struct {
+	a, b, c        []float32
+	m, n, k        int
+	transA, transB bool
+	alpha, beta    float32
+
+	bias []float32
+	act  Activation
+
+	// prec is the product's precision policy. Backends only act on
+	// PrecisionFast; compensated products reach them as standard blocks.
+	prec Precision
+}
+
+// runBackend calls fn with the engine's backend, holding it open for the
+// duration of the call so that a concurrent Close cannot release it, and
+// translates fn's status into a FallbackReason.
+func (e *MPSEng) runBackend(fn func(be backend) int) FallbackReason {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.be == nil {
+		return ReasonNoDevice
+	}
+	if status := fn(e.be); status != 0 {
+		return ReasonDeviceError
+	}
+	return ReasonNone
+}
+
+// withBackend makes the engine use be instead of the platform default.
+// It exists for tests, which use it to run the whole dispatch pipeline
+// on the reference backend.
+func withBackend(be backend) Option {
+	return func(c *config) {
+		c.backend = be
+	}
+}
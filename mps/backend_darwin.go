@@ -0,0 +1,106 @@
+//go:build darwin && cgo
+
+// backend_darwin.go
+//
+// Metal backend: forwards the backend kernels to the Objective-C bridge
+// in mps_matmul.m and mps_reduce.m, using the engine context created in
+// engine_darwin.go.
+
+package mps
+
+/*
+#cgo darwin CFLAGS: -fobjc-arc
+#cgo darwin LDFLAGS: -framework Metal -framework MetalPerformanceShaders -framework Foundation
+#include "mps_engine_ctx.h"
+#include "mps_matmul.h"
+#include "mps_reduce.h"
+*/
+import "C"
+
+import "unsafe"
+
+// metalBackend owns an engine context (Metal device, command queue and
+// compiled pipelines).
+type metalBackend struct {
+	ctx C.MPSEngineContext
+}
+
+func (b *metalBackend) deviceName() string { return defaultDeviceName() }
+
+func (b *metalBackend) maxBufferBytes() int64 {
+	return int64(C.MPSEngineMaxBufferLength(b.ctx))
+}
+
+func (b *metalBackend) matMulF32(g gemmArgs) int {
+	var bias *C.float
+	if g.bias != nil {
+		bias = (*C.float)(&g.bias[0])
+	}
+	return int(C.mpsMatMulFloat32(
+		b.ctx,
+		(*C.float)(&g.a[0]),
+		(*C.float)(&g.b[0]),
+		(*C.float)(&g.c[0]),
+		C.int(g.m),
+		C.int(g.n),
+		C.int(g.k),
+		cBool(g.transA),
+		cBool(g.transB),
+		C.float(g.alpha),
+		C.float(g.beta),
+		bias,
+		C.int(g.act),
+		cBool(g.prec == PrecisionFast),
+	))
+}
+
+// cBool converts a Go bool to a C int flag.
+func cBool(v bool) C.int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func (b *metalBackend) batchedMatMulF32(g gemmArgs, batch int) int {
+	return int(C.mpsBatchedMatMulFloat32(
+		b.ctx,
+		(*C.float)(&g.a[0]),
+		(*C.float)(&g.b[0]),
+		(*C.float)(&g.c[0]),
+		C.int(batch),
+		C.int(g.m),
+		C.int(g.n),
+		C.int(g.k),
+		C.float(g.alpha),
+		C.float(g.beta),
+	))
+}
+
+func (b *metalBackend) reduceAxisF32(op reduceOp, x, y []float32, outer, n, inner int) int {
+	return int(C.mpsReduceAxisFloat32(
+		b.ctx,
+		C.int(op),
+		(*C.float)(&x[0]),
+		(*C.float)(&y[0]),
+		C.int(outer),
+		C.int(n),
+		C.int(inner),
+	))
+}
+
+func (b *metalBackend) argReduceAxisF32(op reduceOp, x []float32, idx []int32, outer, n, inner int) int {
+	return int(C.mpsArgReduceAxisFloat32(
+		b.ctx,
+		C.int(op),
+		(*C.float)(&x[0]),
+		(*C.int)(unsafe.Pointer(&idx[0])),
+		C.int(outer),
+		C.int(n),
+		C.int(inner),
+	))
+}
+
+func (b *metalBackend) release() {
+	C.MPSEngineReleaseContext(b.ctx)
+}
@@ -0,0 +1,134 @@
+// backend_ref.go
+//
+// Pure-Go reference implementation of the backend kernels. It is slow
+// but simple and runs everywhere, which lets tests exercise the full
+// MPSEng pipeline (planning, staging, scatter-back, stats) on platforms
+// without Metal.
+
+package mps
+
+// refDeviceName is the device name reported by the reference backend.
+const refDeviceName = "reference"
+
+type refBackend struct{}
+
+func newRefBackend() *refBackend { return &refBackend{} }
+
+func (*refBackend) deviceName() string { return refDeviceName }
+
+func (*refBackend) maxBufferBytes() int64 { return 0 }
+
+func (*refBackend) matMulF32(g gemmArgs) int {
+	// Element strides of A and B as stored.
+	ai, ap := g.k, 1
+	if g.transA {
+		ai, ap = 1, g.m
+	}
+	bp, bj := g.n, 1
+	if g.transB {
+		bp, bj = 1, g.k
+	}
+	a, b := g.a, g.b
+	if g.prec == PrecisionFast {
+		// Round the operands to float16 as the Metal backend does.
+		a, b = roundedToHalf(a), roundedToHalf(b)
+	}
+	acc := make([]float32, g.n)
+	for i := 0; i < g.m; i++ {
+		for j := range acc {
+			acc[j] = 0
+		}
+		for p := 0; p < g.k; p++ {
+			aip := a[i*ai+p*ap]
+			for j := range acc {
+				acc[j] += aip * b[p*bp+j*bj]
+			}
+		}
+		crow := g.c[i*g.n : (i+1)*g.n]
+		for j, v := range acc {
+			if g.beta == 0 {
+				crow[j] = g.alpha * v
+			} else {
+				crow[j] = g.alpha*v + g.beta*crow[j]
+			}
+		}
+		if g.bias != nil || g.act != ActNone {
+			epilogueRowF32(crow, g.bias, g.act)
+		}
+	}
+	return 0
+}
+
+func (rb *refBackend) batchedMatMulF32(g gemmArgs, batch int) int {
+	sa, sb, sc := g.m*g.k, g.k*g.n, g.m*g.n
+	for i := 0; i < batch; i++ {
+		sub := g
+		sub.a = g.a[i*sa : (i+1)*sa]
+		sub.b = g.b[i*sb : (i+1)*sb]
+		sub.c = g.c[i*sc : (i+1)*sc]
+		sub.transA, sub.transB = false, false
+		sub.bias, sub.act = nil, ActNone
+		rb.matMulF32(sub)
+	}
+	return 0
+}
+
+func (*refBackend) reduceAxisF32(op reduceOp, x, y []float32, outer, n, inner int) int {
+	if !op.valid() {
+		return -3
+	}
+	// Each column starts from its first element, as in StdEng, which
+	// the maximum and minimum need to treat NaNs as it does.
+	if n == 0 {
+		for i := range y[:outer*inner] {
+			y[i] = op.identity()
+		}
+		return 0
+	}
+	if inner == 1 {
+		for o := 0; o < outer; o++ {
+			acc := x[o*n]
+			for _, v := range x[o*n+1 : (o+1)*n] {
+				acc = op.combine(acc, v)
+			}
+			y[o] = acc
+		}
+		return 0
+	}
+	for o := 0; o < outer; o++ {
+		acc := y[o*inner : (o+1)*inner]
+		copy(acc, x[o*n*inner:(o*n+1)*inner])
+		for j := 1; j < n; j++ {
+			for i, v := range x[(o*n+j)*inner : (o*n+j+1)*inner] {
+				acc[i] = op.combine(acc[i], v)
+			}
+		}
+	}
+	return 0
+}
+
+func (*refBackend) argReduceAxisF32(op reduceOp, x []float32, idx []int32, outer, n, inner int) int {
+	if op != reduceMax && op != reduceMin {
+		return -3
+	}
+	for o := 0; o < outer; o++ {
+		for i := 0; i < inner; i++ {
+			base := o*n*inner + i
+			best, arg := x[base], 0
+			for j := 1; j < n; j++ {
+				v := x[base+j*inner]
+				if op.ends(v) {
+					arg = j
+					break
+				}
+				if op.better(v, best) {
+					best, arg = v, j
+				}
+			}
+			idx[o*inner+i] = int32(arg)
+		}
+	}
+	return 0
+}
+
+func (*refBackend) release() {}
@@ -0,0 +1,185 @@
+package mps
+
+import (
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// newRefEngine returns an engine that runs every supported op, however
+// small, on the pure-Go reference backend.
+func newRefEngine(t testing.TB, opts ...Option) *MPSEng {
+	t.Helper()
+	e := NewMPSEng(append([]Option{WithMinFLOPs(0), withBackend(newRefBackend())}, opts...)...)
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// transposedView returns a rows x cols view that is the transpose of a
+// fresh cols x rows row-major matrix, without materializing it.
+func transposedView(t *testing.T, rows, cols int, r *rand.Rand) *tensor.Dense {
+	t.Helper()
+	d := newRandomFloat32Matrix(t, cols, rows, r)
+	if err := d.T(); err != nil {
+		t.Fatalf("T() error: %v", err)
+	}
+	return d
+}
+
+// slicedView returns a rows x cols view into the interior of a larger
+// row-major matrix, so its rows are not contiguous.
+func slicedView(t *testing.T, rows, cols int, r *rand.Rand) *tensor.Dense {
+	t.Helper()
+	d := newRandomFloat32Matrix(t, rows+2, cols+3, r)
+	v, err := d.Slice(tensor.S(1, rows+1), tensor.S(2, cols+2))
+	if err != nil {
+		t.Fatalf("Slice error: %v", err)
+	}
+	return v.(*tensor.Dense)
+}
+
+// denseValues returns the logical contents of a float32 or float64
+// tensor of any rank, scalars included, as float32 in row-major order.
+// It reads them one by one through At, independently of the staging
+// code under test.
+func denseValues(t *testing.T, d *tensor.Dense) []float32 {
+	t.Helper()
+	shape := d.Shape()
+	out := make([]float32, shape.TotalSize())
+	coords := make([]int, len(shape))
+	for i := range out {
+		for axis, pos := len(shape)-1, i; axis >= 0; axis-- {
+			coords[axis] = pos % shape[axis]
+			pos /= shape[axis]
+		}
+		v, err := d.At(coords...)
+		if err != nil {
+			t.Fatalf("At(%v) error: %v", coords, err)
+		}
+		switch x := v.(type) {
+		case float32:
+			out[i] = x
+		case float64:
+			out[i] = float32(x)
+		default:
+			t.Fatalf("unexpected element type %T", v)
+		}
+	}
+	return out
+}
+
+// Test the whole MatMul pipeline, including staging and scatter-back of
+// non-row-major operands, on the reference backend.
+func TestRefBackendMatMulLayouts(t *testing.T) {
+	const m, k, n = 5, 4, 3
+	r := rand.New(rand.NewSource(11))
+
+	makers := map[string]func(rows, cols int) *tensor.Dense{
+		"rowmajor":   func(rows, cols int) *tensor.Dense { return newRandomFloat32Matrix(t, rows, cols, r) },
+		"transposed": func(rows, cols int) *tensor.Dense { return transposedView(t, rows, cols, r) },
+		"sliced":     func(rows, cols int) *tensor.Dense { return slicedView(t, rows, cols, r) },
+	}
+
+	for aName, makeA := range makers {
+		for bName, makeB := range makers {
+			for _, cName := range []string{"rowmajor", "sliced"} {
+				t.Run(aName+"_"+bName+"_"+cName, func(t *testing.T) {
+					a, b := makeA(m, k), makeB(k, n)
+					want := newZeroFloat32Matrix(m, n)
+					var cpu tensor.StdEng
+					if err := cpu.MatMul(tensor.New(tensor.WithShape(m, k), tensor.WithBacking(denseValues(t, a))),
+						tensor.New(tensor.WithShape(k, n), tensor.WithBacking(denseValues(t, b))), want); err != nil {
+						t.Fatalf("StdEng.MatMul error: %v", err)
+					}
+
+					c := newZeroFloat32Matrix(m, n)
+					if cName == "sliced" {
+						c = slicedView(t, m, n, r)
+					}
+					e := newRefEngine(t)
+					if err := e.MatMul(a, b, c); err != nil {
+						t.Fatalf("MatMul error: %v", err)
+					}
+					if st := e.Stats().Ops[OpMatMul]; st.Accelerated != 1 {
+						t.Fatalf("MatMul not run on the backend: %+v", st)
+					}
+					if got := denseValues(t, c); !equalApprox(got, extractFloat32Backing(t, want), 1e-5) {
+						t.Fatalf("result differs from StdEng\n got:  %v\n want: %v", got, extractFloat32Backing(t, want))
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestRefBackendSumMatchesStdEng(t *testing.T) {
+	r := rand.New(rand.NewSource(12))
+	x := newRandomFloat32Matrix(t, 6, 9, r)
+
+	var cpu tensor.StdEng
+	want, err := cpu.Sum(x.Clone().(*tensor.Dense), 1)
+	if err != nil {
+		t.Fatalf("StdEng.Sum error: %v", err)
+	}
+
+	e := newRefEngine(t)
+	got, err := e.Sum(x, -1)
+	if err != nil {
+		t.Fatalf("Sum error: %v", err)
+	}
+	if st := e.Stats().Ops[OpSum]; st.Accelerated != 1 {
+		t.Fatalf("Sum not run on the backend: %+v", st)
+	}
+	n := want.Shape().TotalSize()
+	if !equalApprox(got.Data().([]float32)[:n], want.Data().([]float32)[:n], 1e-5) {
+		t.Fatalf("result differs from StdEng\n got:  %v\n want: %v", got.Data(), want.Data())
+	}
+}
+
+// Test that packing a view and scattering it back into a view of the same
+// shape reproduces its logical contents.
+func TestRowMajorStagingRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(13))
+	for name, src := range map[string]*tensor.Dense{
+		"rowmajor":   newRandomFloat32Matrix(t, 3, 4, r),
+		"transposed": transposedView(t, 3, 4, r),
+		"sliced":     slicedView(t, 3, 4, r),
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf, alias, err := denseToRowMajor2DF32(src, nil)
+			if err != nil {
+				t.Fatalf("denseToRowMajor2DF32 error: %v", err)
+			}
+			if alias != (name == "rowmajor") {
+				t.Fatalf("alias = %v for %s layout", alias, name)
+			}
+			for i := 0; i < 3; i++ {
+				for j := 0; j < 4; j++ {
+					v, err := src.At(i, j)
+					if err != nil {
+						t.Fatalf("At error: %v", err)
+					}
+					if buf[i*4+j] != v.(float32) {
+						t.Fatalf("buf[%d,%d] = %v, want %v", i, j, buf[i*4+j], v)
+					}
+				}
+			}
+
+			dst := slicedView(t, 3, 4, r)
+			if err := rowMajor2DToDenseF32(buf, dst); err != nil {
+				t.Fatalf("rowMajor2DToDenseF32 error: %v", err)
+			}
+			if got := denseValues(t, dst); !equalApprox(got, buf, 0) {
+				t.Fatalf("scatter mismatch\n got:  %v\n want: %v", got, buf)
+			}
+		})
+	}
+}
+
+func TestRefBackendDeviceName(t *testing.T) {
+	e := newRefEngine(t)
+	if got := e.Profile().Device; got != refDeviceName {
+		t.Fatalf("Profile().Device = %q, want %q", got, refDeviceName)
+	}
+}
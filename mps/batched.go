@@ -0,0 +1,208 @@
+// batched.go
+//
+// BatchedMatMul: matrix products over the leading (batch) dims of rank-3
+// and higher float32 tensors, with NumPy-style broadcasting of the batch
+// dims, executed as a single batched device call.
+
+package mps
+
+import (
+	"fmt"
+
+	"gorgonia.org/tensor"
+)
+
+// BatchedMatMul computes prealloc[i] = a[i] x b[i] for every index i of
+// the leading (batch) dims, where a is [..., M, K], b is [..., K, N] and
+// prealloc is [..., M, N]. The batch dims of a and b broadcast against
+// each other as in NumPy, so [B, M, K] x [K, N] multiplies every matrix
+// of a by the same b, and prealloc must have the broadcast batch shape.
+//
+// float32 Dense operands of any layout run as one batched call on the
+// GPU. Everything else, or problems the dispatch policy rejects, falls
+// back to one MatMul per batch entry on the fallback engine (StdEng by
+// default), recording the reason in Stats. Inconsistent shapes are
+// reported as errors.
+func (e *MPSEng) BatchedMatMul(a, b, prealloc tensor.Tensor) error {
+	if err := e.checkOpen(); err != nil {
+		return err
+	}
+
+	p, reason, err := e.planBatchedMatMul(a, b, prealloc)
+	if err != nil {
+		return err
+	}
+	if reason != ReasonNone {
+		return e.fallbackBatchedMatMul(reason, p.batch, a, b, prealloc)
+	}
+	if reason := e.execBatchedMatMul(p); reason != ReasonNone {
+		return e.fallbackBatchedMatMul(reason, p.batch, a, b, prealloc)
+	}
+
+	e.stats.recordAccelerated(OpBatchedMatMul)
+	return nil
+}
+
+// execBatchedMatMul runs a planned BatchedMatMul on the engine's
+// backend. Operands are staged into back-to-back row-major matrices, one
+// per batch entry, which materializes any broadcasting; operands that
+// already have that layout are used in place. When b is shared by the
+// whole batch the products collapse into a single (count*m x k) by
+// (k x n) MatMul.
+func (e *MPSEng) execBatchedMatMul(p batchedPlan) FallbackReason {
+	m, n, k, count := p.m, p.n, p.k, p.count
+	shared := batchCount(p.b.Shape()[:p.b.Dims()-2]) == 1
+
+	abuf, aliasA, err := e.stageBatch(p.a, p.batch, m, k)
+	if err != nil {
+		return ReasonLayout
+	}
+	if !aliasA {
+		defer e.pool.put(abuf)
+	}
+	bBatch := p.batch
+	if shared {
+		bBatch = nil
+	}
+	bbuf, aliasB, err := e.stageBatch(p.b, bBatch, k, n)
+	if err != nil {
+		return ReasonLayout
+	}
+	if !aliasB {
+		defer e.pool.put(bbuf)
+	}
+
+	var cbuf []float32
+	useDirect := false
+	if cdata, ok := p.c.Data().([]float32); ok && isRowMajorContiguous(p.c) && len(cdata) >= count*m*n &&
+		!sharesMemory(p.c, p.a) && !sharesMemory(p.c, p.b) {
+		cbuf = cdata[:count*m*n]
+		useDirect = true
+	} else {
+		cbuf = e.pool.get(count * m * n)
+		defer e.pool.put(cbuf)
+	}
+
+	reason := e.runBackend(func(be backend) int {
+		if shared {
+			return be.matMulF32(gemmArgs{a: abuf, b: bbuf, c: cbuf, m: count * m, n: n, k: k, alpha: 1})
+		}
+		return be.batchedMatMulF32(gemmArgs{a: abuf, b: bbuf, c: cbuf, m: m, n: n, k: k, alpha: 1}, count)
+	})
+	if reason != ReasonNone {
+		return reason
+	}
+
+	if !useDirect {
+		err := forEachBatchIndex(p.batch, func(i int, idx []int) error {
+			cs, err := batchSlice(p.c, idx)
+			if err != nil {
+				return err
+			}
+			return rowMajor2DToDenseF32(cbuf[i*m*n:(i+1)*m*n], cs.(*tensor.Dense))
+		})
+		if err != nil {
+			return ReasonLayout
+		}
+	}
+	return ReasonNone
+}
+
+// stageBatch lays d out as batchCount(batch) back-to-back row-major
+// rows x cols matrices, broadcasting d's batch dims to batch. If d
+// already has exactly that layout its backing slice is returned with
+// alias=true; otherwise the buffer comes from the engine's pool and the
+// caller must put it back.
+func (e *MPSEng) stageBatch(d *tensor.Dense, batch tensor.Shape, rows, cols int) (buf []float32, alias bool, err error) {
+	count, size := batchCount(batch), rows*cols
+	// d's batch dims broadcast to batch, so if they hold as many entries
+	// nothing is repeated and a contiguous d is already laid out as wanted.
+	lead := batchCount(d.Shape()[:d.Dims()-2])
+	if data, ok := d.Data().([]float32); ok && lead == count && isRowMajorContiguous(d) && len(data) >= count*size {
+		return data[:count*size], true, nil
+	}
+
+	buf = e.pool.get(count * size)
+	err = forEachBatchIndex(batch, func(i int, idx []int) error {
+		s, err := batchSlice(d, idx)
+		if err != nil {
+			return err
+		}
+		return packRowMajor2DF32(buf[i*size:(i+1)*size], s.(*tensor.Dense))
+	})
+	if err != nil {
+		e.pool.put(buf)
+		return nil, false, err
+	}
+	return buf, false, nil
+}
+
+// forEachBatchIndex calls fn with every index of the batch shape, in
+// row-major order, together with its position i in that order. An empty
+// batch shape has exactly one (empty) index.
+func forEachBatchIndex(batch tensor.Shape, fn func(i int, idx []int) error) error {
+	for _, d := range batch {
+		if d == 0 {
+			return nil
+		}
+	}
+	idx := make([]int, len(batch))
+	for i := 0; ; i++ {
+		if err := fn(i, idx); err != nil {
+			return err
+		}
+		// Advance idx like an odometer.
+		j := len(idx) - 1
+		for ; j >= 0; j-- {
+			idx[j]++
+			if idx[j] < batch[j] {
+				break
+			}
+			idx[j] = 0
+		}
+		if j < 0 {
+			return nil
+		}
+	}
+}
+
+// batchSlice returns the matrix of t at batch index idx, where idx
+// indexes the broadcast batch shape: t's batch dims are aligned with the
+// trailing entries of idx and dims of size 1 are broadcast.
+func batchSlice(t tensor.Tensor, idx []int) (tensor.Tensor, error) {
+	shape := t.Shape()
+	lead := len(shape) - 2
+	if lead == 0 {
+		return t, nil
+	}
+	slices := make([]tensor.Slice, lead)
+	for i := range slices {
+		j := 0
+		if shape[i] != 1 {
+			j = idx[len(idx)-lead+i]
+		}
+		slices[i] = tensor.S(j)
+	}
+	v, err := t.Slice(slices...)
+	if err != nil {
+		return nil, fmt.Errorf("mps: slicing batch %v of %v: %w", idx, shape, err)
+	}
+	// Slicing a 1x1 matrix out of t yields a scalar view; restore the
+	// matrix shape, which keeps sharing t's storage.
+	if v.Dims() != 2 {
+		if err := v.Reshape(shape[lead], shape[lead+1]); err != nil {
+			return nil, fmt.Errorf("mps: slicing batch %v of %v: %w", idx, shape, err)
+		}
+	}
+	return v, nil
+}
+
+// batchCount is the number of matrices in a batch shape. Unlike
+// tensor.Shape.TotalSize it counts an empty shape as one entry.
+func batchCount(batch []int) int {
+	n := 1
+	for _, d := range batch {
+		n *= d
+	}
+	return n
+}
@@ -0,0 +1,180 @@
+package mps
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// randomF32 returns a row-major float32 Dense of the given shape.
+func randomF32(r *rand.Rand, shape ...int) *tensor.Dense {
+	data := make([]float32, tensor.Shape(shape).TotalSize())
+	for i := range data {
+		data[i] = float32(r.NormFloat64())
+	}
+	return tensor.New(tensor.WithShape(shape...), tensor.WithBacking(data))
+}
+
+// perSliceMatMul is the reference for BatchedMatMul: one StdEng MatMul
+// per batch entry, returned as back-to-back row-major m x n matrices.
+func perSliceMatMul(t *testing.T, a, b *tensor.Dense, batch tensor.Shape) []float32 {
+	t.Helper()
+	var out []float32
+	err := forEachBatchIndex(batch, func(_ int, idx []int) error {
+		as, err := batchSlice(a, idx)
+		if err != nil {
+			return err
+		}
+		bs, err := batchSlice(b, idx)
+		if err != nil {
+			return err
+		}
+		out = append(out, stdMatMul(t, as.(*tensor.Dense), bs.(*tensor.Dense))...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("per-slice reference: %v", err)
+	}
+	return out
+}
+
+func TestBatchedMatMulParity(t *testing.T) {
+	r := rand.New(rand.NewSource(41))
+
+	transposed := func(shape ...int) *tensor.Dense {
+		n := len(shape)
+		d := randomF32(r, append(append([]int{}, shape[:n-2]...), shape[n-1], shape[n-2])...)
+		axes := make([]int, n)
+		for i := range axes {
+			axes[i] = i
+		}
+		axes[n-2], axes[n-1] = n-1, n-2
+		if err := d.T(axes...); err != nil {
+			t.Fatalf("T error: %v", err)
+		}
+		return d
+	}
+
+	cases := []struct {
+		name   string
+		a, b   func() *tensor.Dense
+		cshape []int
+	}{
+		{"batch", func() *tensor.Dense { return randomF32(r, 2, 3, 4) }, func() *tensor.Dense { return randomF32(r, 2, 4, 5) }, []int{2, 3, 5}},
+		{"shared b", func() *tensor.Dense { return randomF32(r, 2, 3, 4) }, func() *tensor.Dense { return randomF32(r, 4, 5) }, []int{2, 3, 5}},
+		{"shared b with unit batch", func() *tensor.Dense { return randomF32(r, 2, 3, 4) }, func() *tensor.Dense { return randomF32(r, 1, 4, 5) }, []int{2, 3, 5}},
+		{"shared a", func() *tensor.Dense { return randomF32(r, 3, 4) }, func() *tensor.Dense { return randomF32(r, 2, 4, 5) }, []int{2, 3, 5}},
+		{"broadcast both", func() *tensor.Dense { return randomF32(r, 2, 1, 3, 4) }, func() *tensor.Dense { return randomF32(r, 3, 4, 5) }, []int{2, 3, 3, 5}},
+		{"vectors", func() *tensor.Dense { return randomF32(r, 2, 1, 4) }, func() *tensor.Dense { return randomF32(r, 2, 4, 1) }, []int{2, 1, 1}},
+		{"transposed a", func() *tensor.Dense { return transposed(2, 3, 4) }, func() *tensor.Dense { return randomF32(r, 2, 4, 5) }, []int{2, 3, 5}},
+		{"transposed b", func() *tensor.Dense { return randomF32(r, 3, 3, 4) }, func() *tensor.Dense { return transposed(3, 4, 2) }, []int{3, 3, 2}},
+		{"rank 2", func() *tensor.Dense { return randomF32(r, 3, 4) }, func() *tensor.Dense { return randomF32(r, 4, 5) }, []int{3, 5}},
+	}
+
+	engines := []struct {
+		name   string
+		opts   []Option
+		reason FallbackReason
+	}{
+		{"device", []Option{withBackend(newRefBackend())}, ReasonNone},
+		{"fallback", []Option{WithOpEnabled(OpBatchedMatMul, false)}, ReasonDisabled},
+		{"device error", []Option{withBackend(newFailingBackend(fault{status: 1, corrupt: true}))}, ReasonDeviceError},
+	}
+
+	for _, tc := range cases {
+		for _, eng := range engines {
+			t.Run(tc.name+"/"+eng.name, func(t *testing.T) {
+				a, b := tc.a(), tc.b()
+				c := tensor.New(tensor.WithShape(tc.cshape...), tensor.Of(tensor.Float32))
+				batch := tensor.Shape(tc.cshape[:len(tc.cshape)-2])
+
+				e := NewMPSEng(append([]Option{WithMinFLOPs(0)}, eng.opts...)...)
+				defer e.Close()
+				if err := e.BatchedMatMul(a, b, c); err != nil {
+					t.Fatalf("BatchedMatMul error: %v", err)
+				}
+				if got, want := denseValues(t, c), perSliceMatMul(t, a, b, batch); !equalApprox(got, want, 1e-5) {
+					t.Fatalf("result differs from per-slice MatMul\n got:  %v\n want: %v", got, want)
+				}
+
+				st := e.Stats().Ops[OpBatchedMatMul]
+				if eng.reason == ReasonNone {
+					if st.Accelerated != 1 {
+						t.Fatalf("not accelerated: %+v", st)
+					}
+				} else if st.Fallbacks[eng.reason] != 1 {
+					t.Fatalf("expected one %v fallback: %+v", eng.reason, st)
+				}
+			})
+		}
+	}
+}
+
+// Test that results are scattered back into an output view whose
+// matrices are not contiguous.
+func TestBatchedMatMulStridedOutput(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	a, b := randomF32(r, 2, 3, 4), randomF32(r, 2, 4, 5)
+	wide := tensor.New(tensor.WithShape(2, 3, 7), tensor.Of(tensor.Float32))
+	v, err := wide.Slice(nil, nil, tensor.S(1, 6))
+	if err != nil {
+		t.Fatalf("Slice error: %v", err)
+	}
+	c := v.(*tensor.Dense)
+
+	e := newRefEngine(t)
+	if err := e.BatchedMatMul(a, b, c); err != nil {
+		t.Fatalf("BatchedMatMul error: %v", err)
+	}
+	batch := tensor.Shape{2}
+	if got, want := denseValues(t, c), perSliceMatMul(t, a, b, batch); !equalApprox(got, want, 1e-5) {
+		t.Fatalf("result differs from per-slice MatMul\n got:  %v\n want: %v", got, want)
+	}
+	if st := e.Stats(); st.Ops[OpBatchedMatMul].Accelerated != 1 || st.Pool.BytesInUse != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestBatchedMatMulShapeErrors(t *testing.T) {
+	cases := []struct {
+		name       string
+		a, b, c    []int
+		wantSubstr string
+	}{
+		{"rank 1", []int{4}, []int{4, 5}, []int{5}, "rank"},
+		{"inner dims", []int{2, 3, 4}, []int{2, 5, 6}, []int{2, 3, 6}, "inner dims"},
+		{"batch dims", []int{2, 3, 4}, []int{3, 4, 5}, []int{2, 3, 5}, "broadcast"},
+		{"prealloc batch", []int{2, 3, 4}, []int{2, 4, 5}, []int{3, 3, 5}, "prealloc"},
+		{"prealloc rank", []int{2, 3, 4}, []int{4, 5}, []int{6, 5}, "prealloc"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newRefEngine(t)
+			f32 := func(shape []int) *tensor.Dense {
+				return tensor.New(tensor.WithShape(shape...), tensor.Of(tensor.Float32))
+			}
+			err := e.BatchedMatMul(f32(tc.a), f32(tc.b), f32(tc.c))
+			if err == nil || !strings.Contains(err.Error(), tc.wantSubstr) {
+				t.Fatalf("got error %v, want one mentioning %q", err, tc.wantSubstr)
+			}
+			if st := e.Stats().Ops[OpBatchedMatMul]; st.Accelerated+st.TotalFallbacks() != 0 {
+				t.Fatalf("invalid shapes must not be dispatched: %+v", st)
+			}
+		})
+	}
+}
+
+func TestStrictBatchedMatMul(t *testing.T) {
+	e := newRefEngine(t, WithStrict(true))
+	f64 := func(shape ...int) *tensor.Dense {
+		return tensor.New(tensor.WithShape(shape...), tensor.Of(tensor.Float64))
+	}
+	err := e.BatchedMatMul(f64(2, 3, 4), f64(2, 4, 5), f64(2, 3, 5))
+	var fe *FallbackError
+	if !errors.As(err, &fe) || fe.Op != OpBatchedMatMul || fe.Reason != ReasonDtype {
+		t.Fatalf("expected dtype FallbackError, got %v", err)
+	}
+}
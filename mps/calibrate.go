@@ -0,0 +1,153 @@
+// calibrate.go
+//
+// Calibrate measures every accelerated op on both StdEng and the GPU at
+// a ladder of problem sizes and installs the crossover thresholds fitted
+// by fitThreshold (see costmodel.go).
+
+package mps
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"gorgonia.org/tensor"
+)
+
+// ErrNoDevice is returned by operations that need a Metal device on an
+// engine that does not have one.
+var ErrNoDevice = errors.New("mps: no Metal device available")
+
+// calibrationSizes are the square problem edges measured by Calibrate.
+var calibrationSizes = []int{8, 16, 32, 64, 128, 256, 512, 1024}
+
+// calibrationOps are the ops Calibrate fits thresholds for. Other ops
+// keep their configured thresholds.
+var calibrationOps = []Op{OpMatMul, OpSum}
+
+// calibrationReps is how often each path is timed per size; the fastest
+// run is kept to filter out scheduling noise.
+const calibrationReps = 3
+
+// measureFunc times op on an n x n problem on both the CPU and GPU path.
+type measureFunc func(op Op, n int) (calibrationSample, error)
+
+// calibrate fits a Threshold for each of ops from measurements at every
+// problem edge in sizes.
+func calibrate(ops []Op, sizes []int, measure measureFunc) (map[Op]Threshold, error) {
+	th := make(map[Op]Threshold, len(ops))
+	for _, op := range ops {
+		samples := make([]calibrationSample, 0, len(sizes))
+		for _, n := range sizes {
+			s, err := measure(op, n)
+			if err != nil {
+				return nil, fmt.Errorf("mps: calibrating %v at n=%d: %w", op, n, err)
+			}
+			samples = append(samples, s)
+		}
+		th[op] = fitThreshold(samples)
+	}
+	return th, nil
+}
+
+// Calibrate times each accelerated op on StdEng and on the GPU over a
+// range of problem sizes, fits per-op crossover thresholds, installs them
+// on the engine and returns them. Thresholds set through options are
+// replaced. Calibrate takes a few seconds; persist the result rather
+// than calibrating on every start.
+//
+// Calibrate returns ErrNoDevice on engines without a Metal device.
+func (e *MPSEng) Calibrate() (map[Op]Threshold, error) {
+	if err := e.checkOpen(); err != nil {
+		return nil, err
+	}
+	if !e.hasDevice() {
+		return nil, ErrNoDevice
+	}
+	th, err := calibrate(calibrationOps, calibrationSizes, e.measure)
+	if err != nil {
+		return nil, err
+	}
+	e.setThresholds(th)
+	return th, nil
+}
+
+// measure is the measureFunc used by Calibrate. It bypasses the dispatch
+// policy and runs the device path directly.
+func (e *MPSEng) measure(op Op, n int) (calibrationSample, error) {
+	r := rand.New(rand.NewSource(int64(n)))
+	switch op {
+	case OpMatMul:
+		a, b := randomDenseF32(r, n, n), randomDenseF32(r, n, n)
+		c := tensor.New(tensor.WithShape(n, n), tensor.Of(tensor.Float32))
+		p := matMulPlan{a: a, b: b, c: c, m: n, n: n, k: n, alpha: 1}
+
+		cpu, err := timeBest(nil, func() error { return e.StdEng.MatMul(a, b, c) })
+		if err != nil {
+			return calibrationSample{}, err
+		}
+		gpu, err := timeBest(nil, func() error { return deviceRunError(e.execMatMul(p)) })
+		if err != nil {
+			return calibrationSample{}, err
+		}
+		return calibrationSample{cost: matMulCost(n, n, n), cpu: cpu, gpu: gpu}, nil
+
+	case OpSum:
+		x := randomDenseF32(r, n, n)
+		cpu, err := timeBest(nil, func() error {
+			_, err := e.StdEng.Sum(x, 1)
+			return err
+		})
+		if err != nil {
+			return calibrationSample{}, err
+		}
+
+		p, _ := e.planReduce(OpSum, x, []int{1}, false)
+		y := tensor.New(tensor.WithShape(n), tensor.Of(tensor.Float32))
+		gpu, err := timeBest(nil, func() error { return deviceRunError(e.execReduce(p, y)) })
+		if err != nil {
+			return calibrationSample{}, err
+		}
+		return calibrationSample{cost: reduceCost(n, n), cpu: cpu, gpu: gpu}, nil
+	}
+	return calibrationSample{}, fmt.Errorf("mps: %v cannot be calibrated", op)
+}
+
+// timeBest runs fn calibrationReps times, calling setup untimed before
+// each run, and returns the fastest run.
+func timeBest(setup func(), fn func() error) (time.Duration, error) {
+	best := time.Duration(-1)
+	for i := 0; i < calibrationReps; i++ {
+		if setup != nil {
+			setup()
+		}
+		start := time.Now()
+		if err := fn(); err != nil {
+			return 0, err
+		}
+		if d := time.Since(start); best < 0 || d < best {
+			best = d
+		}
+	}
+	return best, nil
+}
+
+// deviceRunError converts the outcome of a direct device run into an
+// error for calibration.
+func deviceRunError(reason FallbackReason) error {
+	if reason != ReasonNone {
+		return fmt.Errorf("device run failed: %v", reason)
+	}
+	return nil
+}
+
+// randomDenseF32 returns a rows x cols float32 Dense with normally
+// distributed contents drawn from r.
+func randomDenseF32(r *rand.Rand, rows, cols int) *tensor.Dense {
+	data := make([]float32, rows*cols)
+	for i := range data {
+		data[i] = float32(r.NormFloat64())
+	}
+	return tensor.New(tensor.WithShape(rows, cols), tensor.WithBacking(data))
+}
@@ -0,0 +1,165 @@
+package mps
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// Stress test for sharing one engine between goroutines. It is most
+// useful under `go test -race`, which checks the Go-side bookkeeping
+// (stats, thresholds, backend handle) of the whole pipeline.
+func TestConcurrentMatMulAndSum(t *testing.T) {
+	const (
+		workers   = 8
+		iters     = 40
+		failEvery = 5
+	)
+	faults := make(map[int]fault)
+	for n := failEvery; n <= 2*workers*iters; n += failEvery {
+		faults[n] = fault{status: 1}
+	}
+	fb := newFaultBackend(faults)
+	e := newRefEngine(t, withBackend(fb))
+
+	done := make(chan struct{})
+	var observers sync.WaitGroup
+	observers.Add(1)
+	go func() {
+		defer observers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_ = e.Stats()
+			_ = e.Profile()
+			e.setThresholds(map[Op]Threshold{OpMatMul: {}, OpSum: {}})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < iters; i++ {
+				if err := checkMatMul(e, r); err != nil {
+					errs <- err
+					return
+				}
+				if err := checkSum(e, r); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(done)
+	observers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	var accelerated, deviceErrors, total uint64
+	for _, st := range e.Stats().Ops {
+		accelerated += st.Accelerated
+		deviceErrors += st.Fallbacks[ReasonDeviceError]
+		total += st.Accelerated + st.TotalFallbacks()
+	}
+	if want := uint64(2 * workers * iters); total != want || uint64(fb.callCount()) != want {
+		t.Fatalf("recorded %d ops and %d device calls, want %d", total, fb.callCount(), want)
+	}
+	if want := uint64(len(faults)); deviceErrors != want || accelerated != total-want {
+		t.Fatalf("accelerated=%d deviceErrors=%d, want %d device errors", accelerated, deviceErrors, want)
+	}
+}
+
+// Test that closing an engine while other goroutines use it neither
+// races nor corrupts results: every call either succeeds with a correct
+// result or reports ErrEngineClosed.
+func TestCloseWhileInUse(t *testing.T) {
+	e := NewMPSEng(WithMinFLOPs(0), withBackend(newRefBackend()))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	started := make(chan struct{}, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; ; i++ {
+				if i == 10 {
+					started <- struct{}{}
+				}
+				err := checkMatMul(e, r)
+				if errors.Is(err, ErrEngineClosed) {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(int64(w))
+	}
+	for w := 0; w < 4; w++ {
+		<-started
+	}
+	e.Close()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// checkMatMul runs a random MatMul on e and verifies it against StdEng.
+func checkMatMul(e *MPSEng, r *rand.Rand) error {
+	m, k, n := 1+r.Intn(8), 1+r.Intn(8), 1+r.Intn(8)
+	a, b := randomDenseF32(r, m, k), randomDenseF32(r, k, n)
+	got := tensor.New(tensor.WithShape(m, n), tensor.Of(tensor.Float32))
+	if err := e.MatMul(a, b, got); err != nil {
+		return err
+	}
+	want := tensor.New(tensor.WithShape(m, n), tensor.Of(tensor.Float32))
+	var cpu tensor.StdEng
+	if err := cpu.MatMul(a, b, want); err != nil {
+		return err
+	}
+	// Float32s, unlike Data, keeps got and want alive while it builds
+	// the slice; they are dead after this comparison.
+	if !equalApprox(got.Float32s(), want.Float32s(), 1e-4) {
+		return errors.New("concurrent MatMul result differs from StdEng")
+	}
+	return nil
+}
+
+// checkSum runs a random last-axis Sum on e and verifies it against
+// StdEng.
+func checkSum(e *MPSEng, r *rand.Rand) error {
+	rows, cols := 1+r.Intn(8), 1+r.Intn(8)
+	x := randomDenseF32(r, rows, cols)
+	var cpu tensor.StdEng
+	want, err := cpu.Sum(x.Clone().(*tensor.Dense), 1)
+	if err != nil {
+		return err
+	}
+	got, err := e.Sum(x, 1)
+	if err != nil {
+		return err
+	}
+	if !equalApprox(got.(*tensor.Dense).Float32s()[:rows], want.(*tensor.Dense).Float32s(), 1e-4) {
+		return errors.New("concurrent Sum result differs from StdEng")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// costmodel.go
+//
+// Size-aware CPU/GPU dispatch. Every accelerated op is described by an
+// opCost (floating point operations and bytes moved); per-op Thresholds
+// mark the crossover above which the GPU beats StdEng once cgo and
+// command-buffer overhead are paid. Thresholds can be set explicitly or
+// fitted from measurements with Calibrate (see calibrate.go).
+
+package mps
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Threshold is the crossover point at which an op starts running on the
+// GPU. A problem is dispatched to the device only when its cost reaches
+// both minimums; the zero Threshold admits every problem.
+type Threshold struct {
+	MinFLOPs int64 `json:"min_flops"`
+	MinBytes int64 `json:"min_bytes"`
+}
+
+// Never is a Threshold that keeps an op on the CPU for every problem
+// size. Calibrate fits it for ops on which the GPU never wins.
+var Never = Threshold{MinFLOPs: math.MaxInt64, MinBytes: math.MaxInt64}
+
+// opCost is the size of a single op invocation.
+type opCost struct {
+	flops int64 // floating point operations
+	bytes int64 // bytes read and written
+}
+
+// admits reports whether a problem of cost c is large enough for the GPU.
+func (t Threshold) admits(c opCost) bool {
+	return c.flops >= t.MinFLOPs && c.bytes >= t.MinBytes
+}
+
+// thresholdTable holds one Threshold per Op.
+type thresholdTable [numOps]Threshold
+
+// matMulCost is the cost of an (m x k) by (k x n) float32 matrix product.
+func matMulCost(m, n, k int) opCost {
+	m64, n64, k64 := int64(m), int64(n), int64(k)
+	return opCost{
+		flops: 2 * m64 * n64 * k64,
+		bytes: 4 * (m64*k64 + k64*n64 + m64*n64),
+	}
+}
+
+// batchedMatMulCost is the cost of count independent (m x k) by (k x n)
+// float32 matrix products.
+func batchedMatMulCost(count, m, n, k int) opCost {
+	c := matMulCost(m, n, k)
+	return opCost{flops: int64(count) * c.flops, bytes: int64(count) * c.bytes}
+}
+
+// reduceCost is the cost of reducing a rows x cols float32 matrix along
+// its last axis, or any rows*cols elements to rows results.
+func reduceCost(rows, cols int) opCost {
+	r64, c64 := int64(rows), int64(cols)
+	return opCost{
+		flops: r64 * c64,
+		bytes: 4 * (r64*c64 + r64),
+	}
+}
+
+// threshold returns the crossover currently in force for op.
+func (e *MPSEng) threshold(op Op) Threshold {
+	return e.thresholds.Load()[op]
+}
+
+// Thresholds returns the per-op crossover thresholds currently in force.
+func (e *MPSEng) Thresholds() map[Op]Threshold {
+	t := e.thresholds.Load()
+	m := make(map[Op]Threshold, numOps)
+	for op := Op(0); op < numOps; op++ {
+		m[op] = t[op]
+	}
+	return m
+}
+
+// setThresholds replaces the thresholds of the ops present in th, leaving
+// the others unchanged. It is safe to call concurrently with running ops.
+func (e *MPSEng) setThresholds(th map[Op]Threshold) {
+	for {
+		old := e.thresholds.Load()
+		next := *old
+		for op, t := range th {
+			if op.valid() {
+				next[op] = t
+			}
+		}
+		if e.thresholds.CompareAndSwap(old, &next) {
+			return
+		}
+	}
+}
+
+// calibrationSample is one timing of an op at a single problem size on
+// both the CPU and the GPU path.
+type calibrationSample struct {
+	cost     opCost
+	cpu, gpu time.Duration
+}
+
+// fitThreshold derives a crossover from samples taken at increasing
+// problem sizes. The GPU must win at the returned size and at every
+// larger sample; the crossover is placed at the geometric midpoint
+// between the last losing and first winning sample. If the GPU wins
+// everywhere the zero Threshold is returned, and if it never wins at the
+// largest size the result is Never.
+func fitThreshold(samples []calibrationSample) Threshold {
+	if len(samples) == 0 {
+		return Threshold{}
+	}
+	s := append([]calibrationSample(nil), samples...)
+	sort.Slice(s, func(i, j int) bool { return s[i].cost.flops < s[j].cost.flops })
+
+	first := len(s)
+	for i := len(s) - 1; i >= 0 && s[i].gpu < s[i].cpu; i-- {
+		first = i
+	}
+	switch first {
+	case 0:
+		return Threshold{}
+	case len(s):
+		return Never
+	}
+
+	lo, hi := s[first-1].cost, s[first].cost
+	return Threshold{
+		MinFLOPs: geomMid(lo.flops, hi.flops),
+		MinBytes: geomMid(lo.bytes, hi.bytes),
+	}
+}
+
+// geomMid returns the geometric mean of a and b, rounded up and kept in
+// (a, b] so that the larger sample is still admitted.
+func geomMid(a, b int64) int64 {
+	m := int64(math.Ceil(math.Sqrt(float64(a) * float64(b))))
+	if m <= a {
+		m = a + 1
+	}
+	if m > b {
+		m = b
+	}
+	return m
+}
@@ -0,0 +1,137 @@
+package mps
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThresholdAdmits(t *testing.T) {
+	th := Threshold{MinFLOPs: 100, MinBytes: 40}
+	cases := []struct {
+		cost opCost
+		want bool
+	}{
+		{opCost{flops: 100, bytes: 40}, true},
+		{opCost{flops: 99, bytes: 400}, false},
+		{opCost{flops: 1000, bytes: 39}, false},
+	}
+	for _, tc := range cases {
+		if got := th.admits(tc.cost); got != tc.want {
+			t.Fatalf("admits(%+v) = %v, want %v", tc.cost, got, tc.want)
+		}
+	}
+	if !(Threshold{}).admits(opCost{}) {
+		t.Fatalf("zero Threshold must admit every problem")
+	}
+	if Never.admits(matMulCost(1<<14, 1<<14, 1<<14)) {
+		t.Fatalf("Never must not admit any problem")
+	}
+}
+
+// sampleAt builds a calibration sample for an n x n x n MatMul with the
+// given timings in microseconds.
+func sampleAt(n int, cpuUS, gpuUS int) calibrationSample {
+	return calibrationSample{
+		cost: matMulCost(n, n, n),
+		cpu:  time.Duration(cpuUS) * time.Microsecond,
+		gpu:  time.Duration(gpuUS) * time.Microsecond,
+	}
+}
+
+func TestFitThreshold(t *testing.T) {
+	t.Run("crossover", func(t *testing.T) {
+		th := fitThreshold([]calibrationSample{
+			sampleAt(128, 300, 100),
+			sampleAt(16, 1, 50),
+			sampleAt(64, 40, 60),
+		})
+		lo, hi := matMulCost(64, 64, 64), matMulCost(128, 128, 128)
+		if th.MinFLOPs <= lo.flops || th.MinFLOPs > hi.flops {
+			t.Fatalf("MinFLOPs %d not in (%d, %d]", th.MinFLOPs, lo.flops, hi.flops)
+		}
+		if th.MinBytes <= lo.bytes || th.MinBytes > hi.bytes {
+			t.Fatalf("MinBytes %d not in (%d, %d]", th.MinBytes, lo.bytes, hi.bytes)
+		}
+		if th.admits(lo) || !th.admits(hi) {
+			t.Fatalf("threshold %+v does not separate the samples", th)
+		}
+	})
+
+	t.Run("noisy win below crossover is ignored", func(t *testing.T) {
+		th := fitThreshold([]calibrationSample{
+			sampleAt(16, 10, 5),
+			sampleAt(32, 10, 20),
+			sampleAt(64, 100, 30),
+		})
+		if th.admits(matMulCost(32, 32, 32)) || !th.admits(matMulCost(64, 64, 64)) {
+			t.Fatalf("threshold %+v should start above the last GPU loss", th)
+		}
+	})
+
+	t.Run("gpu always wins", func(t *testing.T) {
+		th := fitThreshold([]calibrationSample{sampleAt(8, 10, 1), sampleAt(16, 20, 2)})
+		if th != (Threshold{}) {
+			t.Fatalf("got %+v, want zero Threshold", th)
+		}
+	})
+
+	t.Run("gpu never wins", func(t *testing.T) {
+		th := fitThreshold([]calibrationSample{sampleAt(8, 1, 10), sampleAt(16, 2, 20)})
+		if th != Never {
+			t.Fatalf("got %+v, want Never", th)
+		}
+	})
+}
+
+func TestCalibrateWithInjectedTimings(t *testing.T) {
+	// The GPU costs a fixed 50us of overhead; the CPU scales with n^3.
+	measure := func(op Op, n int) (calibrationSample, error) {
+		cpu := n * n * n / 1000
+		return sampleAt(n, cpu, 50+cpu/10), nil
+	}
+	th, err := calibrate([]Op{OpMatMul}, []int{8, 16, 32, 64, 128}, measure)
+	if err != nil {
+		t.Fatalf("calibrate error: %v", err)
+	}
+	got := th[OpMatMul]
+	if got.admits(matMulCost(32, 32, 32)) || !got.admits(matMulCost(64, 64, 64)) {
+		t.Fatalf("fitted threshold %+v, want crossover between n=32 and n=64", got)
+	}
+
+	failing := func(op Op, n int) (calibrationSample, error) {
+		return calibrationSample{}, errors.New("boom")
+	}
+	if _, err := calibrate([]Op{OpSum}, []int{8}, failing); err == nil {
+		t.Fatalf("expected calibrate to report measurement errors")
+	}
+}
+
+// Test that thresholds installed on a live engine drive dispatch.
+func TestSetThresholdsDrivesDispatch(t *testing.T) {
+	e := NewMPSEng(WithMinFLOPs(0), WithThreshold(OpSum, Threshold{MinFLOPs: 7}))
+	defer e.Close()
+
+	small := matMulCost(4, 4, 4)
+	if r := e.policyReason(OpMatMul, small); r != ReasonNone {
+		t.Fatalf("policyReason before = %v, want none", r)
+	}
+	e.setThresholds(map[Op]Threshold{OpMatMul: {MinFLOPs: small.flops + 1}})
+	if r := e.policyReason(OpMatMul, small); r != ReasonSizeThreshold {
+		t.Fatalf("policyReason after = %v, want size-threshold", r)
+	}
+	if got := e.Thresholds()[OpSum]; got.MinFLOPs != 7 {
+		t.Fatalf("setThresholds must leave other ops untouched, got %+v", got)
+	}
+}
+
+func TestCalibrateWithoutDevice(t *testing.T) {
+	e := NewMPSEng()
+	defer e.Close()
+	if e.hasDevice() {
+		t.Skip("Metal device available")
+	}
+	if _, err := e.Calibrate(); !errors.Is(err, ErrNoDevice) {
+		t.Fatalf("Calibrate without device: got %v, want ErrNoDevice", err)
+	}
+}
@@ -0,0 +1,964 @@
+// dispatch.go
+//
+// Platform-independent dispatch policy for MPSEng: which ops exist, when
+// an op is worth sending to the GPU, and how to hand an op to the
+// fallback engine when it is not.
+
+package mps
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+
+	"gorgonia.org/tensor"
+)
+
+// Op identifies an MPSEng operation that can be dispatched to the GPU.
+type Op int
+
+const (
+	OpMatMul Op = iota
+	OpSum
+	OpBatchedMatMul
+	OpMatVecMul
+	OpInner
+	OpOuter
+	OpLinear
+	OpMax
+	OpMin
+	OpProd
+	OpMean
+	OpArgmax
+	OpArgmin
+
+	numOps
+)
+
+var opNames = [numOps]string{
+	OpMatMul:        "MatMul",
+	OpSum:           "Sum",
+	OpBatchedMatMul: "BatchedMatMul",
+	OpMatVecMul:     "MatVecMul",
+	OpInner:         "Inner",
+	OpOuter:         "Outer",
+	OpLinear:        "Linear",
+	OpMax:           "Max",
+	OpMin:           "Min",
+	OpProd:          "Prod",
+	OpMean:          "Mean",
+	OpArgmax:        "Argmax",
+	OpArgmin:        "Argmin",
+}
+
+func (op Op) valid() bool { return op >= 0 && op < numOps }
+
+func (op Op) String() string {
+	if !op.valid() {
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+	return opNames[op]
+}
+
+// policyReason applies the configured dispatch policy to op, costing
+// cost. It returns ReasonNone when the op should run on the GPU.
+func (e *MPSEng) policyReason(op Op, cost opCost) FallbackReason {
+	if e.cfg.disabled[op] {
+		return ReasonDisabled
+	}
+	if !e.threshold(op).admits(cost) {
+		return ReasonSizeThreshold
+	}
+	return ReasonNone
+}
+
+// dispatchReason combines the dispatch policy with device availability.
+func (e *MPSEng) dispatchReason(op Op, cost opCost) FallbackReason {
+	if r := e.policyReason(op, cost); r != ReasonNone {
+		return r
+	}
+	if !e.hasDevice() {
+		return ReasonNoDevice
+	}
+	return ReasonNone
+}
+
+// hasDevice reports whether the engine holds a device backend.
+func (e *MPSEng) hasDevice() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.be != nil
+}
+
+// deviceName names the engine's device, or noDeviceName without one.
+func (e *MPSEng) deviceName() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.be == nil {
+		return noDeviceName
+	}
+	return e.be.deviceName()
+}
+
+// fallbackMatMul records why a MatMul is not accelerated and hands it to
+// the configured fallback engine through cpuMatMul, or to sgemm (see
+// WithCPUGEMM), or returns a *FallbackError in strict mode. Empty
+// products, which StdEng cannot compute, are handled here.
+func (e *MPSEng) fallbackMatMul(reason FallbackReason, prec Precision, a, b, prealloc tensor.Tensor) error {
+	e.stats.recordFallback(OpMatMul, reason)
+	if e.cfg.strict {
+		return newFallbackError(OpMatMul, reason, a, b, prealloc)
+	}
+	if reason == ReasonEmpty {
+		return zeroProduct(prealloc.(*tensor.Dense))
+	}
+	if e.cpuGEMMEligible(reason) {
+		if p, r, err := matMulOperands(a, b, prealloc); err == nil && r == ReasonNone {
+			p.prec = prec
+			if e.tryCPUGEMM(OpMatMul, p) {
+				return nil
+			}
+		}
+	}
+	return cpuMatMul(e.fallbackMatMuler(prec), a, b, prealloc)
+}
+
+// fallbackMatMuler returns the configured fallback engine's MatMul, or
+// StdEng's if it has none, computing float32 products in float64 for
+// PrecisionCompensated.
+func (e *MPSEng) fallbackMatMuler(prec Precision) tensor.MatMuler {
+	var mm tensor.MatMuler = e.StdEng
+	if fm, ok := e.cfg.fallback.(tensor.MatMuler); ok {
+		mm = fm
+	}
+	if prec == PrecisionCompensated {
+		return widenedMatMuler{mm}
+	}
+	return mm
+}
+
+// fallbackReduce records why the reduction p.op of a is not
+// accelerated and hands it to the configured fallback engine, or to
+// StdEng if it lacks the method, reshaping the result to keep the
+// reduced axes if p.keepDims is set and copying it into reuse if that is
+// not nil. It returns a *FallbackError in strict mode.
+//
+// StdEng has no Prod: without a fallback Proder, float32 Dense products
+// are computed by the reference kernels on the CPU, with ones for those
+// of no elements, and others are errors.
+// Mean is the fallback's Sum divided by the number of elements summed.
+func (e *MPSEng) fallbackReduce(reason FallbackReason, p reducePlan, a, reuse tensor.Tensor) (tensor.Tensor, error) {
+	op, along := p.op, p.along
+	e.stats.recordFallback(op, reason)
+	if e.cfg.strict {
+		return nil, newFallbackError(op, reason, a)
+	}
+
+	var (
+		res tensor.Tensor
+		err error
+	)
+	switch op {
+	case OpSum, OpMean:
+		if s, ok := e.cfg.fallback.(tensor.Sumer); ok {
+			res, err = s.Sum(a, along...)
+		} else {
+			res, err = e.StdEng.Sum(a, along...)
+		}
+		if err == nil && op == OpMean {
+			err = divideMean(res, a.Shape().TotalSize())
+		}
+	case OpMax:
+		if m, ok := e.cfg.fallback.(tensor.Maxer); ok {
+			res, err = m.Max(a, along...)
+		} else {
+			res, err = e.StdEng.Max(a, along...)
+		}
+	case OpMin:
+		if m, ok := e.cfg.fallback.(tensor.Miner); ok {
+			res, err = m.Min(a, along...)
+		} else {
+			res, err = e.StdEng.Min(a, along...)
+		}
+	case OpProd:
+		if pr, ok := e.cfg.fallback.(tensor.Proder); ok {
+			res, err = pr.Prod(a, along...)
+			break
+		}
+		switch {
+		case reason == ReasonAxis:
+			return nil, fmt.Errorf("mps: Prod of %v over %v: axes out of range or repeated", a.Shape(), along)
+		case p.a == nil && reason != ReasonEmpty:
+			return nil, fmt.Errorf("mps: Prod of %v %v over %v needs a fallback engine implementing tensor.Proder", a.Shape(), a.Dtype(), along)
+		}
+		out, err := e.reduceOutput(p, reuse)
+		if err != nil {
+			return nil, err
+		}
+		if reason == ReasonEmpty {
+			// The product of no elements is 1.
+			return out, out.Memset(float32(1))
+		}
+		p.cpu = true
+		if reason := e.execReduce(p, out); reason != ReasonNone {
+			return nil, fmt.Errorf("mps: Prod on the CPU failed (%v)", reason)
+		}
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.keepDims {
+		if res, err = keepReducedDims(op, res, a.Shape(), along); err != nil {
+			return nil, err
+		}
+	}
+	return copyReduced(op, res, reuse)
+}
+
+// fallbackArg records why an Argmax or Argmin is not accelerated and
+// computes it with the configured fallback engine's Argmaxer or
+// Argminer, or StdEng's, or returns a *FallbackError in strict mode.
+func (e *MPSEng) fallbackArg(reason FallbackReason, op Op, t tensor.Tensor, axis int) (tensor.Tensor, error) {
+	e.stats.recordFallback(op, reason)
+	if e.cfg.strict {
+		return nil, newFallbackError(op, reason, t)
+	}
+	if op == OpArgmin {
+		if m, ok := e.cfg.fallback.(tensor.Argminer); ok {
+			return m.Argmin(t, axis)
+		}
+		return e.StdEng.Argmin(t, axis)
+	}
+	if m, ok := e.cfg.fallback.(tensor.Argmaxer); ok {
+		return m.Argmax(t, axis)
+	}
+	return e.StdEng.Argmax(t, axis)
+}
+
+// fallbackBatchedMatMul records why a BatchedMatMul is not accelerated
+// and runs it as one MatMul per batch entry on the configured fallback
+// engine, or returns a *FallbackError in strict mode.
+func (e *MPSEng) fallbackBatchedMatMul(reason FallbackReason, batch tensor.Shape, a, b, prealloc tensor.Tensor) error {
+	e.stats.recordFallback(OpBatchedMatMul, reason)
+	if e.cfg.strict {
+		return newFallbackError(OpBatchedMatMul, reason, a, b, prealloc)
+	}
+	if reason == ReasonEmpty {
+		return zeroProduct(prealloc.(*tensor.Dense))
+	}
+	mm := e.fallbackMatMuler(PrecisionStandard)
+	return forEachBatchIndex(batch, func(_ int, idx []int) error {
+		as, err := batchSlice(a, idx)
+		if err != nil {
+			return err
+		}
+		bs, err := batchSlice(b, idx)
+		if err != nil {
+			return err
+		}
+		cs, err := batchSlice(prealloc, idx)
+		if err != nil {
+			return err
+		}
+		return cpuMatMul(mm, as, bs, cs)
+	})
+}
+
+// fallbackMatVecMul records why a MatVecMul is not accelerated and hands
+// it to the configured fallback engine, or returns a *FallbackError in
+// strict mode.
+func (e *MPSEng) fallbackMatVecMul(reason FallbackReason, a, b, prealloc tensor.Tensor) error {
+	e.stats.recordFallback(OpMatVecMul, reason)
+	if e.cfg.strict {
+		return newFallbackError(OpMatVecMul, reason, a, b, prealloc)
+	}
+	if mv, ok := e.cfg.fallback.(tensor.MatVecMuler); ok {
+		return mv.MatVecMul(a, b, prealloc)
+	}
+	return e.StdEng.MatVecMul(a, b, prealloc)
+}
+
+// fallbackInner records why an Inner is not accelerated and hands it to
+// the configured fallback engine, or returns a *FallbackError in strict
+// mode.
+func (e *MPSEng) fallbackInner(reason FallbackReason, a, b tensor.Tensor) (interface{}, error) {
+	e.stats.recordFallback(OpInner, reason)
+	if e.cfg.strict {
+		return nil, newFallbackError(OpInner, reason, a, b)
+	}
+	if ip, ok := e.cfg.fallback.(tensor.InnerProder); ok {
+		return ip.Inner(a, b)
+	}
+	return e.StdEng.Inner(a, b)
+}
+
+// fallbackOuter records why an Outer is not accelerated and hands it to
+// the configured fallback engine, or returns a *FallbackError in strict
+// mode.
+func (e *MPSEng) fallbackOuter(reason FallbackReason, a, b, prealloc tensor.Tensor) error {
+	e.stats.recordFallback(OpOuter, reason)
+	if e.cfg.strict {
+		return newFallbackError(OpOuter, reason, a, b, prealloc)
+	}
+	if op, ok := e.cfg.fallback.(tensor.OuterProder); ok {
+		return op.Outer(a, b, prealloc)
+	}
+	return e.StdEng.Outer(a, b, prealloc)
+}
+
+// fallbackLinear records why a Linear is not accelerated and computes it
+// on the CPU: with sgemm if WithCPUGEMM allows, and otherwise as a
+// product from the configured fallback engine's MatMul through
+// cpuMatMul followed by linearEpilogue, the reference the device kernels
+// are tested against. In strict mode it returns a *FallbackError
+// instead.
+func (e *MPSEng) fallbackLinear(reason FallbackReason, x, w, bias tensor.Tensor, act Activation, prealloc tensor.Tensor) error {
+	e.stats.recordFallback(OpLinear, reason)
+	if e.cfg.strict {
+		return newFallbackError(OpLinear, reason, x, w, bias, prealloc)
+	}
+	if e.cpuGEMMEligible(reason) {
+		// The inputs passed planning before, so p is complete.
+		if p, _, err := e.planLinear(x, w, bias, act, prealloc); err == nil && p.mm.c != nil && e.tryCPULinear(p) {
+			return nil
+		}
+	}
+	dc, ok := prealloc.(*tensor.Dense)
+	if !ok {
+		return fmt.Errorf("mps: Linear requires a *tensor.Dense output, got %T", prealloc)
+	}
+	var db *tensor.Dense
+	if bias != nil {
+		if db, ok = bias.(*tensor.Dense); !ok {
+			return fmt.Errorf("mps: Linear requires a *tensor.Dense bias, got %T", bias)
+		}
+		// The product overwrites the output before the bias is read.
+		db = unaliased(db, dc).(*tensor.Dense)
+	}
+
+	// The epilogue works on a row-major product, so strided outputs get
+	// a temporary, as in fallbackGemm.
+	out := dc
+	if !isRowMajorContiguous(dc) {
+		out = tensor.New(tensor.WithShape(dc.Shape().Clone()...), tensor.Of(dc.Dtype()))
+	}
+	if reason == ReasonEmpty {
+		if err := zeroProduct(out); err != nil {
+			return err
+		}
+	} else if err := cpuMatMul(e.fallbackMatMuler(e.cfg.precision), x, w, out); err != nil {
+		return err
+	}
+	if err := linearEpilogue(out, db, act); err != nil {
+		return err
+	}
+	if out != dc {
+		return blendGemm(1, out, 0, dc)
+	}
+	return nil
+}
+
+// cpuMatMul computes a x b into c with mm, working around the ways
+// StdEng.MatMul differs from a plain matrix product: inputs that share
+// memory with c are copied first, since it overwrites c before reading
+// all of its inputs; strided inputs are materialized; and a strided
+// Dense c receives the product through a row-major temporary, since it
+// would be written as if it were row-major.
+func cpuMatMul(mm tensor.MatMuler, a, b, c tensor.Tensor) error {
+	a = materializeStrided(unaliased(a, c))
+	b = materializeStrided(unaliased(b, c))
+	dc, ok := c.(*tensor.Dense)
+	if !ok || isRowMajorContiguous(dc) {
+		return mm.MatMul(a, b, c)
+	}
+	tmp := tensor.New(tensor.WithShape(dc.Shape().Clone()...), tensor.Of(dc.Dtype()))
+	if err := mm.MatMul(a, b, tmp); err != nil {
+		return err
+	}
+	return copyRowMajor(dc, tmp)
+}
+
+// unaliased returns a copy of the input t if it shares memory with the
+// output out, and t itself otherwise.
+func unaliased(t, out tensor.Tensor) tensor.Tensor {
+	d, ok := t.(*tensor.Dense)
+	o, okO := out.(*tensor.Dense)
+	if !ok || !okO || !sharesMemory(d, o) {
+		return t
+	}
+	return d.Clone().(*tensor.Dense)
+}
+
+// zeroProduct sets every element of c, the output of a MatMul with a
+// zero-sized dimension, to zero: an empty inner dimension makes every
+// element an empty sum. StdEng cannot multiply empty matrices.
+func zeroProduct(c *tensor.Dense) error {
+	if c.Shape().TotalSize() == 0 {
+		return nil
+	}
+	data := reflect.ValueOf(c.Data())
+	zero := reflect.Zero(data.Type().Elem())
+	return forEachRowMajor(c, func(_, idx int) { data.Index(idx).Set(zero) })
+}
+
+// copyRowMajor copies the row-major contiguous src into dst, a tensor of
+// the same shape and dtype and any layout. src is usually a temporary,
+// so it is read with its typed accessors, or kept alive until the copy
+// ends for other dtypes: Data does not keep a tensor alive while it
+// builds the slice.
+func copyRowMajor(dst, src *tensor.Dense) error {
+	switch dd := dst.Data().(type) {
+	case []float32:
+		return scatterF32(src.Float32s(), dst, dd)
+	case []float64:
+		sd := src.Float64s()
+		return forEachRowMajor(dst, func(pos, idx int) { dd[idx] = sd[pos] })
+	}
+	from, to := reflect.ValueOf(src.Data()), reflect.ValueOf(dst.Data())
+	err := forEachRowMajor(dst, func(pos, idx int) { to.Index(idx).Set(from.Index(pos)) })
+	runtime.KeepAlive(src)
+	return err
+}
+
+// materializeStrided returns a row-major copy of a Dense matrix view
+// whose elements are not stored contiguously in row-major order, and t
+// itself otherwise. StdEng.MatMul reads its operands' backing slices as
+// if they were row-major, and Dense.Materialize returns such views
+// unchanged, which is wrong for matrices sliced out of a transposed
+// batch.
+func materializeStrided(t tensor.Tensor) tensor.Tensor {
+	d, ok := t.(*tensor.Dense)
+	if !ok || d.Dims() != 2 || isRowMajorContiguous(d) {
+		return t
+	}
+	rows, cols := d.Shape()[0], d.Shape()[1]
+	out := tensor.New(tensor.WithShape(rows, cols), tensor.Of(d.Dtype()))
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			v, err := d.At(r, c)
+			if err != nil {
+				return t
+			}
+			if err := out.SetAt(v, r, c); err != nil {
+				return t
+			}
+		}
+	}
+	return out
+}
+
+// matMulPlan is a MatMul whose operands passed every portable check. It
+// computes c = act(alpha * a x b + beta * c + bias); a plain MatMul has
+// alpha 1, beta 0 and no epilogue.
+type matMulPlan struct {
+	a, b, c     *tensor.Dense
+	m, n, k     int
+	alpha, beta float32
+
+	// bias, if not nil, holds n staged values added to every row, and
+	// act is applied last (see Linear).
+	bias []float32
+	act  Activation
+
+	// cpu computes the product with sgemm instead of the backend (see
+	// WithCPUGEMM).
+	cpu bool
+
+	// prec is the precision policy (see Precision).
+	prec Precision
+}
+
+// planMatMul decides whether a MatMul can run on the GPU. It returns
+// ReasonNone together with the plan when it can, and otherwise the reason
+// it must fall back. Inconsistent shapes are reported through err rather
+// than as a fallback.
+func (e *MPSEng) planMatMul(a, b, prealloc tensor.Tensor) (p matMulPlan, reason FallbackReason, err error) {
+	p, reason, err = matMulOperands(a, b, prealloc)
+	if err != nil || reason != ReasonNone {
+		return p, reason, err
+	}
+	return p, e.dispatchReason(OpMatMul, matMulCost(p.m, p.n, p.k)), nil
+}
+
+// matMulOperands runs the checks of planMatMul that do not depend on the
+// dispatch policy, for ops built on a MatMul.
+func matMulOperands(a, b, prealloc tensor.Tensor) (p matMulPlan, reason FallbackReason, err error) {
+	if a == nil || b == nil || prealloc == nil {
+		return p, ReasonNone, fmt.Errorf("mps: MatMul requires non-nil operands")
+	}
+	m, n, k, err := matMulDims(a.Shape(), b.Shape(), prealloc.Shape())
+	if err != nil {
+		return p, ReasonNone, err
+	}
+
+	da, okA := a.(*tensor.Dense)
+	db, okB := b.(*tensor.Dense)
+	dc, okC := prealloc.(*tensor.Dense)
+	if !okA || !okB || !okC {
+		return p, ReasonNotDense, nil
+	}
+	p = matMulPlan{a: da, b: db, c: dc, m: m, n: n, k: k, alpha: 1}
+	if m == 0 || n == 0 || k == 0 {
+		return p, ReasonEmpty, nil
+	}
+	if da.Dtype() != tensor.Float32 || db.Dtype() != tensor.Float32 || dc.Dtype() != tensor.Float32 {
+		return p, ReasonDtype, nil
+	}
+	return p, ReasonNone, nil
+}
+
+// vecPlan is a MatVecMul, Inner or Outer whose operands passed every
+// portable check. It describes the equivalent MatMul of an (m x k) by a
+// (k x n) matrix, with the vector operands viewed as matrices: a
+// MatVecMul has n = 1, an Inner m = n = 1 and an Outer k = 1. c is nil
+// for Inner, whose result is a scalar.
+type vecPlan struct {
+	a, b, c *tensor.Dense
+	m, n, k int
+}
+
+// planMatVecMul decides whether a MatVecMul of the matrix a by the
+// vector b into the vector prealloc can run on the GPU, like planMatMul
+// does for MatMul.
+func (e *MPSEng) planMatVecMul(a, b, prealloc tensor.Tensor) (p vecPlan, reason FallbackReason, err error) {
+	da, okA := a.(*tensor.Dense)
+	db, okB := b.(*tensor.Dense)
+	dc, okC := prealloc.(*tensor.Dense)
+	if !okA || !okB || !okC {
+		return p, ReasonNotDense, nil
+	}
+	if da.Dims() != 2 || !db.Shape().IsVector() || !dc.Shape().IsVector() {
+		return p, ReasonRank, nil
+	}
+
+	m, k := da.Shape()[0], da.Shape()[1]
+	if db.Shape().TotalSize() != k {
+		return p, ReasonNone, fmt.Errorf("mps: MatVecMul shape mismatch: a=%v, b=%v", da.Shape(), db.Shape())
+	}
+	if dc.Shape().TotalSize() != m {
+		return p, ReasonNone, fmt.Errorf("mps: MatVecMul prealloc shape mismatch: expected %d elements, got %v", m, dc.Shape())
+	}
+
+	if da.Dtype() != tensor.Float32 || db.Dtype() != tensor.Float32 || dc.Dtype() != tensor.Float32 {
+		return p, ReasonDtype, nil
+	}
+	if m == 0 || k == 0 {
+		return p, ReasonEmpty, nil
+	}
+
+	p = vecPlan{a: da, b: db, c: dc, m: m, n: 1, k: k}
+	return p, e.dispatchReason(OpMatVecMul, matMulCost(m, 1, k)), nil
+}
+
+// planInner decides whether the inner product of the vectors a and b can
+// run on the GPU.
+func (e *MPSEng) planInner(a, b tensor.Tensor) (p vecPlan, reason FallbackReason, err error) {
+	da, okA := a.(*tensor.Dense)
+	db, okB := b.(*tensor.Dense)
+	if !okA || !okB {
+		return p, ReasonNotDense, nil
+	}
+	if !da.Shape().IsVector() || !db.Shape().IsVector() {
+		return p, ReasonRank, nil
+	}
+
+	k := da.Shape().TotalSize()
+	if db.Shape().TotalSize() != k {
+		return p, ReasonNone, fmt.Errorf("mps: Inner shape mismatch: a=%v, b=%v", da.Shape(), db.Shape())
+	}
+
+	if da.Dtype() != tensor.Float32 || db.Dtype() != tensor.Float32 {
+		return p, ReasonDtype, nil
+	}
+	if k == 0 {
+		return p, ReasonEmpty, nil
+	}
+
+	p = vecPlan{a: da, b: db, m: 1, n: 1, k: k}
+	return p, e.dispatchReason(OpInner, matMulCost(1, 1, k)), nil
+}
+
+// planOuter decides whether the outer product of the vectors a and b
+// into the matrix prealloc can run on the GPU.
+func (e *MPSEng) planOuter(a, b, prealloc tensor.Tensor) (p vecPlan, reason FallbackReason, err error) {
+	da, okA := a.(*tensor.Dense)
+	db, okB := b.(*tensor.Dense)
+	dc, okC := prealloc.(*tensor.Dense)
+	if !okA || !okB || !okC {
+		return p, ReasonNotDense, nil
+	}
+	if !da.Shape().IsVector() || !db.Shape().IsVector() {
+		return p, ReasonRank, nil
+	}
+
+	m, n := da.Shape().TotalSize(), db.Shape().TotalSize()
+	if shapeC := dc.Shape(); len(shapeC) != 2 || shapeC[0] != m || shapeC[1] != n {
+		return p, ReasonNone, fmt.Errorf("mps: Outer prealloc shape mismatch: expected [%d %d], got %v", m, n, shapeC)
+	}
+
+	if da.Dtype() != tensor.Float32 || db.Dtype() != tensor.Float32 || dc.Dtype() != tensor.Float32 {
+		return p, ReasonDtype, nil
+	}
+	if m == 0 || n == 0 {
+		return p, ReasonEmpty, nil
+	}
+
+	p = vecPlan{a: da, b: db, c: dc, m: m, n: n, k: 1}
+	return p, e.dispatchReason(OpOuter, matMulCost(m, n, 1)), nil
+}
+
+// linearPlan is a Linear whose operands passed every portable check: the
+// MatMul of x by w into the output, and the bias to stage for its
+// epilogue, or nil.
+type linearPlan struct {
+	mm   matMulPlan
+	bias *tensor.Dense
+}
+
+// planLinear decides whether a Linear can run on the GPU, like
+// planMatMul does for MatMul. bias may be nil; otherwise it must hold one
+// value per output column, with shape [N] or [1, N].
+func (e *MPSEng) planLinear(x, w, bias tensor.Tensor, act Activation, prealloc tensor.Tensor) (p linearPlan, reason FallbackReason, err error) {
+	if !act.valid() {
+		return p, ReasonNone, fmt.Errorf("mps: Linear with unknown activation %v", act)
+	}
+	mm, reason, err := matMulOperands(x, w, prealloc)
+	if err != nil || reason == ReasonNotDense {
+		return p, reason, err
+	}
+
+	if bias != nil {
+		n := w.Shape()[1]
+		if bs := bias.Shape(); bs.TotalSize() != n || len(bs) > 2 || (len(bs) == 2 && bs[0] != 1) {
+			return p, ReasonNone, fmt.Errorf("mps: Linear bias shape mismatch: expected [%d] or [1 %d], got %v", n, n, bs)
+		}
+		db, ok := bias.(*tensor.Dense)
+		if !ok {
+			return p, ReasonNotDense, nil
+		}
+		if db.Dtype() != tensor.Float32 {
+			return p, ReasonDtype, nil
+		}
+		p.bias = db
+	}
+	if reason != ReasonNone {
+		return p, reason, nil
+	}
+
+	mm.act = act
+	mm.prec = e.cfg.precision
+	p.mm = mm
+	return p, e.dispatchReason(OpLinear, matMulCost(mm.m, mm.n, mm.k)), nil
+}
+
+// batchedPlan is a BatchedMatMul whose operands passed every portable
+// check: count products of (m x k) by (k x n) matrices over the
+// broadcast batch shape batch.
+type batchedPlan struct {
+	a, b, c *tensor.Dense
+	batch   tensor.Shape
+	count   int
+	m, n, k int
+}
+
+// planBatchedMatMul decides whether a BatchedMatMul can run on the GPU,
+// like planMatMul does for MatMul. The broadcast batch shape is returned
+// even when the op must fall back, since the fallback loops over it.
+func (e *MPSEng) planBatchedMatMul(a, b, prealloc tensor.Tensor) (p batchedPlan, reason FallbackReason, err error) {
+	batch, m, n, k, err := batchedMatMulDims(a.Shape(), b.Shape(), prealloc.Shape())
+	if err != nil {
+		return p, ReasonNone, err
+	}
+	p.batch = batch
+
+	da, okA := a.(*tensor.Dense)
+	db, okB := b.(*tensor.Dense)
+	dc, okC := prealloc.(*tensor.Dense)
+	if !okA || !okB || !okC {
+		return p, ReasonNotDense, nil
+	}
+	if da.Dtype() != tensor.Float32 || db.Dtype() != tensor.Float32 || dc.Dtype() != tensor.Float32 {
+		return p, ReasonDtype, nil
+	}
+	count := batchCount(batch)
+	if count == 0 || m == 0 || n == 0 || k == 0 {
+		return p, ReasonEmpty, nil
+	}
+
+	p = batchedPlan{a: da, b: db, c: dc, batch: batch, count: count, m: m, n: n, k: k}
+	return p, e.dispatchReason(OpBatchedMatMul, batchedMatMulCost(count, m, n, k)), nil
+}
+
+// reducePlan is a reduction (Sum, Max, Min, Prod or Mean) whose input
+// passed every portable check: a float32 tensor of any rank reduced over
+// any of its axes, or all of them.
+//
+// The reduction works on a row-major copy of the input whose axes of
+// size 1 are dropped and whose adjacent kept or reduced axes are merged
+// into groups: dims[i] is the size of group i, and reduce[i] whether it
+// is reduced. Kept and reduced groups therefore alternate, and there is
+// at least one reduced group.
+type reducePlan struct {
+	op   Op
+	a    *tensor.Dense
+	data []float32
+
+	// cpu runs the plan on the reference kernels instead of the device,
+	// for fallbacks that have no fallback engine method.
+	cpu bool
+
+	// contiguous is set when data holds a's elements in row-major order
+	// as is; otherwise they are gathered into a staging buffer.
+	contiguous bool
+
+	// The reduction runs over a's elements viewed as an array of dims,
+	// one pass per reduced group of axes, outermost first. The maximum
+	// and minimum keep each reduced axis in a group of its own unless all
+	// are reduced, since StdEng treats NaNs axis by axis, and lead marks
+	// the groups StdEng reduces as the leading axis of what remains.
+	dims   []int
+	reduce []bool
+	lead   []bool
+
+	// shape is the shape of the result: a's shape without the reduced
+	// axes, as StdEng.Sum returns it (empty, a scalar, if all of them
+	// are), or with them kept with size 1 when keepDims is set.
+	shape    tensor.Shape
+	keepDims bool
+
+	// count is the number of elements reduced into each result.
+	count int
+
+	// along holds the axes to hand to the fallback engine, already
+	// resolved to be non-negative when they are all in range.
+	along []int
+}
+
+// planReduce decides whether the reduction op of a over along can run
+// on the GPU, keeping the reduced axes with size 1 if keepDims is set.
+// No axes reduce all of them. It returns ReasonNone when it can, and
+// otherwise the reason it must fall back; p.along and p.keepDims are
+// valid in both cases, p.shape also for ReasonEmpty, and the rest of p
+// whenever p.a is set.
+func (e *MPSEng) planReduce(op Op, a tensor.Tensor, along []int, keepDims bool) (p reducePlan, reason FallbackReason) {
+	p.op, p.along, p.keepDims = op, along, keepDims
+
+	ad, ok := a.(*tensor.Dense)
+	if !ok {
+		return p, ReasonNotDense
+	}
+	if ad.Dtype() != tensor.Float32 {
+		return p, ReasonDtype
+	}
+
+	// Axes out of range are left for the fallback engine to report, and
+	// repeated ones to treat as it does.
+	rank := ad.Dims()
+	reduced := make([]bool, rank)
+	resolved := make([]int, len(along))
+	for i, axis := range along {
+		if axis < -rank || axis >= rank {
+			return p, ReasonAxis
+		}
+		axis = resolveAxis(axis, rank)
+		if reduced[axis] {
+			return p, ReasonAxis
+		}
+		reduced[axis], resolved[i] = true, axis
+	}
+	p.along = resolved
+	if len(along) == 0 {
+		for axis := range reduced {
+			reduced[axis] = true
+		}
+	}
+
+	// StdEng reduces all axes at once only when along lists them in
+	// order.
+	all := len(along) == 0 || len(resolved) == rank && slices.IsSorted(resolved)
+	separate := (op == OpMax || op == OpMin) && !all
+	shape := ad.Shape()
+	p.shape = make(tensor.Shape, 0, rank)
+	leading := true
+	for axis, size := range shape {
+		switch {
+		case !reduced[axis]:
+			p.shape = append(p.shape, size)
+		case keepDims:
+			p.shape = append(p.shape, 1)
+		}
+		lead := separate && leading && reduced[axis]
+		leading = leading && reduced[axis]
+		if size == 1 {
+			continue
+		}
+		if last := len(p.dims) - 1; last >= 0 && p.reduce[last] == reduced[axis] && !(separate && reduced[axis]) {
+			p.dims[last] *= size
+			continue
+		}
+		p.dims = append(p.dims, size)
+		p.reduce = append(p.reduce, reduced[axis])
+		p.lead = append(p.lead, lead)
+	}
+	if !slices.Contains(p.reduce, true) {
+		// Only axes of size 1 are reduced: the reduction is a copy.
+		p.dims = append(p.dims, 1)
+		p.reduce = append(p.reduce, true)
+		p.lead = append(p.lead, false)
+	}
+	total := shape.TotalSize()
+	if total == 0 {
+		return p, ReasonEmpty
+	}
+
+	// Float32s, unlike Data, is a slice for scalars too.
+	data := ad.Float32s()
+	p.a, p.data = ad, data
+	p.contiguous = isRowMajorContiguous(ad) && len(data) >= total
+	p.count = total / p.shape.TotalSize()
+	if ad.IsMasked() {
+		return p, ReasonLayout
+	}
+	return p, e.dispatchReason(op, reduceCost(p.shape.TotalSize(), p.count))
+}
+
+// argPlan is an Argmax or Argmin that planArg accepted for the GPU.
+type argPlan struct {
+	op   Op
+	a    *tensor.Dense
+	data []float32
+
+	// contiguous is set when data holds a's elements in row-major order
+	// as is; otherwise they are gathered into a staging buffer.
+	contiguous bool
+
+	// The arguments are taken along the middle axis of a's elements
+	// viewed as an outer x n x inner array.
+	outer, n, inner int
+
+	// shape is the shape of the result: a's shape without the axis, as
+	// StdEng.Argmax returns it, or empty for a scalar.
+	shape tensor.Shape
+}
+
+// planArg decides whether the Argmax or Argmin op of a along axis can
+// run on the GPU. It returns ReasonNone when it can, and otherwise the
+// reason it must fall back. axis may be tensor.AllAxes, for the index of
+// a's extreme in row-major order.
+func (e *MPSEng) planArg(op Op, a tensor.Tensor, axis int) (p argPlan, reason FallbackReason) {
+	p.op = op
+	ad, ok := a.(*tensor.Dense)
+	if !ok {
+		return p, ReasonNotDense
+	}
+	if ad.Dtype() != tensor.Float32 {
+		return p, ReasonDtype
+	}
+
+	// Unlike reductions, arguments take no negative axes: -1 is
+	// tensor.AllAxes, and the fallback engine reports the others.
+	shape := ad.Shape()
+	total := shape.TotalSize()
+	switch {
+	case axis == tensor.AllAxes:
+		p.outer, p.n, p.inner = 1, total, 1
+		p.shape = tensor.Shape{}
+	case axis >= 0 && axis < len(shape):
+		p.outer, p.n, p.inner = product(shape[:axis]), shape[axis], product(shape[axis+1:])
+		p.shape = slices.Delete(shape.Clone(), axis, axis+1)
+	default:
+		return p, ReasonAxis
+	}
+	if total == 0 {
+		return p, ReasonEmpty
+	}
+	if ad.IsMasked() {
+		return p, ReasonLayout
+	}
+	// Float32s, unlike Data, is a slice for scalars too.
+	data := ad.Float32s()
+
+	p.a, p.data = ad, data
+	p.contiguous = isRowMajorContiguous(ad) && len(data) >= total
+	return p, e.dispatchReason(op, reduceCost(p.outer*p.inner, p.n))
+}
+
+// resolveAxis mirrors tensor.resolveAxis (which is unexported) so that
+// we can support negative axes in a consistent way for reductions.
+//
+// For example, for dims=2 and axis=-1 this returns 1 (the last dim).
+func resolveAxis(axis, dims int) int {
+	res := axis % dims
+	if (res < 0 && dims > 0) || (res > 0 && dims < 0) {
+		return res + dims
+	}
+	return res
+}
+
+// batchedMatMulDims extracts the broadcast batch shape and (m, n, k) for
+// C[..., m x n] = A[..., m x k] * B[..., k x n]. The leading (batch) dims
+// of A and B broadcast against each other: aligned from the right, each
+// pair must be equal or contain a 1, and missing dims count as 1. C must
+// have the broadcast batch shape.
+func batchedMatMulDims(shapeA, shapeB, shapeC tensor.Shape) (batch tensor.Shape, m, n, k int, err error) {
+	ra, rb := len(shapeA), len(shapeB)
+	if ra < 2 || rb < 2 {
+		return nil, 0, 0, 0, fmt.Errorf("mps: BatchedMatMul needs operands of rank >= 2, got a=%v, b=%v", shapeA, shapeB)
+	}
+	m, kA := shapeA[ra-2], shapeA[ra-1]
+	kB, n := shapeB[rb-2], shapeB[rb-1]
+	if kA != kB {
+		return nil, 0, 0, 0, fmt.Errorf("mps: BatchedMatMul shape mismatch: a=%v, b=%v (inner dims %d vs %d)", shapeA, shapeB, kA, kB)
+	}
+
+	leadA, leadB := shapeA[:ra-2], shapeB[:rb-2]
+	batch = make(tensor.Shape, max(len(leadA), len(leadB)))
+	for i := range batch {
+		da, db := 1, 1
+		if j := len(leadA) - len(batch) + i; j >= 0 {
+			da = leadA[j]
+		}
+		if j := len(leadB) - len(batch) + i; j >= 0 {
+			db = leadB[j]
+		}
+		switch {
+		case da == db || db == 1:
+			batch[i] = da
+		case da == 1:
+			batch[i] = db
+		default:
+			return nil, 0, 0, 0, fmt.Errorf("mps: BatchedMatMul batch dims do not broadcast: a=%v, b=%v", shapeA, shapeB)
+		}
+	}
+
+	want := append(batch.Clone(), m, n)
+	if len(shapeC) != len(want) {
+		return nil, 0, 0, 0, fmt.Errorf("mps: BatchedMatMul prealloc shape mismatch: expected %v, got %v", want, shapeC)
+	}
+	for i := range want {
+		if shapeC[i] != want[i] {
+			return nil, 0, 0, 0, fmt.Errorf("mps: BatchedMatMul prealloc shape mismatch: expected %v, got %v", want, shapeC)
+		}
+	}
+	return batch, m, n, kA, nil
+}
+
+// matMulDims extracts (m, n, k) for C[m x n] = A[m x k] * B[k x n],
+// checking that the three shapes are 2D and agree before indexing them.
+func matMulDims(shapeA, shapeB, shapeC tensor.Shape) (m, n, k int, err error) {
+	if len(shapeA) != 2 || len(shapeB) != 2 || len(shapeC) != 2 {
+		return 0, 0, 0, fmt.Errorf("mps: MatMul requires 2D operands, got a=%v, b=%v, prealloc=%v", shapeA, shapeB, shapeC)
+	}
+	m, kA := shapeA[0], shapeA[1]
+	kB, n := shapeB[0], shapeB[1]
+
+	if kA != kB {
+		return 0, 0, 0, fmt.Errorf("mps: MatMul shape mismatch: a=%v, b=%v (inner dims %d vs %d)", shapeA, shapeB, kA, kB)
+	}
+	if shapeC[0] != m || shapeC[1] != n {
+		return 0, 0, 0, fmt.Errorf("mps: MatMul prealloc shape mismatch: expected [%d %d], got %v", m, n, shapeC)
+	}
+	return m, n, kA, nil
+}
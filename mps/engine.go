@@ -2,30 +2,108 @@
 package mps
 
 import (
-	"unsafe"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
 
 	"gorgonia.org/tensor"
 )
 
+// ErrEngineClosed is returned by the accelerated methods of an MPSEng
+// after Close has been called.
+var ErrEngineClosed = errors.New("mps: engine is closed")
+
 // MPSEng is a tensor.Engine implementation that embeds tensor.StdEng but
-// also holds an opaque handle to a GPU context used by the MPS-backed
-// operations (matmul and future ops).
+// also holds a device backend (a Metal context on darwin) used by the
+// accelerated operations (matrix and vector products, sums and future
+// ops).
+//
+// An MPSEng owns native Metal resources; call Close when done with it.
+//
+// An MPSEng is safe for concurrent use by multiple goroutines, so a single
+// engine can be shared by, e.g., every handler of a server. Each call to
+// an accelerated method encodes its own command buffer on the engine's
+// Metal command queue, and the Go-side state (stats, thresholds, the
+// backend handle) is synchronized. Concurrent calls must not write to the
+// same tensors, as with any engine, and a configured fallback engine must
+// itself be safe for concurrent use. A call racing with Close either
+// completes or falls back to the CPU.
 type MPSEng struct {
 	tensor.StdEng
-	ctx unsafe.Pointer
+	cfg   config
+	stats counters
+
+	// thresholds holds the live per-op crossovers; it starts out as
+	// cfg.thresholds and is swapped atomically by Calibrate.
+	thresholds atomic.Pointer[thresholdTable]
+
+	// mu guards be: kernels hold it for reading while they use the
+	// backend, and Close holds it for writing while releasing it. be is
+	// nil when there is no device or after Close.
+	mu     sync.RWMutex
+	be     backend
+	closed atomic.Bool
+
+	// pool recycles the buffers used to stage non-row-major operands.
+	pool *stagingPool
 }
 
-// NewMPSEng constructs a new MPSEng.
+// NewMPSEng constructs a new MPSEng configured by opts.
 //
-// For now there’s nothing to initialize beyond the embedded StdEng, but this
-// gives you a single place to add MPS/Metal setup later (device, queue, etc.).
-func NewMPSEng() *MPSEng {
+// Without options supported ops are sent to the GPU once they are large
+// enough to amortize the dispatch overhead, and everything else silently
+// falls back to the embedded StdEng; see Option for ways to change that
+// policy.
+//
+// A finalizer releases the engine's native resources if it becomes
+// unreachable without being closed, but callers should not rely on it.
+func NewMPSEng(opts ...Option) *MPSEng {
 	e := &MPSEng{
 		StdEng: tensor.StdEng{},
+		cfg:    defaultConfig(),
+	}
+	for _, opt := range opts {
+		opt(&e.cfg)
 	}
-	initMPSEngine(e)
+	th := e.cfg.thresholds
+	e.thresholds.Store(&th)
+	e.pool = newStagingPool(e.cfg.maxPoolBytes)
+	if e.cfg.backend != nil {
+		e.be = e.cfg.backend
+	} else {
+		e.be = newDefaultBackend()
+	}
+	runtime.SetFinalizer(e, (*MPSEng).Close)
 	return e
 }
 
+// Close releases the device resources owned by the engine. After
+// Close, the accelerated methods (MatMul, Sum, ...) return
+// ErrEngineClosed; methods inherited from tensor.StdEng keep working
+// since they never touch the GPU. Close is idempotent and always returns
+// nil.
+func (e *MPSEng) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed.Swap(true) {
+		return nil
+	}
+	if e.be != nil {
+		e.be.release()
+		e.be = nil
+	}
+	runtime.SetFinalizer(e, nil)
+	return nil
+}
+
+// checkOpen returns ErrEngineClosed once the engine has been closed.
+func (e *MPSEng) checkOpen() error {
+	if e.closed.Load() {
+		return ErrEngineClosed
+	}
+	return nil
+}
+
 // Compile-time check that *MPSEng satisfies tensor.Engine.
 var _ tensor.Engine = (*MPSEng)(nil)
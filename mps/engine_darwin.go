@@ -4,9 +4,8 @@
 //
 // Darwin-specific initialization for MPSEng. This ensures that the
 // underlying Metal device and command queue used by the MPS-backed
-// operations (currently MatMul, and future ops) are created eagerly
-// when a new engine is constructed, rather than lazily inside each
-// operation.
+// operations are created eagerly when a new engine is constructed,
+// rather than lazily inside each operation.
 
 package mps
 
@@ -17,12 +16,26 @@ package mps
 */
 import "C"
 
-import "unsafe"
+import "sync"
 
-// initMPSEngine performs any one-time Metal/MPS initialization needed
-// for this engine instance. At the moment it simply creates a dedicated
-// engine context; future GPU-backed ops can be wired through here as
-// well.
-func initMPSEngine(e *MPSEng) {
-	e.ctx = unsafe.Pointer(C.MPSEngineCreateContext())
+// newDefaultBackend creates a dedicated engine context on the system
+// default Metal device and wraps it in a Metal backend. It returns nil if
+// no device is available, in which case every op falls back to the CPU.
+func newDefaultBackend() backend {
+	ctx := C.MPSEngineCreateContext()
+	if ctx == nil {
+		return nil
+	}
+	return &metalBackend{ctx: ctx}
 }
+
+// defaultDeviceName returns the name of the system default Metal device,
+// which is the device every engine context is created on, or
+// noDeviceName if there is none. The name is looked up once.
+var defaultDeviceName = sync.OnceValue(func() string {
+	var buf [256]C.char
+	if C.MPSDefaultDeviceName(&buf[0], C.int(len(buf))) != 0 {
+		return noDeviceName
+	}
+	return C.GoString(&buf[0])
+})
@@ -3,14 +3,18 @@
 // engine_other.go
 //
 // Non-darwin (or non-cgo) stub for MPSEng initialization. On these
-// platforms, MPSEng simply delegates to tensor.StdEng without any
-// additional setup.
+// platforms there is no device backend, so MPSEng delegates every op to
+// its fallback engine (tensor.StdEng by default).
 
 package mps
 
-func initMPSEngine(e *MPSEng) {
-	_ = e
-	// No-op on non-Metal platforms.
+// newDefaultBackend reports that there is no device on non-Metal
+// platforms.
+func newDefaultBackend() backend {
+	return nil
 }
 
-
+// defaultDeviceName reports that there is no Metal device.
+func defaultDeviceName() string {
+	return noDeviceName
+}
@@ -0,0 +1,37 @@
+package mps
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMPSEngCloseIdempotent(t *testing.T) {
+	e := NewMPSEng()
+	for i := 0; i < 3; i++ {
+		if err := e.Close(); err != nil {
+			t.Fatalf("Close #%d returned %v", i+1, err)
+		}
+	}
+	if e.be != nil {
+		t.Fatalf("Close did not release the engine backend")
+	}
+}
+
+// Test that the accelerated methods refuse to run after Close.
+func TestMPSEngUseAfterClose(t *testing.T) {
+	e := NewMPSEng()
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	a := newZeroFloat32Matrix(2, 3)
+	b := newZeroFloat32Matrix(3, 4)
+	c := newZeroFloat32Matrix(2, 4)
+
+	if err := e.MatMul(a, b, c); !errors.Is(err, ErrEngineClosed) {
+		t.Fatalf("MatMul after Close: got %v, want ErrEngineClosed", err)
+	}
+	if _, err := e.Sum(a, 1); !errors.Is(err, ErrEngineClosed) {
+		t.Fatalf("Sum after Close: got %v, want ErrEngineClosed", err)
+	}
+}
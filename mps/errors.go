@@ -0,0 +1,48 @@
+// errors.go
+//
+// Error types reported by MPSEng in addition to ErrEngineClosed.
+
+package mps
+
+import (
+	"fmt"
+	"strings"
+
+	"gorgonia.org/tensor"
+)
+
+// FallbackError is returned in strict mode (see WithStrict) when an op
+// would otherwise have fallen back to the CPU. Inspect it with
+// errors.As.
+type FallbackError struct {
+	Op     Op
+	Reason FallbackReason
+	// Shapes holds the shape of every tensor operand, in argument order.
+	Shapes []tensor.Shape
+	// Dtype is the dtype of the first operand.
+	Dtype tensor.Dtype
+}
+
+func (e *FallbackError) Error() string {
+	shapes := make([]string, len(e.Shapes))
+	for i, s := range e.Shapes {
+		shapes[i] = fmt.Sprintf("%v", s)
+	}
+	return fmt.Sprintf("mps: %v on %v %s not accelerated (%v) and strict mode forbids CPU fallback",
+		e.Op, e.Dtype, strings.Join(shapes, " x "), e.Reason)
+}
+
+// newFallbackError describes operands of op rejected for reason.
+func newFallbackError(op Op, reason FallbackReason, operands ...tensor.Tensor) *FallbackError {
+	fe := &FallbackError{Op: op, Reason: reason}
+	for i, t := range operands {
+		if t == nil {
+			continue
+		}
+		if i == 0 {
+			fe.Dtype = t.Dtype()
+		}
+		fe.Shapes = append(fe.Shapes, t.Shape().Clone())
+	}
+	return fe
+}
@@ -0,0 +1,60 @@
+package mps
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// Test that strict mode reports the op, shapes, dtype and reason of a
+// rejected MatMul through a *FallbackError.
+func TestStrictMatMulFallbackError(t *testing.T) {
+	e := NewMPSEng(WithStrict(true))
+	defer e.Close()
+
+	a := tensor.New(tensor.WithShape(2, 3), tensor.Of(tensor.Float64))
+	b := tensor.New(tensor.WithShape(3, 4), tensor.Of(tensor.Float64))
+	c := tensor.New(tensor.WithShape(2, 4), tensor.Of(tensor.Float64))
+
+	err := e.MatMul(a, b, c)
+	var fe *FallbackError
+	if !errors.As(err, &fe) {
+		t.Fatalf("expected *FallbackError, got %T (%v)", err, err)
+	}
+	if fe.Op != OpMatMul || fe.Reason != ReasonDtype || fe.Dtype != tensor.Float64 {
+		t.Fatalf("unexpected FallbackError fields: %+v", fe)
+	}
+	if len(fe.Shapes) != 3 || !fe.Shapes[0].Eq(tensor.Shape{2, 3}) || !fe.Shapes[2].Eq(tensor.Shape{2, 4}) {
+		t.Fatalf("unexpected FallbackError shapes: %v", fe.Shapes)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "MatMul") || !strings.Contains(msg, "dtype") {
+		t.Fatalf("error message lacks op or reason: %q", msg)
+	}
+	if n := e.Stats().Ops[OpMatMul].Fallbacks[ReasonDtype]; n != 1 {
+		t.Fatalf("strict-mode fallback not counted: %d", n)
+	}
+}
+
+// Test that, without a Metal device, strict mode rejects otherwise
+// supported inputs with ReasonNoDevice.
+func TestStrictNoDevice(t *testing.T) {
+	e := NewMPSEng(WithStrict(true), WithMinFLOPs(0))
+	defer e.Close()
+	if e.hasDevice() {
+		t.Skip("Metal device available")
+	}
+
+	x := newZeroFloat32Matrix(3, 4)
+	err := e.MatMul(x, newZeroFloat32Matrix(4, 2), newZeroFloat32Matrix(3, 2))
+	var fe *FallbackError
+	if !errors.As(err, &fe) || fe.Reason != ReasonNoDevice {
+		t.Fatalf("MatMul: expected ReasonNoDevice FallbackError, got %v", err)
+	}
+
+	_, err = e.Sum(x, -1)
+	if !errors.As(err, &fe) || fe.Op != OpSum || fe.Reason != ReasonNoDevice {
+		t.Fatalf("Sum: expected ReasonNoDevice FallbackError, got %v", err)
+	}
+}
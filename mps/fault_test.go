@@ -0,0 +1,334 @@
+package mps
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// fault scripts the outcome of one backend kernel call.
+type fault struct {
+	// status is returned instead of running the kernel when non-zero.
+	status int
+
+	// corrupt fills the call's output with NaN (indices with -1),
+	// before failing with status or, when status is 0, instead of
+	// computing it.
+	corrupt bool
+
+	// after runs once the kernel has succeeded, before the engine sees
+	// its result, as a concurrent caller could.
+	after func()
+}
+
+// faultBackend wraps the reference backend and injects faults into
+// selected kernel calls, so that the engine's device-failure paths can be
+// exercised without a GPU. Calls are numbered from 1 across all kernels.
+type faultBackend struct {
+	inner backend
+
+	mu     sync.Mutex
+	calls  int
+	faults map[int]fault
+	always *fault
+}
+
+// newFaultBackend returns a backend that applies faults[n] to the nth
+// kernel call and runs every other call on the reference backend.
+func newFaultBackend(faults map[int]fault) *faultBackend {
+	return &faultBackend{inner: newRefBackend(), faults: faults}
+}
+
+// newFailingBackend returns a backend whose every kernel call applies f.
+func newFailingBackend(f fault) *faultBackend {
+	return &faultBackend{inner: newRefBackend(), always: &f}
+}
+
+// next counts a kernel call and returns the fault scripted for it.
+func (fb *faultBackend) next() fault {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.calls++
+	if fb.always != nil {
+		return *fb.always
+	}
+	return fb.faults[fb.calls]
+}
+
+// run runs kernel and then, if it succeeded, f.after.
+func (f fault) run(kernel func() int) int {
+	status := kernel()
+	if status == 0 && f.after != nil {
+		f.after()
+	}
+	return status
+}
+
+func (fb *faultBackend) callCount() int {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.calls
+}
+
+func (fb *faultBackend) deviceName() string { return "fault" }
+
+func (fb *faultBackend) maxBufferBytes() int64 { return fb.inner.maxBufferBytes() }
+
+func (fb *faultBackend) matMulF32(g gemmArgs) int {
+	f := fb.next()
+	if f.corrupt {
+		fillNaN(g.c[:g.m*g.n])
+	}
+	if f.status != 0 || f.corrupt {
+		return f.status
+	}
+	return f.run(func() int { return fb.inner.matMulF32(g) })
+}
+
+func (fb *faultBackend) batchedMatMulF32(g gemmArgs, batch int) int {
+	f := fb.next()
+	if f.corrupt {
+		fillNaN(g.c[:batch*g.m*g.n])
+	}
+	if f.status != 0 || f.corrupt {
+		return f.status
+	}
+	return f.run(func() int { return fb.inner.batchedMatMulF32(g, batch) })
+}
+
+func (fb *faultBackend) reduceAxisF32(op reduceOp, x, y []float32, outer, n, inner int) int {
+	f := fb.next()
+	if f.corrupt {
+		fillNaN(y[:outer*inner])
+	}
+	if f.status != 0 || f.corrupt {
+		return f.status
+	}
+	return f.run(func() int { return fb.inner.reduceAxisF32(op, x, y, outer, n, inner) })
+}
+
+func (fb *faultBackend) argReduceAxisF32(op reduceOp, x []float32, idx []int32, outer, n, inner int) int {
+	f := fb.next()
+	if f.corrupt {
+		for i := range idx[:outer*inner] {
+			idx[i] = -1
+		}
+	}
+	if f.status != 0 || f.corrupt {
+		return f.status
+	}
+	return f.run(func() int { return fb.inner.argReduceAxisF32(op, x, idx, outer, n, inner) })
+}
+
+func (fb *faultBackend) release() { fb.inner.release() }
+
+func fillNaN(xs []float32) {
+	nan := float32(math.NaN())
+	for i := range xs {
+		xs[i] = nan
+	}
+}
+
+// stdMatMul computes a x b with StdEng from the operands' logical values.
+func stdMatMul(t *testing.T, a, b *tensor.Dense) []float32 {
+	t.Helper()
+	m, n := a.Shape()[0], b.Shape()[1]
+	want := newZeroFloat32Matrix(m, n)
+	var cpu tensor.StdEng
+	if err := cpu.MatMul(tensor.New(tensor.WithShape(a.Shape()...), tensor.WithBacking(denseValues(t, a))),
+		tensor.New(tensor.WithShape(b.Shape()...), tensor.WithBacking(denseValues(t, b))), want); err != nil {
+		t.Fatalf("StdEng.MatMul error: %v", err)
+	}
+	return extractFloat32Backing(t, want)
+}
+
+// Test that a failing device call falls back to a correct CPU result,
+// even when the device clobbered the output before failing, and that the
+// failure is counted as ReasonDeviceError whatever the status code.
+func TestDeviceFailureFallsBack(t *testing.T) {
+	r := rand.New(rand.NewSource(21))
+	for _, status := range []int{1, -1, 255} {
+		a := newRandomFloat32Matrix(t, 4, 6, r)
+		b := newRandomFloat32Matrix(t, 6, 5, r)
+		c := newZeroFloat32Matrix(4, 5)
+
+		fb := newFailingBackend(fault{status: status, corrupt: true})
+		cpu := &countingEngine{}
+		e := newRefEngine(t, withBackend(fb), WithFallbackEngine(cpu))
+		if err := e.MatMul(a, b, c); err != nil {
+			t.Fatalf("status %d: MatMul error: %v", status, err)
+		}
+		if fb.callCount() != 1 || cpu.matMuls != 1 {
+			t.Fatalf("status %d: %d device calls and %d fallbacks, want 1 each", status, fb.callCount(), cpu.matMuls)
+		}
+		if got, want := extractFloat32Backing(t, c), stdMatMul(t, a, b); !equalApprox(got, want, 1e-5) {
+			t.Fatalf("status %d: fallback result wrong\n got:  %v\n want: %v", status, got, want)
+		}
+		st := e.Stats().Ops[OpMatMul]
+		if st.Accelerated != 0 || st.Fallbacks[ReasonDeviceError] != 1 || st.TotalFallbacks() != 1 {
+			t.Fatalf("status %d: unexpected stats %+v", status, st)
+		}
+	}
+}
+
+// Test that only the scripted call fails and the engine keeps using the
+// device afterwards.
+func TestDeviceFailureOnNthCall(t *testing.T) {
+	r := rand.New(rand.NewSource(22))
+	fb := newFaultBackend(map[int]fault{2: {status: 3}})
+	e := newRefEngine(t, withBackend(fb))
+
+	for i := 0; i < 3; i++ {
+		a := newRandomFloat32Matrix(t, 3, 4, r)
+		b := newRandomFloat32Matrix(t, 4, 2, r)
+		c := newZeroFloat32Matrix(3, 2)
+		if err := e.MatMul(a, b, c); err != nil {
+			t.Fatalf("call %d: MatMul error: %v", i+1, err)
+		}
+		if got, want := extractFloat32Backing(t, c), stdMatMul(t, a, b); !equalApprox(got, want, 1e-5) {
+			t.Fatalf("call %d: wrong result\n got:  %v\n want: %v", i+1, got, want)
+		}
+	}
+
+	st := e.Stats().Ops[OpMatMul]
+	if st.Accelerated != 2 || st.Fallbacks[ReasonDeviceError] != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestSumDeviceFailureFallsBack(t *testing.T) {
+	r := rand.New(rand.NewSource(23))
+	x := newRandomFloat32Matrix(t, 5, 7, r)
+
+	var cpu tensor.StdEng
+	want, err := cpu.Sum(x.Clone().(*tensor.Dense), 1)
+	if err != nil {
+		t.Fatalf("StdEng.Sum error: %v", err)
+	}
+
+	e := newRefEngine(t, withBackend(newFailingBackend(fault{status: 7})))
+	got, err := e.Sum(x, 1)
+	if err != nil {
+		t.Fatalf("Sum error: %v", err)
+	}
+	if !equalApprox(got.Data().([]float32), want.Data().([]float32), 1e-5) {
+		t.Fatalf("fallback result wrong\n got:  %v\n want: %v", got.Data(), want.Data())
+	}
+	if st := e.Stats().Ops[OpSum]; st.Accelerated != 0 || st.Fallbacks[ReasonDeviceError] != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+// Test that a device that reports success has its output delivered as
+// is, including through the scatter-back of a staged output.
+func TestDeviceOutputReachesCaller(t *testing.T) {
+	r := rand.New(rand.NewSource(24))
+	c := slicedView(t, 3, 2, r)
+	e := newRefEngine(t, withBackend(newFailingBackend(fault{corrupt: true})))
+	if err := e.MatMul(newRandomFloat32Matrix(t, 3, 4, r), newRandomFloat32Matrix(t, 4, 2, r), c); err != nil {
+		t.Fatalf("MatMul error: %v", err)
+	}
+	for i, v := range denseValues(t, c) {
+		if !math.IsNaN(float64(v)) {
+			t.Fatalf("c[%d] = %v, want the device's NaN output", i, v)
+		}
+	}
+	if st := e.Stats().Ops[OpMatMul]; st.Accelerated != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestStrictDeviceFailure(t *testing.T) {
+	e := newRefEngine(t, withBackend(newFailingBackend(fault{status: 1})), WithStrict(true))
+	x := newZeroFloat32Matrix(3, 4)
+
+	err := e.MatMul(x, newZeroFloat32Matrix(4, 2), newZeroFloat32Matrix(3, 2))
+	var fe *FallbackError
+	if !errors.As(err, &fe) || fe.Op != OpMatMul || fe.Reason != ReasonDeviceError {
+		t.Fatalf("MatMul: expected ReasonDeviceError FallbackError, got %v", err)
+	}
+
+	_, err = e.Sum(x, -1)
+	if !errors.As(err, &fe) || fe.Op != OpSum || fe.Reason != ReasonDeviceError {
+		t.Fatalf("Sum: expected ReasonDeviceError FallbackError, got %v", err)
+	}
+
+	for _, op := range []Op{OpMatMul, OpSum} {
+		if st := e.Stats().Ops[op]; st.Fallbacks[ReasonDeviceError] != 1 {
+			t.Fatalf("%v: device error not counted: %+v", op, st)
+		}
+	}
+}
+
+// restoringEngine is a countingEngine that reshapes MatMul outputs back
+// to shape before computing them, undoing a fault's reshape.
+type restoringEngine struct {
+	countingEngine
+	shape tensor.Shape
+}
+
+func (r *restoringEngine) MatMul(a, b, prealloc tensor.Tensor) error {
+	if err := prealloc.Reshape(r.shape...); err != nil {
+		return err
+	}
+	return r.countingEngine.MatMul(a, b, prealloc)
+}
+
+// Test the safety net that hands the MatMul to the fallback engine when
+// scattering a staged result into the output tensor fails after a
+// successful device call: here because the output, a column staged for
+// sharing memory with b, is reshaped to a vector while the device runs.
+func TestScatterFailureFallsBack(t *testing.T) {
+	r := rand.New(rand.NewSource(25))
+	a := newRandomFloat32Matrix(t, 3, 4, r)
+	b := newRandomFloat32Matrix(t, 4, 1, r)
+	column := func(b *tensor.Dense) *tensor.Dense {
+		t.Helper()
+		c, err := b.Slice(tensor.S(0, 3))
+		if err != nil {
+			t.Fatalf("Slice error: %v", err)
+		}
+		return c.(*tensor.Dense)
+	}
+	reshaping := func(c *tensor.Dense) Option {
+		return withBackend(newFaultBackend(map[int]fault{1: {after: func() {
+			if err := c.Reshape(3); err != nil {
+				t.Errorf("Reshape error: %v", err)
+			}
+		}}}))
+	}
+	want := make([]float32, 3)
+	for i, v := range naiveMatMul(t, a, b) {
+		want[i] = float32(v)
+	}
+
+	cpu := &restoringEngine{shape: tensor.Shape{3, 1}}
+	bb := b.Clone().(*tensor.Dense)
+	c := column(bb)
+	e := newRefEngine(t, WithFallbackEngine(cpu), reshaping(c))
+	if err := e.MatMul(a, bb, c); err != nil {
+		t.Fatalf("MatMul error: %v", err)
+	}
+	if cpu.matMuls != 1 {
+		t.Fatalf("fallback engine called %d times, want 1", cpu.matMuls)
+	}
+	if st := e.Stats().Ops[OpMatMul]; st.Accelerated != 0 || st.Fallbacks[ReasonLayout] != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if got := c.Float32s()[:3]; !equalApprox(got, want, 1e-5) {
+		t.Fatalf("fallback product differs\n got:  %v\n want: %v", got, want)
+	}
+
+	bb = b.Clone().(*tensor.Dense)
+	c = column(bb)
+	strict := newRefEngine(t, WithStrict(true), reshaping(c))
+	err := strict.MatMul(a, bb, c)
+	var fe *FallbackError
+	if !errors.As(err, &fe) || fe.Reason != ReasonLayout {
+		t.Fatalf("strict: expected ReasonLayout FallbackError, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+// gemm.go
+//
+// Gemm: C = alpha * A x B + beta * C in a single device call, and
+// MatMulOpts, which maps the tensor package's WithReuse and WithIncr
+// options onto it so that accumulating products (C += A x B, as in
+// gradient accumulation) need neither a temporary nor a separate Add.
+
+package mps
+
+import (
+	"fmt"
+
+	"gorgonia.org/tensor"
+)
+
+// Gemm computes c = alpha * a x b + beta * c for 2D a (M x K), b (K x N)
+// and c (M x N). When beta is 0 the previous contents of c are ignored,
+// NaNs included, as in BLAS.
+//
+// Gemm shares MatMul's dispatch policy, layout handling and Stats
+// (OpMatMul): float32 Dense operands run on the GPU with alpha and beta
+// applied by the device, and everything else falls back to a MatMul on
+// the fallback engine followed by the blend on the CPU. Besides float32,
+// the fallback supports float64 outputs, and for alpha 1 and beta 0 any
+// output the fallback engine's MatMul accepts.
+func (e *MPSEng) Gemm(alpha float64, a, b tensor.Tensor, beta float64, c tensor.Tensor) error {
+	if err := e.checkOpen(); err != nil {
+		return err
+	}
+
+	p, reason, err := e.planMatMul(a, b, c)
+	if err != nil {
+		return err
+	}
+	if reason != ReasonNone {
+		return e.fallbackGemm(reason, alpha, a, b, beta, c)
+	}
+	p.alpha, p.beta, p.prec = float32(alpha), float32(beta), e.cfg.precision
+	if reason := e.execMatMul(p); reason != ReasonNone {
+		return e.fallbackGemm(reason, alpha, a, b, beta, c)
+	}
+
+	e.stats.recordAccelerated(OpMatMul)
+	return nil
+}
+
+// MatMulOpts computes a x b like tensor.MatMul, honoring the WithReuse
+// and WithIncr function options:
+//
+//   - WithIncr(incr) accumulates the product into incr (incr += a x b)
+//     with a single Gemm and returns incr;
+//   - WithReuse(reuse) writes the product into reuse and returns it;
+//   - with both, the product is written into reuse and then added to
+//     incr, which is returned, as tensor.Dense.MatMul does;
+//   - with neither, a new M x N tensor using this engine is returned.
+//
+// Other options are ignored.
+func (e *MPSEng) MatMulOpts(a, b tensor.Tensor, opts ...tensor.FuncOpt) (tensor.Tensor, error) {
+	fo := tensor.ParseFuncOpts(opts...)
+	reuse, incr := fo.Reuse(), fo.Incr()
+
+	switch {
+	case incr != nil && reuse == nil:
+		if err := e.Gemm(1, a, b, 1, incr); err != nil {
+			return nil, err
+		}
+		return incr, nil
+	case incr != nil:
+		if err := e.MatMul(a, b, reuse); err != nil {
+			return nil, err
+		}
+		if _, err := e.StdEng.Add(incr, reuse, tensor.UseUnsafe()); err != nil {
+			return nil, fmt.Errorf("mps: MatMul accumulating into incr: %w", err)
+		}
+		return incr, nil
+	case reuse != nil:
+		if err := e.MatMul(a, b, reuse); err != nil {
+			return nil, err
+		}
+		return reuse, nil
+	}
+
+	if a.Dims() != 2 || b.Dims() != 2 {
+		return nil, fmt.Errorf("mps: MatMul requires matrices, got a=%v, b=%v", a.Shape(), b.Shape())
+	}
+	retVal := tensor.New(tensor.WithShape(a.Shape()[0], b.Shape()[1]), tensor.Of(a.Dtype()), tensor.WithEngine(e))
+	if err := e.MatMul(a, b, retVal); err != nil {
+		return nil, err
+	}
+	return retVal, nil
+}
+
+// fallbackGemm records why a Gemm is not accelerated and computes it on
+// the CPU: with sgemm if WithCPUGEMM allows, and otherwise as a product
+// from the configured fallback engine's MatMul through cpuMatMul, into a
+// temporary unless it is a plain product, blended with c here. In strict
+// mode it returns a *FallbackError instead.
+func (e *MPSEng) fallbackGemm(reason FallbackReason, alpha float64, a, b tensor.Tensor, beta float64, c tensor.Tensor) error {
+	e.stats.recordFallback(OpMatMul, reason)
+	if e.cfg.strict {
+		return newFallbackError(OpMatMul, reason, a, b, c)
+	}
+	if e.cpuGEMMEligible(reason) {
+		if p, r, err := matMulOperands(a, b, c); err == nil && r == ReasonNone {
+			p.alpha, p.beta, p.prec = float32(alpha), float32(beta), e.cfg.precision
+			if e.tryCPUGEMM(OpMatMul, p) {
+				return nil
+			}
+		}
+	}
+	mm := e.fallbackMatMuler(e.cfg.precision)
+	if alpha == 1 && beta == 0 {
+		if reason == ReasonEmpty {
+			return zeroProduct(c.(*tensor.Dense))
+		}
+		return cpuMatMul(mm, a, b, c)
+	}
+	dc, ok := c.(*tensor.Dense)
+	if !ok {
+		return fmt.Errorf("mps: Gemm with alpha %v and beta %v requires a *tensor.Dense output, got %T", alpha, beta, c)
+	}
+	// An empty inner dimension leaves the product all zeros.
+	ab := tensor.New(tensor.WithShape(dc.Shape().Clone()...), tensor.Of(dc.Dtype()))
+	if reason != ReasonEmpty {
+		if err := cpuMatMul(mm, a, b, ab); err != nil {
+			return err
+		}
+	}
+	return blendGemm(alpha, ab, beta, dc)
+}
+
+// blendGemm sets c = alpha * ab + beta * c, where ab is a row-major
+// contiguous tensor with c's shape and dtype. Like the device kernels it
+// ignores c's contents when beta is 0. ab is read with its typed
+// accessors: it is usually a temporary, and Data does not keep a tensor
+// alive while it builds the slice.
+func blendGemm(alpha float64, ab *tensor.Dense, beta float64, c *tensor.Dense) error {
+	var err error
+	switch cd := c.Data().(type) {
+	case []float32:
+		src := ab.Float32s()
+		al, be := float32(alpha), float32(beta)
+		err = forEachRowMajor(c, func(pos, idx int) {
+			if be == 0 {
+				cd[idx] = al * src[pos]
+			} else {
+				cd[idx] = al*src[pos] + be*cd[idx]
+			}
+		})
+	case []float64:
+		src := ab.Float64s()
+		err = forEachRowMajor(c, func(pos, idx int) {
+			if beta == 0 {
+				cd[idx] = alpha * src[pos]
+			} else {
+				cd[idx] = alpha*src[pos] + beta*cd[idx]
+			}
+		})
+	default:
+		return fmt.Errorf("mps: Gemm does not support dtype %v with alpha %v and beta %v", c.Dtype(), alpha, beta)
+	}
+	if err != nil {
+		return fmt.Errorf("mps: Gemm blending into output: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package mps
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// gemmWant is the reference for Gemm: alpha * a x b + beta * c0, with c0
+// ignored when beta is 0.
+func gemmWant(t *testing.T, alpha float32, a, b *tensor.Dense, beta float32, c0 []float32) []float32 {
+	t.Helper()
+	want := stdMatMul(t, a, b)
+	for i := range want {
+		want[i] *= alpha
+		if beta != 0 {
+			want[i] += beta * c0[i]
+		}
+	}
+	return want
+}
+
+func TestGemmParity(t *testing.T) {
+	r := rand.New(rand.NewSource(61))
+
+	outputs := []struct {
+		name string
+		c    func() *tensor.Dense
+	}{
+		{"row-major", func() *tensor.Dense { return newRandomFloat32Matrix(t, 5, 4, r) }},
+		{"sliced", func() *tensor.Dense { return slicedView(t, 5, 4, r) }},
+	}
+	scales := []struct{ alpha, beta float32 }{
+		{1, 0}, {2, 0}, {1, 1}, {-0.5, 3},
+	}
+	engines := []struct {
+		name   string
+		opts   []Option
+		reason FallbackReason
+	}{
+		{"device", []Option{withBackend(newRefBackend())}, ReasonNone},
+		{"fallback", []Option{WithOpEnabled(OpMatMul, false)}, ReasonDisabled},
+		{"device error", []Option{withBackend(newFailingBackend(fault{status: 1, corrupt: true}))}, ReasonDeviceError},
+	}
+
+	for _, out := range outputs {
+		for _, s := range scales {
+			for _, eng := range engines {
+				a, b := transposedView(t, 5, 3, r), newRandomFloat32Matrix(t, 3, 4, r)
+				c := out.c()
+				c0 := denseValues(t, c)
+
+				e := NewMPSEng(append([]Option{WithMinFLOPs(0)}, eng.opts...)...)
+				if err := e.Gemm(float64(s.alpha), a, b, float64(s.beta), c); err != nil {
+					t.Fatalf("%s/%v/%s: Gemm error: %v", out.name, s, eng.name, err)
+				}
+				if got, want := denseValues(t, c), gemmWant(t, s.alpha, a, b, s.beta, c0); !equalApprox(got, want, 1e-4) {
+					t.Fatalf("%s/%v/%s: result differs from reference\n got:  %v\n want: %v", out.name, s, eng.name, got, want)
+				}
+
+				st := e.Stats().Ops[OpMatMul]
+				if eng.reason == ReasonNone {
+					if st.Accelerated != 1 {
+						t.Fatalf("%s/%v/%s: not accelerated: %+v", out.name, s, eng.name, st)
+					}
+				} else if st.Fallbacks[eng.reason] != 1 {
+					t.Fatalf("%s/%v/%s: expected one %v fallback: %+v", out.name, s, eng.name, eng.reason, st)
+				}
+				e.Close()
+			}
+		}
+	}
+}
+
+// Test that beta == 0 ignores the previous contents of c, NaNs included,
+// on the device and the CPU path alike.
+func TestGemmBetaZeroIgnoresOutput(t *testing.T) {
+	r := rand.New(rand.NewSource(62))
+	for _, e := range []*MPSEng{newRefEngine(t), newRefEngine(t, WithOpEnabled(OpMatMul, false))} {
+		a, b := newRandomFloat32Matrix(t, 3, 4, r), newRandomFloat32Matrix(t, 4, 2, r)
+		c := newZeroFloat32Matrix(3, 2)
+		fillNaN(extractFloat32Backing(t, c))
+		if err := e.Gemm(2, a, b, 0, c); err != nil {
+			t.Fatalf("Gemm error: %v", err)
+		}
+		if got, want := denseValues(t, c), gemmWant(t, 2, a, b, 0, nil); !equalApprox(got, want, 1e-5) {
+			t.Fatalf("result differs from reference\n got:  %v\n want: %v", got, want)
+		}
+	}
+}
+
+func TestGemmFloat64Fallback(t *testing.T) {
+	e := newRefEngine(t)
+	a := tensor.New(tensor.WithShape(2, 2), tensor.WithBacking([]float64{1, 2, 3, 4}))
+	b := tensor.New(tensor.WithShape(2, 2), tensor.WithBacking([]float64{5, 6, 7, 8}))
+	c := tensor.New(tensor.WithShape(2, 2), tensor.WithBacking([]float64{1, 1, 1, 1}))
+	if err := e.Gemm(0.5, a, b, -1, c); err != nil {
+		t.Fatalf("Gemm error: %v", err)
+	}
+	want := []float64{0.5*19 - 1, 0.5*22 - 1, 0.5*43 - 1, 0.5*50 - 1}
+	for i, v := range c.Data().([]float64) {
+		if math.Abs(v-want[i]) > 1e-12 {
+			t.Fatalf("got %v, want %v", c.Data(), want)
+		}
+	}
+	if st := e.Stats().Ops[OpMatMul]; st.Fallbacks[ReasonDtype] != 1 {
+		t.Fatalf("expected a dtype fallback: %+v", st)
+	}
+}
+
+// Test that WithIncr accumulates into incr with a single device call and
+// that WithReuse and the default allocate-a-result form agree with MatMul.
+func TestMatMulOpts(t *testing.T) {
+	r := rand.New(rand.NewSource(63))
+	a, b := newRandomFloat32Matrix(t, 4, 3, r), newRandomFloat32Matrix(t, 3, 5, r)
+	want := stdMatMul(t, a, b)
+
+	e := newRefEngine(t)
+	incr := newZeroFloat32Matrix(4, 5)
+	for i := 0; i < 2; i++ {
+		got, err := e.MatMulOpts(a, b, tensor.WithIncr(incr))
+		if err != nil {
+			t.Fatalf("MatMulOpts(WithIncr) error: %v", err)
+		}
+		if got != incr {
+			t.Fatalf("MatMulOpts(WithIncr) did not return incr")
+		}
+	}
+	twice := make([]float32, len(want))
+	for i, v := range want {
+		twice[i] = 2 * v
+	}
+	if got := denseValues(t, incr); !equalApprox(got, twice, 1e-4) {
+		t.Fatalf("incr after two accumulations\n got:  %v\n want: %v", got, twice)
+	}
+	if st := e.Stats(); st.Ops[OpMatMul].Accelerated != 2 {
+		t.Fatalf("accumulation not accelerated: %+v", st.Ops[OpMatMul])
+	}
+
+	reuse := newZeroFloat32Matrix(4, 5)
+	got, err := e.MatMulOpts(a, b, tensor.WithReuse(reuse))
+	if err != nil || got != reuse {
+		t.Fatalf("MatMulOpts(WithReuse) = %v, %v; want reuse", got, err)
+	}
+	if !equalApprox(denseValues(t, reuse), want, 1e-5) {
+		t.Fatalf("reuse holds %v, want %v", denseValues(t, reuse), want)
+	}
+
+	got, err = e.MatMulOpts(a, b, tensor.WithReuse(reuse), tensor.WithIncr(incr))
+	if err != nil || got != incr {
+		t.Fatalf("MatMulOpts(WithReuse, WithIncr) = %v, %v; want incr", got, err)
+	}
+	for i, v := range want {
+		twice[i] += v
+	}
+	if !equalApprox(denseValues(t, incr), twice, 1e-4) {
+		t.Fatalf("incr holds %v, want %v", denseValues(t, incr), twice)
+	}
+
+	got, err = e.MatMulOpts(a, b)
+	if err != nil {
+		t.Fatalf("MatMulOpts error: %v", err)
+	}
+	d := got.(*tensor.Dense)
+	if !d.Shape().Eq(tensor.Shape{4, 5}) || d.Engine() != tensor.Engine(e) {
+		t.Fatalf("new result has shape %v and engine %T", d.Shape(), d.Engine())
+	}
+	if !equalApprox(denseValues(t, d), want, 1e-5) {
+		t.Fatalf("result %v, want %v", denseValues(t, d), want)
+	}
+}
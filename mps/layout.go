@@ -0,0 +1,406 @@
+// layout.go
+//
+// Staging helpers that move 2D float32 tensors of any layout into and out
+// of the contiguous row-major buffers the device backends expect, so that
+// tensor allocations can stay in regular Go/CPU memory.
+
+package mps
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"gorgonia.org/tensor"
+)
+
+// isRowMajorContiguous2D reports whether d is a 2D dense tensor with the
+// standard row-major layout that our simple MPS wrapper expects:
+//
+//	shape = [rows, cols]
+//	strides = [cols, 1]
+func isRowMajorContiguous2D(d *tensor.Dense) bool {
+	if d.Dims() != 2 {
+		return false
+	}
+	shape := d.Shape()
+	strides := d.Strides()
+	if len(shape) != 2 || len(strides) != 2 {
+		return false
+	}
+	rows, cols := shape[0], shape[1]
+	return strides[1] == 1 && strides[0] == cols && rows > 0 && cols > 0
+}
+
+// matLayout classifies how a 2D tensor's elements are stored, which
+// decides whether a device kernel can read it in place.
+type matLayout int
+
+const (
+	// layoutStrided is any layout the kernels cannot read directly
+	// (sliced views with padded rows, masked tensors, ...); such
+	// operands are packed into a row-major staging buffer.
+	layoutStrided matLayout = iota
+	// layoutRowMajor: element (r, c) is at r*cols + c.
+	layoutRowMajor
+	// layoutTransposed (column-major): element (r, c) is at c*rows + r,
+	// i.e. the backing slice holds the transpose row-major. This is what
+	// T() produces on a row-major matrix.
+	layoutTransposed
+)
+
+func (l matLayout) String() string {
+	switch l {
+	case layoutRowMajor:
+		return "row-major"
+	case layoutTransposed:
+		return "transposed"
+	}
+	return "strided"
+}
+
+// classify2D returns the layout of a 2D float32 tensor from its strides.
+// Strides along dims of size 1 are irrelevant, so single-row or
+// single-column matrices may be both row-major and transposed; row-major
+// wins.
+func classify2D(d *tensor.Dense) matLayout {
+	if d.Dims() != 2 || d.IsMasked() {
+		return layoutStrided
+	}
+	shape, strides := d.Shape(), d.Strides()
+	if len(strides) != 2 {
+		return layoutStrided
+	}
+	rows, cols := shape[0], shape[1]
+	if rows == 0 || cols == 0 {
+		return layoutStrided
+	}
+	if data, ok := d.Data().([]float32); !ok || len(data) < rows*cols {
+		return layoutStrided
+	}
+	switch {
+	case (rows == 1 || strides[0] == cols) && (cols == 1 || strides[1] == 1):
+		return layoutRowMajor
+	case (rows == 1 || strides[0] == 1) && (cols == 1 || strides[1] == rows):
+		return layoutTransposed
+	}
+	return layoutStrided
+}
+
+// isRowMajorContiguous reports whether d of any rank stores its elements
+// contiguously in row-major order, so that its backing slice can be used
+// as is. Strides of dims of size 1 are irrelevant and not checked.
+func isRowMajorContiguous(d *tensor.Dense) bool {
+	if d.RequiresIterator() {
+		return false
+	}
+	shape, strides := d.Shape(), d.Strides()
+	if len(strides) != len(shape) {
+		return false
+	}
+	want := 1
+	for i := len(shape) - 1; i >= 0; i-- {
+		if shape[i] != 1 && strides[i] != want {
+			return false
+		}
+		want *= shape[i]
+	}
+	return true
+}
+
+// sharesMemory reports whether the backing storage of x and y overlaps,
+// so that writing one while reading the other is unsafe. It compares
+// whole backing ranges, so views of one tensor that select disjoint
+// elements may still be reported as sharing memory.
+func sharesMemory(x, y *tensor.Dense) bool {
+	xs, ys := x.MemSize(), y.MemSize()
+	if xs == 0 || ys == 0 {
+		return false
+	}
+	x0, y0 := x.Uintptr(), y.Uintptr()
+	return x0 < y0+ys && y0 < x0+xs
+}
+
+// denseToRowMajor2DF32 materializes the logical contents of a 2D float32
+// Dense tensor into a row-major contiguous []float32 buffer.
+//
+// If the tensor is already row-major contiguous and doesn't require an
+// iterator, the returned slice is just the underlying backing slice and
+// alias=true. Otherwise a buffer is taken from pool (or freshly allocated
+// if pool is nil), the values are copied in logical (row, col) order, and
+// alias=false; the caller then owns the buffer and should put it back.
+func denseToRowMajor2DF32(d *tensor.Dense, pool *stagingPool) (buf []float32, alias bool, err error) {
+	if d.Dtype() != tensor.Float32 {
+		return nil, false, fmt.Errorf("denseToRowMajor2DF32: expected Float32, got %v", d.Dtype())
+	}
+	if d.Dims() != 2 {
+		return nil, false, fmt.Errorf("denseToRowMajor2DF32: expected 2D tensor, got %dD", d.Dims())
+	}
+
+	shape := d.Shape()
+	rows, cols := shape[0], shape[1]
+	if rows == 0 || cols == 0 {
+		return nil, false, fmt.Errorf("denseToRowMajor2DF32: zero-sized matrix %v", shape)
+	}
+
+	data, ok := d.Data().([]float32)
+	if !ok {
+		return nil, false, fmt.Errorf("denseToRowMajor2DF32: backing is %T, want []float32", d.Data())
+	}
+
+	// Fast path: already row-major contiguous and no iterator needed.
+	if !d.RequiresIterator() && isRowMajorContiguous2D(d) {
+		need := rows * cols
+		if len(data) < need {
+			return nil, false, fmt.Errorf("denseToRowMajor2DF32: backing slice too small: have %d, need %d", len(data), need)
+		}
+		return data[:need], true, nil
+	}
+
+	// General path: gather the tensor's logical layout (slices, transposes,
+	// masks, ...) into a compact row-major buffer.
+	if pool != nil {
+		buf = pool.get(rows * cols)
+	} else {
+		buf = make([]float32, rows*cols)
+	}
+
+	if err := gatherF32(buf, d, data); err != nil {
+		if pool != nil {
+			pool.put(buf)
+		}
+		return nil, false, fmt.Errorf("denseToRowMajor2DF32: %w", err)
+	}
+
+	return buf, false, nil
+}
+
+// packRowMajor2DF32 copies the logical contents of a 2D float32 Dense
+// tensor into dst in row-major order. dst must hold exactly the tensor's
+// elements.
+func packRowMajor2DF32(dst []float32, d *tensor.Dense) error {
+	if d.Dtype() != tensor.Float32 || d.Dims() != 2 {
+		return fmt.Errorf("packRowMajor2DF32: expected 2D Float32 tensor, got %dD %v", d.Dims(), d.Dtype())
+	}
+	if n := d.Shape().TotalSize(); n != len(dst) {
+		return fmt.Errorf("packRowMajor2DF32: dst holds %d elements, tensor has %d", len(dst), n)
+	}
+	data, ok := d.Data().([]float32)
+	if !ok {
+		return fmt.Errorf("packRowMajor2DF32: backing is %T, want []float32", d.Data())
+	}
+	if isRowMajorContiguous(d) && len(data) >= len(dst) {
+		copy(dst, data)
+		return nil
+	}
+	if err := gatherF32(dst, d, data); err != nil {
+		return fmt.Errorf("packRowMajor2DF32: %w", err)
+	}
+	return nil
+}
+
+// rowMajor2DToDenseF32 writes the contents of a row-major contiguous
+// buffer back into a 2D float32 Dense tensor. If the tensor is already
+// row-major contiguous and doesn't require an iterator, this is a single
+// copy. Otherwise it scatters into the tensor's view layout.
+func rowMajor2DToDenseF32(buf []float32, d *tensor.Dense) error {
+	if d.Dtype() != tensor.Float32 {
+		return fmt.Errorf("rowMajor2DToDenseF32: expected Float32, got %v", d.Dtype())
+	}
+	if d.Dims() != 2 {
+		return fmt.Errorf("rowMajor2DToDenseF32: expected 2D tensor, got %dD", d.Dims())
+	}
+
+	shape := d.Shape()
+	rows, cols := shape[0], shape[1]
+	if rows == 0 || cols == 0 {
+		return fmt.Errorf("rowMajor2DToDenseF32: zero-sized matrix %v", shape)
+	}
+	if len(buf) < rows*cols {
+		return fmt.Errorf("rowMajor2DToDenseF32: buf too small: have %d, need %d", len(buf), rows*cols)
+	}
+
+	data, ok := d.Data().([]float32)
+	if !ok {
+		return fmt.Errorf("rowMajor2DToDenseF32: backing is %T, want []float32", d.Data())
+	}
+
+	// Fast path: direct copy into backing slice.
+	if !d.RequiresIterator() && isRowMajorContiguous2D(d) {
+		copy(data[:rows*cols], buf)
+		return nil
+	}
+
+	// General path: scatter from row-major buffer into the tensor's layout.
+	if err := scatterF32(buf, d, data); err != nil {
+		return fmt.Errorf("rowMajor2DToDenseF32: %w", err)
+	}
+
+	return nil
+}
+
+// parallelStageElems is the number of elements above which gathers and
+// scatters split their rows across goroutines. Below it the goroutine
+// start-up costs more than the copy.
+var parallelStageElems = 1 << 18
+
+// stageBlock is the edge of the square blocks a strided gather or scatter
+// walks, so that the rows of the packed side and the columns of a
+// transposed side both stay in cache.
+const stageBlock = 64
+
+// strided2D describes the elements of d as a rows x cols matrix with
+// element (r, c) at data[r*rs+c*cs], where data is d's backing slice,
+// which starts at the view's offset. Vectors are described as a single
+// column. ok is false for masked tensors, other ranks and strides that
+// would reach outside data; those must go through the iterator.
+func strided2D(d *tensor.Dense, n int) (rows, cols, rs, cs int, ok bool) {
+	if d.IsMasked() {
+		return 0, 0, 0, 0, false
+	}
+	shape, strides := d.Shape(), d.Strides()
+	switch {
+	case d.Dims() == 1 && len(shape) == 1 && len(strides) == 1:
+		rows, cols, rs, cs = shape[0], 1, strides[0], 1
+	case d.Dims() == 2 && len(shape) == 2 && len(strides) == 2:
+		rows, cols, rs, cs = shape[0], shape[1], strides[0], strides[1]
+	default:
+		return 0, 0, 0, 0, false
+	}
+	// Strides of dims of size 1 are never applied.
+	if rows == 1 {
+		rs = 0
+	}
+	if cols == 1 {
+		cs = 0
+	}
+	if rows == 0 || cols == 0 {
+		return rows, cols, rs, cs, true
+	}
+	if rs < 0 || cs < 0 || (rows-1)*rs+(cols-1)*cs >= n {
+		return 0, 0, 0, 0, false
+	}
+	return rows, cols, rs, cs, true
+}
+
+// gatherF32 copies the logical contents of d, whose backing slice is
+// data, into dst in row-major order. dst must hold d's elements.
+func gatherF32(dst []float32, d *tensor.Dense, data []float32) error {
+	if rows, cols, rs, cs, ok := strided2D(d, len(data)); ok {
+		gatherStrided(dst, data, rows, cols, rs, cs)
+		return nil
+	}
+	return forEachRowMajor(d, func(pos, idx int) { dst[pos] = data[idx] })
+}
+
+// scatterF32 copies the row-major src into the elements of d, whose
+// backing slice is data. It is the inverse of gatherF32.
+func scatterF32(src []float32, d *tensor.Dense, data []float32) error {
+	if rows, cols, rs, cs, ok := strided2D(d, len(data)); ok {
+		scatterStrided(data, rows, cols, rs, cs, src)
+		return nil
+	}
+	return forEachRowMajor(d, func(pos, idx int) { data[idx] = src[pos] })
+}
+
+// gatherStrided packs the rows x cols matrix stored in src with element
+// strides rs and cs into dst, row-major.
+func gatherStrided(dst, src []float32, rows, cols, rs, cs int) {
+	forRowRanges(rows, cols, func(r0, r1 int) {
+		if cs == 1 {
+			for r := r0; r < r1; r++ {
+				copy(dst[r*cols:(r+1)*cols], src[r*rs:r*rs+cols])
+			}
+			return
+		}
+		for rb := r0; rb < r1; rb += stageBlock {
+			re := min(rb+stageBlock, r1)
+			for cb := 0; cb < cols; cb += stageBlock {
+				ce := min(cb+stageBlock, cols)
+				for r := rb; r < re; r++ {
+					row, base := dst[r*cols:(r+1)*cols], r*rs
+					for c := cb; c < ce; c++ {
+						row[c] = src[base+c*cs]
+					}
+				}
+			}
+		}
+	})
+}
+
+// scatterStrided unpacks the row-major rows x cols matrix src into dst,
+// where it is stored with element strides rs and cs.
+func scatterStrided(dst []float32, rows, cols, rs, cs int, src []float32) {
+	forRowRanges(rows, cols, func(r0, r1 int) {
+		if cs == 1 {
+			for r := r0; r < r1; r++ {
+				copy(dst[r*rs:r*rs+cols], src[r*cols:(r+1)*cols])
+			}
+			return
+		}
+		for rb := r0; rb < r1; rb += stageBlock {
+			re := min(rb+stageBlock, r1)
+			for cb := 0; cb < cols; cb += stageBlock {
+				ce := min(cb+stageBlock, cols)
+				for r := rb; r < re; r++ {
+					row, base := src[r*cols:(r+1)*cols], r*rs
+					for c := cb; c < ce; c++ {
+						dst[base+c*cs] = row[c]
+					}
+				}
+			}
+		}
+	})
+}
+
+// forRowRanges calls fn over disjoint row ranges [r0, r1) covering a
+// rows x cols matrix: once for small matrices and concurrently, one range
+// per CPU, for matrices of at least parallelStageElems elements.
+func forRowRanges(rows, cols int, fn func(r0, r1 int)) {
+	workers := min(runtime.GOMAXPROCS(0), rows)
+	if rows*cols < parallelStageElems || workers < 2 {
+		fn(0, rows)
+		return
+	}
+	chunk := (rows + workers - 1) / workers
+	var wg sync.WaitGroup
+	for r0 := 0; r0 < rows; r0 += chunk {
+		wg.Add(1)
+		go func(r0, r1 int) {
+			defer wg.Done()
+			fn(r0, r1)
+		}(r0, min(r0+chunk, rows))
+	}
+	wg.Wait()
+}
+
+// forEachRowMajor calls fn for every element of d in logical row-major
+// order, with pos the element's row-major position and idx its index in
+// the backing slice. It is the slow path for layouts strided2D cannot
+// describe, chiefly masked tensors.
+//
+// The tensor's flat iterator already visits elements in logical order, so
+// pos is simply a running count. Its Coord method reports the coordinate
+// of the element after idx, and its Done method turns true while the last
+// element is still pending, so neither is used here; iteration ends when
+// Next returns a NoOpError.
+func forEachRowMajor(d *tensor.Dense, fn func(pos, idx int)) error {
+	size := d.Shape().TotalSize()
+	it := d.Iterator()
+	pos := 0
+	idx, err := it.Next()
+	for ; err == nil; idx, err = it.Next() {
+		if pos >= size {
+			return fmt.Errorf("iterator visited more than %d elements", size)
+		}
+		fn(pos, idx)
+		pos++
+	}
+	if _, ok := err.(tensor.NoOpError); !ok {
+		return fmt.Errorf("iterator error: %w", err)
+	}
+	if pos != size {
+		return fmt.Errorf("iterator visited %d of %d elements", pos, size)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package mps
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// Test stride classification against views produced by the tensor
+// package itself.
+func TestClassify2D(t *testing.T) {
+	r := rand.New(rand.NewSource(51))
+	view := func(d *tensor.Dense, slices ...tensor.Slice) *tensor.Dense {
+		v, err := d.Slice(slices...)
+		if err != nil {
+			t.Fatalf("Slice error: %v", err)
+		}
+		return v.(*tensor.Dense)
+	}
+	transpose := func(d *tensor.Dense) *tensor.Dense {
+		if err := d.T(); err != nil {
+			t.Fatalf("T error: %v", err)
+		}
+		return d
+	}
+
+	cases := []struct {
+		name string
+		d    *tensor.Dense
+		want matLayout
+	}{
+		{"row-major", newRandomFloat32Matrix(t, 3, 4, r), layoutRowMajor},
+		{"row range", view(newRandomFloat32Matrix(t, 5, 4, r), tensor.S(1, 3), nil), layoutRowMajor},
+		{"row vector", newRandomFloat32Matrix(t, 1, 4, r), layoutRowMajor},
+		{"T", transpose(newRandomFloat32Matrix(t, 4, 3, r)), layoutTransposed},
+		{"T of row range", transpose(view(newRandomFloat32Matrix(t, 6, 3, r), tensor.S(2, 6), nil)), layoutTransposed},
+		{"T of column vector", transpose(newRandomFloat32Matrix(t, 4, 1, r)), layoutRowMajor},
+		{"column range", view(newRandomFloat32Matrix(t, 3, 5, r), nil, tensor.S(1, 4)), layoutStrided},
+		{"interior", slicedView(t, 3, 4, r), layoutStrided},
+		{"row range of T", view(transpose(newRandomFloat32Matrix(t, 4, 3, r)), tensor.S(0, 2), nil), layoutStrided},
+		{"masked", tensor.New(tensor.WithShape(2, 2), tensor.WithBacking([]float32{1, 2, 3, 4}), tensor.WithMask([]bool{false, true, false, false})), layoutStrided},
+		{"float64", tensor.New(tensor.WithShape(2, 2), tensor.Of(tensor.Float64)), layoutStrided},
+		{"rank 3", tensor.New(tensor.WithShape(2, 2, 2), tensor.Of(tensor.Float32)), layoutStrided},
+	}
+	for _, tc := range cases {
+		if got := classify2D(tc.d); got != tc.want {
+			t.Errorf("%s: shape %v strides %v classified %v, want %v", tc.name, tc.d.Shape(), tc.d.Strides(), got, tc.want)
+		}
+	}
+}
+
+// Test that MatMul reads transposed operands in place instead of packing
+// them.
+func TestMatMulTransposedOperandsNotPacked(t *testing.T) {
+	r := rand.New(rand.NewSource(52))
+	a, b := transposedView(t, 5, 3, r), transposedView(t, 3, 4, r)
+	c := newZeroFloat32Matrix(5, 4)
+
+	e := newRefEngine(t)
+	if err := e.MatMul(a, b, c); err != nil {
+		t.Fatalf("MatMul error: %v", err)
+	}
+	if got, want := extractFloat32Backing(t, c), stdMatMul(t, a, b); !equalApprox(got, want, 1e-5) {
+		t.Fatalf("result differs from StdEng\n got:  %v\n want: %v", got, want)
+	}
+	st := e.Stats()
+	if st.Ops[OpMatMul].Accelerated != 1 {
+		t.Fatalf("MatMul not accelerated: %+v", st.Ops[OpMatMul])
+	}
+	if st.Pool.Hits+st.Pool.Misses != 0 {
+		t.Fatalf("transposed operands were packed: %+v", st.Pool)
+	}
+}
+
+// stagingLayouts returns views of every layout the tensor package can
+// produce for a rows x cols float32 matrix or an n-element vector: plain,
+// transposed, offset, stepped and column slices, and combinations.
+func stagingLayouts(t *testing.T, rows, cols int) map[string]*tensor.Dense {
+	t.Helper()
+	r := rand.New(rand.NewSource(int64(53 + rows*31 + cols)))
+	view := func(d *tensor.Dense, slices ...tensor.Slice) *tensor.Dense {
+		v, err := d.Slice(slices...)
+		if err != nil {
+			t.Fatalf("Slice(%v) of %v error: %v", slices, d.Shape(), err)
+		}
+		return v.(*tensor.Dense)
+	}
+	transpose := func(d *tensor.Dense) *tensor.Dense {
+		if err := d.T(); err != nil {
+			t.Fatalf("T error: %v", err)
+		}
+		return d
+	}
+	m := func(rows, cols int) *tensor.Dense { return newRandomFloat32Matrix(t, rows, cols, r) }
+
+	views := map[string]*tensor.Dense{
+		"row-major":       m(rows, cols),
+		"T":               transpose(m(cols, rows)),
+		"interior":        view(m(rows+2, cols+3), tensor.S(1, rows+1), tensor.S(2, cols+2)),
+		"stepped":         view(m(2*rows, 3*cols+1), tensor.S(0, 2*rows, 2), tensor.S(1, 3*cols+1, 3)),
+		"T of interior":   transpose(view(m(cols+3, rows+2), tensor.S(2, cols+2), tensor.S(1, rows+1))),
+		"interior of T":   view(transpose(m(cols+2, rows+3)), tensor.S(2, rows+2), tensor.S(1, cols+1)),
+		"T of row range":  transpose(view(m(cols+2, rows), tensor.S(1, cols+1), nil)),
+		"column of wide":  view(m(rows*cols, 3), nil, tensor.S(1)),
+		"row of tall":     view(m(3, rows*cols), tensor.S(2), nil),
+		"stepped vector":  view(tensor.New(tensor.WithShape(3*rows*cols), tensor.WithBacking(make([]float32, 3*rows*cols))), tensor.S(0, 3*rows*cols, 3)),
+		"column of T":     view(transpose(m(rows*cols, 4)), tensor.S(3), nil),
+		"contiguous flat": tensor.New(tensor.WithShape(rows*cols), tensor.WithBacking(make([]float32, rows*cols))),
+	}
+	for name, v := range views {
+		if v.IsScalar() {
+			// Single-element slices collapse to scalars, which are not
+			// staged.
+			delete(views, name)
+			continue
+		}
+		if v.Shape().TotalSize() != rows*cols {
+			t.Fatalf("%s: view has shape %v, want %d elements", name, v.Shape(), rows*cols)
+		}
+		// Give vectors built from zeroed backings distinct values too.
+		data := v.Data().([]float32)
+		for i := range data {
+			if data[i] == 0 {
+				data[i] = float32(i) + 0.5
+			}
+		}
+	}
+	return views
+}
+
+// Test strided gathers and scatters against At for every view layout over
+// a range of shapes, serially and with every matrix split across
+// goroutines.
+func TestGatherScatterLayouts(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		if parallel {
+			defer func(n int) { parallelStageElems = n }(parallelStageElems)
+			parallelStageElems = 1
+		}
+		for rows := 1; rows <= 5; rows++ {
+			for cols := 1; cols <= 6; cols++ {
+				for name, d := range stagingLayouts(t, rows, cols) {
+					data := d.Data().([]float32)
+					before := append([]float32(nil), data...)
+					if _, _, _, _, ok := strided2D(d, len(data)); !ok {
+						t.Fatalf("%s %dx%d: shape %v strides %v not handled by strides", name, rows, cols, d.Shape(), d.Strides())
+					}
+
+					want := denseValues(t, d)
+					got := make([]float32, len(want))
+					if err := gatherF32(got, d, data); err != nil {
+						t.Fatalf("%s %dx%d: gather error: %v", name, rows, cols, err)
+					}
+					if !equalApprox(got, want, 0) {
+						t.Fatalf("%s %dx%d (parallel %v): gathered %v, want %v", name, rows, cols, parallel, got, want)
+					}
+
+					src := make([]float32, len(want))
+					for i := range src {
+						src[i] = -float32(i) - 1
+					}
+					if err := scatterF32(src, d, data); err != nil {
+						t.Fatalf("%s %dx%d: scatter error: %v", name, rows, cols, err)
+					}
+					if got := denseValues(t, d); !equalApprox(got, src, 0) {
+						t.Fatalf("%s %dx%d (parallel %v): scattered %v, want %v", name, rows, cols, parallel, got, src)
+					}
+					// Elements outside the view are left alone.
+					for i, v := range data {
+						if v >= 0 && v != before[i] {
+							t.Fatalf("%s %dx%d: scatter changed element %d outside the view", name, rows, cols, i)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// Test that masked tensors still go through the iterator and stage
+// correctly.
+func TestGatherScatterMasked(t *testing.T) {
+	d := tensor.New(tensor.WithShape(2, 3), tensor.WithBacking([]float32{1, 2, 3, 4, 5, 6}), tensor.WithMask([]bool{false, true, false, false, false, true}))
+	data := d.Data().([]float32)
+	if _, _, _, _, ok := strided2D(d, len(data)); ok {
+		t.Fatalf("masked tensor described by strides")
+	}
+	got := make([]float32, 6)
+	if err := gatherF32(got, d, data); err != nil {
+		t.Fatalf("gather error: %v", err)
+	}
+	if want := []float32{1, 2, 3, 4, 5, 6}; !equalApprox(got, want, 0) {
+		t.Fatalf("gathered %v, want %v", got, want)
+	}
+	if err := scatterF32([]float32{6, 5, 4, 3, 2, 1}, d, data); err != nil {
+		t.Fatalf("scatter error: %v", err)
+	}
+	if want := []float32{6, 5, 4, 3, 2, 1}; !equalApprox(data, want, 0) {
+		t.Fatalf("scattered %v, want %v", data, want)
+	}
+}
+
+// BenchmarkGatherTransposed packs a transposed view, as MatMul does for
+// transposed outputs and Gemm inputs, with the strided gather and with
+// the tensor iterator it replaces.
+func BenchmarkGatherTransposed(b *testing.B) {
+	for _, n := range []int{512, 4096} {
+		d := randomDenseF32(rand.New(rand.NewSource(54)), n, n)
+		if err := d.T(); err != nil {
+			b.Fatal(err)
+		}
+		data := d.Data().([]float32)
+		dst := make([]float32, n*n)
+		for _, bc := range []struct {
+			name   string
+			gather func() error
+		}{
+			{"strided", func() error { return gatherF32(dst, d, data) }},
+			{"iterator", func() error { return forEachRowMajor(d, func(pos, idx int) { dst[pos] = data[idx] }) }},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", bc.name, n), func(b *testing.B) {
+				b.SetBytes(int64(4 * n * n))
+				for i := 0; i < b.N; i++ {
+					if err := bc.gather(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
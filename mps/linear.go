@@ -0,0 +1,173 @@
+// linear.go
+//
+// Linear: the fully connected layer y = act(x x w + bias) as one device
+// submission, a MatMul whose epilogue adds the bias and applies the
+// activation before the result leaves the GPU. The epilogue's Go
+// implementation is the reference for the device kernels and computes
+// the fallback.
+
+package mps
+
+import (
+	"fmt"
+	"math"
+
+	"gorgonia.org/tensor"
+)
+
+// Activation is an elementwise function applied by Linear after the bias
+// add.
+type Activation int
+
+const (
+	// ActNone applies no activation.
+	ActNone Activation = iota
+	// ActReLU is max(x, 0).
+	ActReLU
+	// ActGELU is the exact Gaussian error linear unit,
+	// 0.5 * x * (1 + erf(x / sqrt(2))).
+	ActGELU
+
+	numActivations
+)
+
+var activationNames = [numActivations]string{
+	ActNone: "none",
+	ActReLU: "ReLU",
+	ActGELU: "GELU",
+}
+
+func (a Activation) valid() bool { return a >= 0 && a < numActivations }
+
+func (a Activation) String() string {
+	if !a.valid() {
+		return fmt.Sprintf("Activation(%d)", int(a))
+	}
+	return activationNames[a]
+}
+
+// Linear computes prealloc = act(x x w + bias) for 2D x (M x K), w
+// (K x N) and prealloc (M x N). bias holds one value per output column,
+// with shape [N] or [1, N], and is added to every row; it may be nil.
+//
+// float32 Dense operands of any layout run on the GPU, with the bias add
+// and activation fused into the MatMul's submission instead of two more
+// passes over the result. Like MatMul, everything else falls back to the
+// fallback engine's MatMul, followed by the same epilogue on the CPU, and
+// records the reason in Stats (OpLinear).
+func (e *MPSEng) Linear(x, w, bias tensor.Tensor, act Activation, prealloc tensor.Tensor) error {
+	if err := e.checkOpen(); err != nil {
+		return err
+	}
+
+	p, reason, err := e.planLinear(x, w, bias, act, prealloc)
+	if err != nil {
+		return err
+	}
+	if reason != ReasonNone {
+		return e.fallbackLinear(reason, x, w, bias, act, prealloc)
+	}
+	if reason := e.execLinear(p); reason != ReasonNone {
+		return e.fallbackLinear(reason, x, w, bias, act, prealloc)
+	}
+
+	e.stats.recordAccelerated(OpLinear)
+	return nil
+}
+
+// execLinear stages the bias of a planned Linear and runs its MatMul with
+// the epilogue on the engine's backend. The bias is always copied, so
+// that it may share memory with the output.
+func (e *MPSEng) execLinear(p linearPlan) FallbackReason {
+	mm := p.mm
+	if p.bias != nil {
+		buf := e.pool.get(mm.n)
+		defer e.pool.put(buf)
+		if err := gatherF32(buf, p.bias, p.bias.Data().([]float32)); err != nil {
+			return ReasonLayout
+		}
+		mm.bias = buf
+	}
+	return e.execMatMul(mm)
+}
+
+// linearEpilogue adds bias to every row of the row-major contiguous
+// matrix c and applies act, for float32 and float64. bias may be nil.
+func linearEpilogue(c, bias *tensor.Dense, act Activation) error {
+	if bias != nil && bias.Dtype() != c.Dtype() {
+		return fmt.Errorf("mps: Linear bias dtype %v does not match output dtype %v", bias.Dtype(), c.Dtype())
+	}
+	rows, cols := c.Shape()[0], c.Shape()[1]
+
+	switch cd := c.Data().(type) {
+	case []float32:
+		var b []float32
+		if bias != nil {
+			b = make([]float32, cols)
+			if err := gatherF32(b, bias, bias.Data().([]float32)); err != nil {
+				return fmt.Errorf("mps: Linear reading bias: %w", err)
+			}
+		}
+		for r := 0; r < rows; r++ {
+			epilogueRowF32(cd[r*cols:(r+1)*cols], b, act)
+		}
+	case []float64:
+		var b []float64
+		if bias != nil {
+			b = make([]float64, cols)
+			bd := bias.Data().([]float64)
+			if err := forEachRowMajor(bias, func(pos, idx int) { b[pos] = bd[idx] }); err != nil {
+				return fmt.Errorf("mps: Linear reading bias: %w", err)
+			}
+		}
+		for r := 0; r < rows; r++ {
+			epilogueRowF64(cd[r*cols:(r+1)*cols], b, act)
+		}
+	default:
+		return fmt.Errorf("mps: Linear does not support dtype %v", c.Dtype())
+	}
+	return nil
+}
+
+// epilogueRowF32 sets row[j] = act(row[j] + bias[j]); bias may be nil.
+// The reference backend applies it to every row of a product, so the
+// fallback and the reference device agree bit for bit.
+func epilogueRowF32(row, bias []float32, act Activation) {
+	for j, v := range row {
+		if bias != nil {
+			v += bias[j]
+		}
+		switch act {
+		case ActReLU:
+			if v < 0 {
+				v = 0
+			}
+		case ActGELU:
+			v = float32(gelu(float64(v)))
+		}
+		row[j] = v
+	}
+}
+
+// epilogueRowF64 is epilogueRowF32 for float64.
+func epilogueRowF64(row, bias []float64, act Activation) {
+	for j, v := range row {
+		if bias != nil {
+			v += bias[j]
+		}
+		switch act {
+		case ActReLU:
+			if v < 0 {
+				v = 0
+			}
+		case ActGELU:
+			v = gelu(v)
+		}
+		row[j] = v
+	}
+}
+
+// gelu is the exact GELU, computed in float64.
+func gelu(x float64) float64 {
+	return 0.5 * x * (1 + math.Erf(x/math.Sqrt2))
+}
@@ -0,0 +1,198 @@
+package mps
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// linearWant computes act(x x w + bias) the unfused way: a StdEng MatMul,
+// a StdEng Add of the bias repeated over the rows, then the activation.
+// bias may be nil.
+func linearWant(t *testing.T, x, w, bias *tensor.Dense, act Activation) []float32 {
+	t.Helper()
+	m, n := x.Shape()[0], w.Shape()[1]
+	out := tensor.New(tensor.WithShape(m, n), tensor.WithBacking(stdMatMul(t, x, w)))
+	if bias != nil {
+		bv := denseValues(t, bias)
+		rep := make([]float32, 0, m*n)
+		for i := 0; i < m; i++ {
+			rep = append(rep, bv...)
+		}
+		var std tensor.StdEng
+		if _, err := std.Add(out, tensor.New(tensor.WithShape(m, n), tensor.WithBacking(rep)), tensor.UseUnsafe()); err != nil {
+			t.Fatalf("StdEng.Add error: %v", err)
+		}
+	}
+	vals := out.Data().([]float32)
+	for i, v := range vals {
+		switch act {
+		case ActReLU:
+			vals[i] = float32(math.Max(float64(v), 0))
+		case ActGELU:
+			x := float64(v)
+			vals[i] = float32(x * 0.5 * (1 + math.Erf(x/math.Sqrt2)))
+		}
+	}
+	return vals
+}
+
+// Test Linear against the unfused reference for every activation, bias
+// shape and operand layout, on the device (whole and tiled) and through
+// the fallback.
+func TestLinearParity(t *testing.T) {
+	r := rand.New(rand.NewSource(91))
+	const m, k, n = 5, 7, 4
+
+	xs := map[string]func() *tensor.Dense{
+		"row-major":  func() *tensor.Dense { return newRandomFloat32Matrix(t, m, k, r) },
+		"transposed": func() *tensor.Dense { return transposedView(t, m, k, r) },
+		"sliced":     func() *tensor.Dense { return slicedView(t, m, k, r) },
+	}
+	biases := map[string]func() *tensor.Dense{
+		"none":    func() *tensor.Dense { return nil },
+		"vector":  func() *tensor.Dense { return randomF32(r, n) },
+		"row":     func() *tensor.Dense { return randomF32(r, 1, n) },
+		"strided": func() *tensor.Dense { return columnView(t, n, r) },
+	}
+	outs := map[string]func() *tensor.Dense{
+		"row-major": func() *tensor.Dense { return newZeroFloat32Matrix(m, n) },
+		"sliced":    func() *tensor.Dense { return slicedView(t, m, n, r) },
+	}
+	engines := []struct {
+		name   string
+		opts   []Option
+		reason FallbackReason
+	}{
+		{"device", []Option{withBackend(newRefBackend())}, ReasonNone},
+		{"tiled", []Option{withBackend(newRefBackend()), WithMaxBufferBytes(12 * 4)}, ReasonNone},
+		{"disabled", []Option{WithOpEnabled(OpLinear, false)}, ReasonDisabled},
+		{"device error", []Option{withBackend(newFailingBackend(fault{status: 1, corrupt: true}))}, ReasonDeviceError},
+	}
+
+	for _, eng := range engines {
+		e := NewMPSEng(append([]Option{WithMinFLOPs(0)}, eng.opts...)...)
+		var calls uint64
+		for act := ActNone; act < numActivations; act++ {
+			for xn, newX := range xs {
+				for bn, newBias := range biases {
+					for on, newOut := range outs {
+						x, w, bias, out := newX(), transposedView(t, k, n, r), newBias(), newOut()
+						var bt tensor.Tensor
+						if bias != nil {
+							bt = bias
+						}
+						if err := e.Linear(x, w, bt, act, out); err != nil {
+							t.Fatalf("%s/%v/%s/%s/%s: Linear error: %v", eng.name, act, xn, bn, on, err)
+						}
+						calls++
+						if got, want := denseValues(t, out), linearWant(t, x, w, bias, act); !equalApprox(got, want, 1e-5) {
+							t.Fatalf("%s/%v/%s/%s/%s: result differs from MatMul+Add+%v\n got:  %v\n want: %v", eng.name, act, xn, bn, on, act, got, want)
+						}
+					}
+				}
+			}
+		}
+
+		st := e.Stats()
+		if eng.reason == ReasonNone {
+			if st.Ops[OpLinear].Accelerated != calls {
+				t.Fatalf("%s: %d of %d Linears accelerated: %+v", eng.name, st.Ops[OpLinear].Accelerated, calls, st.Ops[OpLinear])
+			}
+		} else if st.Ops[OpLinear].Fallbacks[eng.reason] != calls {
+			t.Fatalf("%s: expected %d %v fallbacks: %+v", eng.name, calls, eng.reason, st.Ops[OpLinear])
+		}
+		if st.Ops[OpMatMul].Accelerated != 0 || st.Pool.BytesInUse != 0 {
+			t.Fatalf("%s: unexpected stats %+v", eng.name, st)
+		}
+		e.Close()
+	}
+}
+
+// Test that the fallback, and the reference device on the same product,
+// match the unfused StdEng ops bit for bit.
+func TestLinearBitExact(t *testing.T) {
+	r := rand.New(rand.NewSource(92))
+	x, w := newRandomFloat32Matrix(t, 6, 3, r), newRandomFloat32Matrix(t, 3, 8, r)
+	bias := randomF32(r, 8)
+
+	for act := ActNone; act < numActivations; act++ {
+		want := linearWant(t, x, w, bias, act)
+
+		e := NewMPSEng(WithOpEnabled(OpLinear, false))
+		out := newZeroFloat32Matrix(6, 8)
+		if err := e.Linear(x, w, bias, act, out); err != nil {
+			t.Fatalf("%v: Linear error: %v", act, err)
+		}
+		if got := extractFloat32Backing(t, out); !equalApprox(got, want, 0) {
+			t.Fatalf("%v: fallback differs from MatMul+Add+%v\n got:  %v\n want: %v", act, act, got, want)
+		}
+		e.Close()
+
+		// The reference backend's product may round differently from
+		// StdEng's, so compare its epilogue on its own product.
+		be := newRefBackend()
+		prod := make([]float32, 6*8)
+		be.matMulF32(gemmArgs{a: extractFloat32Backing(t, x), b: extractFloat32Backing(t, w), c: prod, m: 6, n: 8, k: 3, alpha: 1})
+		fused := make([]float32, 6*8)
+		be.matMulF32(gemmArgs{a: extractFloat32Backing(t, x), b: extractFloat32Backing(t, w), c: fused, m: 6, n: 8, k: 3, alpha: 1, bias: extractFloat32Backing(t, bias), act: act})
+		unfused := tensor.New(tensor.WithShape(6, 8), tensor.WithBacking(prod))
+		if err := linearEpilogue(unfused, bias, act); err != nil {
+			t.Fatalf("%v: linearEpilogue error: %v", act, err)
+		}
+		if !equalApprox(fused, prod, 0) {
+			t.Fatalf("%v: fused epilogue differs from linearEpilogue\n got:  %v\n want: %v", act, fused, prod)
+		}
+	}
+}
+
+func TestLinearFloat64Fallback(t *testing.T) {
+	x := tensor.New(tensor.WithShape(2, 3), tensor.WithBacking([]float64{1, -2, 3, -4, 5, -6}))
+	w := tensor.New(tensor.WithShape(3, 2), tensor.WithBacking([]float64{1, 0, 0, 1, 1, 1}))
+	bias := tensor.New(tensor.WithShape(2), tensor.WithBacking([]float64{0.5, -10}))
+	out := tensor.New(tensor.WithShape(2, 2), tensor.Of(tensor.Float64))
+
+	e := newRefEngine(t)
+	if err := e.Linear(x, w, bias, ActReLU, out); err != nil {
+		t.Fatalf("Linear error: %v", err)
+	}
+	// x x w = [[4, 1], [-10, -1]]
+	want := []float64{4.5, 0, 0, 0}
+	for i, v := range out.Data().([]float64) {
+		if v != want[i] {
+			t.Fatalf("got %v, want %v", out.Data(), want)
+		}
+	}
+	if st := e.Stats().Ops[OpLinear]; st.Fallbacks[ReasonDtype] != 1 {
+		t.Fatalf("expected a dtype fallback: %+v", st)
+	}
+}
+
+func TestLinearErrors(t *testing.T) {
+	e := newRefEngine(t, WithStrict(true))
+	f32 := func(shape ...int) *tensor.Dense {
+		return tensor.New(tensor.WithShape(shape...), tensor.Of(tensor.Float32))
+	}
+	if err := e.Linear(f32(3, 4), f32(4, 2), f32(3), ActNone, f32(3, 2)); err == nil {
+		t.Fatalf("Linear accepted a bias of the wrong length")
+	}
+	if err := e.Linear(f32(3, 4), f32(4, 2), f32(2, 1), ActNone, f32(3, 2)); err == nil {
+		t.Fatalf("Linear accepted a column bias")
+	}
+	if err := e.Linear(f32(3, 4), f32(4, 2), nil, Activation(42), f32(3, 2)); err == nil {
+		t.Fatalf("Linear accepted an unknown activation")
+	}
+	if err := e.Linear(f32(3, 4), f32(5, 2), nil, ActNone, f32(3, 2)); err == nil {
+		t.Fatalf("Linear accepted mismatched shapes")
+	}
+
+	f64 := tensor.New(tensor.WithShape(2), tensor.Of(tensor.Float64))
+	err := e.Linear(f32(2, 2), f32(2, 2), f64, ActGELU, f32(2, 2))
+	var fe *FallbackError
+	if !errors.As(err, &fe) || fe.Op != OpLinear || fe.Reason != ReasonDtype || len(fe.Shapes) != 4 {
+		t.Fatalf("expected dtype FallbackError over 4 operands, got %v", err)
+	}
+}
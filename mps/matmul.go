@@ -1,14 +1,164 @@
-//go:build !darwin || !cgo
+// matmul.go
+//
+// Platform-independent MatMul for MPSEng: planning, staging through
+// row-major buffers, the backend call and fallback all happen here.
 
-// mps_matmul.go (CPU fallback)
 package mps
 
 import "gorgonia.org/tensor"
 
-// MatMul is a thin wrapper around the CPU StdEng.MatMul implementation.
+// MatMul offloads 2D float32 matrix multiplication to Metal Performance
+// Shaders when possible. Any 2D float32 layout is supported: row-major
+// and transposed (T()) operands are read in place, and other layouts are
+// staged through temporary buffers. prealloc may share memory with a or
+// b; the product is then staged through a temporary.
+// For non-dense tensors, non-float32 dtypes, problems the engine's
+// dispatch policy rejects, or any MPS failure it transparently falls
+// back to the configured fallback engine (StdEng by default), recording
+// the reason in Stats. In strict mode those cases return a
+// *FallbackError instead. Products with a zero-sized dimension are
+// computed on the CPU (ReasonEmpty), and operands that are not 2D or
+// whose shapes disagree are reported as errors, never panics.
 //
-// This is the method you’ll replace with your MPS-backed matmul once the
-// wiring is verified and you have your Metal/MPS plumbing in place.
+// The product follows the engine's precision policy (see WithPrecision
+// and MatMulPrecision).
 func (e *MPSEng) MatMul(a, b, prealloc tensor.Tensor) error {
-	return e.StdEng.MatMul(a, b, prealloc)
+	return e.matMul(a, b, e.cfg.precision, prealloc)
+}
+
+// matMul is MatMul with the precision policy prec.
+func (e *MPSEng) matMul(a, b tensor.Tensor, prec Precision, prealloc tensor.Tensor) error {
+	if err := e.checkOpen(); err != nil {
+		return err
+	}
+
+	p, reason, err := e.planMatMul(a, b, prealloc)
+	if err != nil {
+		return err
+	}
+	if reason != ReasonNone {
+		return e.fallbackMatMul(reason, prec, a, b, prealloc)
+	}
+	p.prec = prec
+	if reason := e.execMatMul(p); reason != ReasonNone {
+		return e.fallbackMatMul(reason, prec, a, b, prealloc)
+	}
+
+	e.stats.recordAccelerated(OpMatMul)
+	return nil
+}
+
+// execMatMul runs a planned 2D float32 MatMul on the engine's backend,
+// or with sgemm if the plan is marked cpu. Row-major and transposed
+// operands are handed to the backend directly (see stageOperand); other
+// layouts (sliced views, ...) are materialized into temporary row-major
+// buffers before the device call and the output is scattered back
+// afterwards. It returns ReasonNone on success and the reason to fall
+// back otherwise.
+func (e *MPSEng) execMatMul(p matMulPlan) FallbackReason {
+	da, db, dc := p.a, p.b, p.c
+	m, n, k := p.m, p.n, p.k
+
+	abuf, transA, pooledA, err := e.stageOperand(da)
+	if err != nil {
+		return ReasonLayout
+	}
+	if pooledA {
+		defer e.pool.put(abuf)
+	}
+	bbuf, transB, pooledB, err := e.stageOperand(db)
+	if err != nil {
+		return ReasonLayout
+	}
+	if pooledB {
+		defer e.pool.put(bbuf)
+	}
+
+	// Decide how to handle the output: if the prealloc tensor is already
+	// row‑major contiguous with a simple backing slice, let the backend
+	// write into it directly. Otherwise, write into a temporary row‑major
+	// buffer and scatter back into the tensor afterwards.
+	//
+	// When the old contents of C are blended in (beta != 0) they are
+	// always staged, so that C is left intact for the fallback if the
+	// device call fails. So is a C that shares memory with A or B, which
+	// the backend may still be reading while it writes C.
+	var (
+		cbuf      []float32
+		useDirect bool
+	)
+
+	cdata, ok := dc.Data().([]float32)
+	if ok && p.beta == 0 && !dc.RequiresIterator() && isRowMajorContiguous2D(dc) && len(cdata) >= m*n &&
+		!sharesMemory(dc, da) && !sharesMemory(dc, db) {
+		cbuf = cdata[:m*n]
+		useDirect = true
+	} else {
+		cbuf = e.pool.get(m * n)
+		defer e.pool.put(cbuf)
+		useDirect = false
+		if p.beta != 0 {
+			if err := packRowMajor2DF32(cbuf, dc); err != nil {
+				return ReasonLayout
+			}
+		}
+	}
+
+	g := gemmArgs{
+		a: abuf, b: bbuf, c: cbuf,
+		m: m, n: n, k: k,
+		transA: transA, transB: transB,
+		alpha: p.alpha, beta: p.beta,
+		bias: p.bias, act: p.act,
+		prec: p.prec,
+	}
+	run := func(g gemmArgs) FallbackReason {
+		if p.cpu {
+			sgemm(g)
+			return ReasonNone
+		}
+		// On any device error, let the caller fall back to the CPU
+		// implementation so that it still gets correct results if
+		// something goes wrong in the GPU path.
+		return e.runBackend(func(be backend) int { return e.matMulTiled(be, g) })
+	}
+	var reason FallbackReason
+	if p.prec == PrecisionCompensated {
+		reason = e.compensatedGemm(g, run)
+	} else {
+		reason = run(g)
+	}
+	if reason != ReasonNone {
+		return reason
+	}
+
+	// If we wrote into a temporary buffer, scatter back into the logical
+	// layout of the prealloc tensor.
+	if !useDirect {
+		if err := rowMajor2DToDenseF32(cbuf, dc); err != nil {
+			// As a safety net, fall back to CPU on any unexpected layout
+			// issue during scatter.
+			return ReasonLayout
+		}
+	}
+
+	return ReasonNone
+}
+
+// stageOperand prepares a MatMul input for the backend. Row-major
+// operands are used in place. Transposed (column-major) operands, such as
+// views created with T(), are also used in place: their backing slice is
+// the row-major transpose, which the backend reads through its transpose
+// flag, so trans is set. Any other layout is packed into a row-major
+// buffer from the engine's pool, which the caller must put back when
+// pooled is set.
+func (e *MPSEng) stageOperand(d *tensor.Dense) (buf []float32, trans, pooled bool, err error) {
+	switch classify2D(d) {
+	case layoutRowMajor:
+		return d.Data().([]float32)[:d.Shape().TotalSize()], false, false, nil
+	case layoutTransposed:
+		return d.Data().([]float32)[:d.Shape().TotalSize()], true, false, nil
+	}
+	buf, alias, err := denseToRowMajor2DF32(d, e.pool)
+	return buf, false, !alias, err
 }
@@ -77,7 +77,7 @@ func TestMPSEngMatMulSupportedMatchesStdEng(t *testing.T) {
 		t.Fatalf("StdEng.MatMul error: %v", err)
 	}
 
-	mpsEng := NewMPSEng()
+	mpsEng := NewMPSEng(WithMinFLOPs(0))
 	if err := mpsEng.MatMul(a, b, cMPS); err != nil {
 		t.Fatalf("MPSEng.MatMul error: %v", err)
 	}
@@ -211,7 +211,7 @@ func benchmarkMatMul(b *testing.B, m, k, n int, useMPS bool) {
 	// Choose engine.
 	var (
 		cpu    tensor.StdEng
-		mpsEng = NewMPSEng()
+		mpsEng = NewMPSEng(WithMinFLOPs(0))
 	)
 
 	b.ResetTimer()
@@ -5,6 +5,13 @@
 // device and command queue. Individual GPU-backed ops (matmul, sum,
 // etc.) take this context as an argument rather than creating their own
 // global state.
+//
+// Thread safety: a context may be used by several threads at once. Its
+// device, command queue and pipeline states are created once and never
+// mutated afterwards, and every op allocates its own buffers and command
+// buffer per call (MTLCommandQueue is itself thread-safe), so no locking
+// is needed. The caller must not release a context while any op using it
+// is still running.
 
 #pragma once
 
@@ -21,6 +28,16 @@ MPSEngineContext MPSEngineCreateContext(void);
 // MPSEngineReleaseContext releases a previously created context.
 void MPSEngineReleaseContext(MPSEngineContext ctx);
 
+// MPSDefaultDeviceName copies the name of the system default Metal
+// device (the device every engine context uses) into buf as a
+// NUL-terminated string of at most len bytes. Returns 0 on success and
+// non-zero if no device is available.
+int MPSDefaultDeviceName(char *buf, int len);
+
+// MPSEngineMaxBufferLength returns the largest buffer, in bytes, that
+// the context's device can allocate, or 0 if ctx is NULL.
+long long MPSEngineMaxBufferLength(MPSEngineContext ctx);
+
 #ifdef __cplusplus
 }
 #endif
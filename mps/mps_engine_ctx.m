@@ -1,3 +1,5 @@
+//go:build darwin && cgo
+
 // mps_engine_ctx.m
 // Objective-C implementation of the engine-level Metal/MPS context.
 
@@ -10,24 +12,79 @@
 @interface MPSEngineContextObj : NSObject
 @property(nonatomic, readonly) id<MTLDevice> device;
 @property(nonatomic, readonly) id<MTLCommandQueue> queue;
-@property(nonatomic, readonly) id<MTLComputePipelineState> rowSumPSO;
+@property(nonatomic, readonly) id<MTLComputePipelineState> rowReducePSO;
+@property(nonatomic, readonly) id<MTLComputePipelineState> axisReducePSO;
+@property(nonatomic, readonly) id<MTLComputePipelineState> rowArgReducePSO;
+@property(nonatomic, readonly) id<MTLComputePipelineState> axisArgReducePSO;
 @end
 
 @implementation MPSEngineContextObj {
-    id<MTLComputePipelineState> _rowSumPSO;
+    id<MTLComputePipelineState> _rowReducePSO;
+    id<MTLComputePipelineState> _axisReducePSO;
+    id<MTLComputePipelineState> _rowArgReducePSO;
+    id<MTLComputePipelineState> _axisArgReducePSO;
 }
 
-// Metal compute kernel source for row-wise sum. Each threadgroup
-// processes one row, with multiple threads per row accumulating partial
-// sums in threadgroup memory and then reducing to a single value.
-static NSString * const kRowSumKernelSource =
+// Metal compute kernel source for the reductions. op selects the
+// combining function, as in mps_reduce.h: 0 sum, 1 max, 2 min, 3 prod,
+// 4 and 5 max and min along the leading axis. Max and min treat NaNs as
+// StdEng does: 1 and 2 give the extreme of the elements after the last
+// NaN, or NaN if that is the last element, and 4 and 5 give NaN if the
+// first element is and skip the other NaNs.
+//
+// row_reduce reduces the rows of a matrix. Each threadgroup processes
+// one row, with multiple threads per row accumulating partial results in
+// threadgroup memory and then reducing them pairwise to a single value.
+// For max and min (1 and 2) the threads first find the row's last NaN
+// the same way, and then reduce only the elements after it; 4 and 5
+// reduce the numbers and check the first element at the end.
+//
+// axis_reduce reduces the middle axis of an outer x n x inner array.
+// Each thread produces one output element, walking its column with a
+// stride of inner, so that neighbouring threads read neighbouring
+// elements, and combining them in order from the first as StdEng does.
+//
+// row_argreduce and axis_argreduce do the same for the index of the
+// maximum (op 1) or minimum (op 2) as StdEng finds it, scanning from the
+// first element: a NaN, or an infinity of the extreme's sign, after the
+// first element ends the scan (arg_ends), and a NaN first element is
+// only displaced that way. axis_argreduce scans each column in order.
+// row_argreduce carries (value, index) pairs, where a pair displaces
+// another when its value is greater (smaller) or, with equal values,
+// when its index is lower, and NaNs displace nothing, so that the first
+// extreme value wins whatever order the threads combine in; it finds
+// the first element ending the scan the same way, and checks the first
+// element at the end. Empty partials hold the op's identity with index
+// UINT_MAX, and lose to any element.
+static NSString * const kReduceKernelSource =
 @"#include <metal_stdlib>\n"
  "using namespace metal;\n"
  "\n"
- "kernel void row_sum(\n"
+ "inline float reduce_identity(uint op) {\n"
+ "  switch (op) {\n"
+ "  case 1: case 4: return -INFINITY;\n"
+ "  case 2: case 5: return INFINITY;\n"
+ "  case 3: return 1.0f;\n"
+ "  default: return 0.0f;\n"
+ "  }\n"
+ "}\n"
+ "\n"
+ "inline float reduce_combine(uint op, float a, float b) {\n"
+ "  switch (op) {\n"
+ "  case 1: return a > b ? a : b;\n"
+ "  case 2: return a < b ? a : b;\n"
+ "  case 3: return a * b;\n"
+ "  case 4: return b > a ? b : a;\n"
+ "  case 5: return b < a ? b : a;\n"
+ "  default: return a + b;\n"
+ "  }\n"
+ "}\n"
+ "\n"
+ "kernel void row_reduce(\n"
  "    const device float *X      [[buffer(0)]],\n"
  "    device float *Y            [[buffer(1)]],\n"
  "    constant uint2 &shape      [[buffer(2)]],\n"
+ "    constant uint &op          [[buffer(3)]],\n"
  "    uint  tid                  [[thread_index_in_threadgroup]],\n"
  "    uint3 tgpig                [[threadgroup_position_in_grid]],\n"
  "    uint  tgSize               [[threads_per_threadgroup]]) {\n"
@@ -36,22 +93,136 @@ static NSString * const kRowSumKernelSource =
  "  uint row  = tgpig.x;\n"
  "  if (row >= rows) { return; }\n"
  "  threadgroup float partial[256];\n"
- "  float acc = 0.0f;\n"
+ "  threadgroup int lastNaN[256];\n"
  "  uint base = row * cols;\n"
- "  for (uint c = tid; c < cols; c += tgSize) {\n"
- "    acc += X[base + c];\n"
+ "  uint from = 0;\n"
+ "  if (op == 1 || op == 2) {\n"
+ "    int last = -1;\n"
+ "    for (uint c = tid; c < cols; c += tgSize) {\n"
+ "      if (isnan(X[base + c])) { last = (int)c; }\n"
+ "    }\n"
+ "    lastNaN[tid] = last;\n"
+ "    threadgroup_barrier(mem_flags::mem_threadgroup);\n"
+ "    for (uint stride = 1; stride < tgSize; stride <<= 1) {\n"
+ "      if (tid % (2 * stride) == 0 && tid + stride < tgSize) {\n"
+ "        lastNaN[tid] = max(lastNaN[tid], lastNaN[tid + stride]);\n"
+ "      }\n"
+ "      threadgroup_barrier(mem_flags::mem_threadgroup);\n"
+ "    }\n"
+ "    from = (uint)(lastNaN[0] + 1);\n"
+ "  }\n"
+ "  float acc = reduce_identity(op);\n"
+ "  for (uint c = from + tid; c < cols; c += tgSize) {\n"
+ "    acc = reduce_combine(op, acc, X[base + c]);\n"
  "  }\n"
  "  partial[tid] = acc;\n"
  "  threadgroup_barrier(mem_flags::mem_threadgroup);\n"
- "  for (uint stride = tgSize / 2; stride > 0; stride >>= 1) {\n"
- "    if (tid < stride && tid + stride < tgSize) {\n"
- "      partial[tid] += partial[tid + stride];\n"
+ "  for (uint stride = 1; stride < tgSize; stride <<= 1) {\n"
+ "    if (tid % (2 * stride) == 0 && tid + stride < tgSize) {\n"
+ "      partial[tid] = reduce_combine(op, partial[tid], partial[tid + stride]);\n"
  "    }\n"
  "    threadgroup_barrier(mem_flags::mem_threadgroup);\n"
  "  }\n"
  "  if (tid == 0) {\n"
- "    Y[row] = partial[0];\n"
+ "    bool nanRow = (from > 0 && from == cols) || (op >= 4 && isnan(X[base]));\n"
+ "    Y[row] = nanRow ? NAN : partial[0];\n"
+ "  }\n"
+ "}\n"
+ "\n"
+ "kernel void axis_reduce(\n"
+ "    const device float *X        [[buffer(0)]],\n"
+ "    device float *Y              [[buffer(1)]],\n"
+ "    constant packed_uint3 &shape [[buffer(2)]],\n"
+ "    constant uint &op            [[buffer(3)]],\n"
+ "    uint gid                     [[thread_position_in_grid]]) {\n"
+ "  uint n     = shape[1];\n"
+ "  uint inner = shape[2];\n"
+ "  if (gid >= shape[0] * inner) { return; }\n"
+ "  const device float *x = X + (gid / inner) * n * inner + gid % inner;\n"
+ "  float acc = n > 0 ? x[0] : reduce_identity(op);\n"
+ "  for (uint j = 1; j < n; j++) {\n"
+ "    acc = reduce_combine(op, acc, x[j * inner]);\n"
  "  }\n"
+ "  Y[gid] = acc;\n"
+ "}\n"
+ "\n"
+ "inline bool arg_better(uint op, float v, uint i, float best, uint bi) {\n"
+ "  if (isnan(v)) { return false; }\n"
+ "  if (v == best) { return i < bi; }\n"
+ "  return op == 2 ? v < best : v > best;\n"
+ "}\n"
+ "\n"
+ "inline bool arg_ends(uint op, float v) {\n"
+ "  return isnan(v) || v == (op == 2 ? -INFINITY : INFINITY);\n"
+ "}\n"
+ "\n"
+ "kernel void row_argreduce(\n"
+ "    const device float *X      [[buffer(0)]],\n"
+ "    device int *I              [[buffer(1)]],\n"
+ "    constant uint2 &shape      [[buffer(2)]],\n"
+ "    constant uint &op          [[buffer(3)]],\n"
+ "    uint  tid                  [[thread_index_in_threadgroup]],\n"
+ "    uint3 tgpig                [[threadgroup_position_in_grid]],\n"
+ "    uint  tgSize               [[threads_per_threadgroup]]) {\n"
+ "  uint rows = shape.x;\n"
+ "  uint cols = shape.y;\n"
+ "  uint row  = tgpig.x;\n"
+ "  if (row >= rows) { return; }\n"
+ "  threadgroup float value[256];\n"
+ "  threadgroup uint index[256];\n"
+ "  threadgroup uint ends[256];\n"
+ "  float best = reduce_identity(op);\n"
+ "  uint bi = 0xffffffffu;\n"
+ "  uint end = 0xffffffffu;\n"
+ "  uint base = row * cols;\n"
+ "  for (uint c = tid; c < cols; c += tgSize) {\n"
+ "    float v = X[base + c];\n"
+ "    if (c > 0 && arg_ends(op, v)) { end = min(end, c); }\n"
+ "    if (arg_better(op, v, c, best, bi)) { best = v; bi = c; }\n"
+ "  }\n"
+ "  value[tid] = best;\n"
+ "  index[tid] = bi;\n"
+ "  ends[tid] = end;\n"
+ "  threadgroup_barrier(mem_flags::mem_threadgroup);\n"
+ "  for (uint stride = 1; stride < tgSize; stride <<= 1) {\n"
+ "    if (tid % (2 * stride) == 0 && tid + stride < tgSize) {\n"
+ "      ends[tid] = min(ends[tid], ends[tid + stride]);\n"
+ "      if (arg_better(op, value[tid + stride], index[tid + stride], value[tid], index[tid])) {\n"
+ "        value[tid] = value[tid + stride];\n"
+ "        index[tid] = index[tid + stride];\n"
+ "      }\n"
+ "    }\n"
+ "    threadgroup_barrier(mem_flags::mem_threadgroup);\n"
+ "  }\n"
+ "  if (tid == 0) {\n"
+ "    uint arg = index[0];\n"
+ "    if (ends[0] != 0xffffffffu) {\n"
+ "      arg = ends[0];\n"
+ "    } else if (isnan(X[base])) {\n"
+ "      arg = 0;\n"
+ "    }\n"
+ "    I[row] = (int)arg;\n"
+ "  }\n"
+ "}\n"
+ "\n"
+ "kernel void axis_argreduce(\n"
+ "    const device float *X        [[buffer(0)]],\n"
+ "    device int *I                [[buffer(1)]],\n"
+ "    constant packed_uint3 &shape [[buffer(2)]],\n"
+ "    constant uint &op            [[buffer(3)]],\n"
+ "    uint gid                     [[thread_position_in_grid]]) {\n"
+ "  uint n     = shape[1];\n"
+ "  uint inner = shape[2];\n"
+ "  if (gid >= shape[0] * inner) { return; }\n"
+ "  const device float *x = X + (gid / inner) * n * inner + gid % inner;\n"
+ "  float best = x[0];\n"
+ "  uint bi = 0;\n"
+ "  for (uint j = 1; j < n; j++) {\n"
+ "    float v = x[j * inner];\n"
+ "    if (arg_ends(op, v)) { bi = j; break; }\n"
+ "    if (op == 2 ? v < best : v > best) { best = v; bi = j; }\n"
+ "  }\n"
+ "  I[gid] = (int)bi;\n"
  "}\n";
 
 - (instancetype)init {
@@ -66,28 +237,64 @@ static NSString * const kRowSumKernelSource =
             return nil;
         }
 
-        // Compile and cache the row_sum pipeline once per engine context.
+        // Compile and cache the reduction pipelines once per engine context.
         NSError *err = nil;
-        id<MTLLibrary> lib = [_device newLibraryWithSource:kRowSumKernelSource
+        id<MTLLibrary> lib = [_device newLibraryWithSource:kReduceKernelSource
                                                    options:nil
                                                      error:&err];
         if (!lib) {
             return nil;
         }
-        id<MTLFunction> fn = [lib newFunctionWithName:@"row_sum"];
+        id<MTLFunction> fn = [lib newFunctionWithName:@"row_reduce"];
+        if (!fn) {
+            return nil;
+        }
+        _rowReducePSO = [_device newComputePipelineStateWithFunction:fn error:&err];
+        if (!_rowReducePSO) {
+            return nil;
+        }
+        fn = [lib newFunctionWithName:@"axis_reduce"];
+        if (!fn) {
+            return nil;
+        }
+        _axisReducePSO = [_device newComputePipelineStateWithFunction:fn error:&err];
+        if (!_axisReducePSO) {
+            return nil;
+        }
+        fn = [lib newFunctionWithName:@"row_argreduce"];
+        if (!fn) {
+            return nil;
+        }
+        _rowArgReducePSO = [_device newComputePipelineStateWithFunction:fn error:&err];
+        if (!_rowArgReducePSO) {
+            return nil;
+        }
+        fn = [lib newFunctionWithName:@"axis_argreduce"];
         if (!fn) {
             return nil;
         }
-        _rowSumPSO = [_device newComputePipelineStateWithFunction:fn error:&err];
-        if (!_rowSumPSO) {
+        _axisArgReducePSO = [_device newComputePipelineStateWithFunction:fn error:&err];
+        if (!_axisArgReducePSO) {
             return nil;
         }
     }
     return self;
 }
 
-- (id<MTLComputePipelineState>)rowSumPSO {
-    return _rowSumPSO;
+- (id<MTLComputePipelineState>)rowReducePSO {
+    return _rowReducePSO;
+}
+
+- (id<MTLComputePipelineState>)axisReducePSO {
+    return _axisReducePSO;
+}
+
+- (id<MTLComputePipelineState>)rowArgReducePSO {
+    return _rowArgReducePSO;
+}
+
+- (id<MTLComputePipelineState>)axisArgReducePSO {
+    return _axisArgReducePSO;
 }
 
 @end
@@ -112,4 +319,28 @@ void MPSEngineReleaseContext(MPSEngineContext ctx) {
     }
 }
 
+int MPSDefaultDeviceName(char *buf, int len) {
+    @autoreleasepool {
+        if (buf == NULL || len <= 0) {
+            return -2;
+        }
+        id<MTLDevice> device = MTLCreateSystemDefaultDevice();
+        if (device == nil) {
+            return -1;
+        }
+        const char *name = [[device name] UTF8String];
+        if (name == NULL) {
+            return -1;
+        }
+        strlcpy(buf, name, (size_t)len);
+        return 0;
+    }
+}
 
+long long MPSEngineMaxBufferLength(MPSEngineContext ctx) {
+    if (!ctx) {
+        return 0;
+    }
+    MPSEngineContextObj *obj = (__bridge MPSEngineContextObj *)ctx;
+    return (long long)obj.device.maxBufferLength;
+}
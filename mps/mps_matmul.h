@@ -11,13 +11,33 @@
 extern "C" {
 #endif
 
-// mpsMatMulFloat32 performs C = A x B using Metal Performance Shaders
-// with the given context.
+// Activations applied by mpsMatMulFloat32's epilogue; the values match
+// the Activation constants in linear.go.
+enum {
+    MPS_ACT_NONE = 0,
+    MPS_ACT_RELU = 1,
+    MPS_ACT_GELU = 2,
+};
+
+// mpsMatMulFloat32 performs C = alpha * A x B + beta * C using Metal
+// Performance Shaders with the given context. When beta is 0 the previous
+// contents of c are not read.
 //
 // A is an m x k row-major matrix, B is a k x n row-major matrix, and
 // C is an m x n row-major matrix. All matrices are stored in contiguous
 // float32 buffers.
 //
+// If transA is non-zero, a instead holds the k x m transpose of A in
+// row-major order (i.e. A column-major), and MPS reads it through its
+// transpose flag without a copy; likewise transB for b (n x k).
+//
+// If bias is not NULL, its n values are added to every row of C, and
+// activation is then applied to every element (MPS_ACT_*), in the same
+// command buffer as the product.
+//
+// If halfInputs is non-zero, A and B are rounded to float16 (to nearest,
+// ties to even) and multiplied as such, accumulating into float32 C.
+//
 // Returns 0 on success, non-zero on failure. On failure, callers should
 // fall back to a CPU implementation.
 int mpsMatMulFloat32(MPSEngineContext ctx,
@@ -26,7 +46,34 @@ int mpsMatMulFloat32(MPSEngineContext ctx,
                      float *c,
                      int m,
                      int n,
-                     int k);
+                     int k,
+                     int transA,
+                     int transB,
+                     float alpha,
+                     float beta,
+                     const float *bias,
+                     int activation,
+                     int halfInputs);
+
+// mpsBatchedMatMulFloat32 performs batch independent products
+// C[i] = alpha * A[i] x B[i] + beta * C[i] with a single batched MPS call.
+//
+// A, B and C hold batch row-major matrices of m x k, k x n and m x n
+// elements respectively, stored back to back in contiguous float32
+// buffers.
+//
+// Returns 0 on success, non-zero on failure. On failure, callers should
+// fall back to a CPU implementation.
+int mpsBatchedMatMulFloat32(MPSEngineContext ctx,
+                            const float *a,
+                            const float *b,
+                            float *c,
+                            int batch,
+                            int m,
+                            int n,
+                            int k,
+                            float alpha,
+                            float beta);
 
 #ifdef __cplusplus
 }
@@ -1,3 +1,5 @@
+//go:build darwin && cgo
+
 // mps_matmul.m
 // Minimal Objective-C helper that uses Metal Performance Shaders to
 // perform a single-precision matrix multiplication using an engine-level
@@ -17,13 +19,103 @@
 @property(nonatomic, readonly) id<MTLCommandQueue> queue;
 @end
 
+// encodeEpilogue encodes result = activation(matC + bias) on cmdBuf with
+// an MPSMatrixNeuron, bias being added to every row of matC when not
+// NULL. The result goes to a new buffer returned in out, since the
+// neuron kernel is not documented to work in place.
+static int encodeEpilogue(id<MTLDevice> device,
+                          id<MTLCommandBuffer> cmdBuf,
+                          MPSMatrix *matC,
+                          MPSMatrixDescriptor *descC,
+                          const float *bias,
+                          int activation,
+                          id<MTLBuffer> *out) {
+    MPSMatrixNeuron *neuron = [[MPSMatrixNeuron alloc] initWithDevice:device];
+    if (neuron == nil) {
+        return -8;
+    }
+    switch (activation) {
+    case MPS_ACT_NONE:
+        [neuron setNeuronType:MPSCNNNeuronTypeNone parameterA:0 parameterB:0 parameterC:0];
+        break;
+    case MPS_ACT_RELU:
+        // ReLU with parameterA as the slope for negative inputs.
+        [neuron setNeuronType:MPSCNNNeuronTypeReLU parameterA:0 parameterB:0 parameterC:0];
+        break;
+    case MPS_ACT_GELU:
+        if (@available(macOS 13.0, *)) {
+            [neuron setNeuronType:MPSCNNNeuronTypeGeLU parameterA:0 parameterB:0 parameterC:0];
+            break;
+        }
+        return -9;
+    default:
+        return -9;
+    }
+
+    MPSVector *vecBias = nil;
+    if (bias != NULL) {
+        const NSUInteger n = descC.columns;
+        id<MTLBuffer> bufBias =
+            [device newBufferWithBytes:bias
+                                length:n * sizeof(float)
+                               options:MTLResourceStorageModeShared];
+        MPSVectorDescriptor *descBias =
+            [MPSVectorDescriptor vectorDescriptorWithLength:n
+                                                   dataType:MPSDataTypeFloat32];
+        if (bufBias == nil || descBias == nil) {
+            return -8;
+        }
+        vecBias = [[MPSVector alloc] initWithBuffer:bufBias descriptor:descBias];
+    }
+
+    id<MTLBuffer> bufOut =
+        [device newBufferWithLength:descC.rows * descC.rowBytes
+                            options:MTLResourceStorageModeShared];
+    if (bufOut == nil) {
+        return -8;
+    }
+    MPSMatrix *matOut = [[MPSMatrix alloc] initWithBuffer:bufOut descriptor:descC];
+
+    [neuron encodeToCommandBuffer:cmdBuf
+                      inputMatrix:matC
+                       biasVector:vecBias
+                     resultMatrix:matOut];
+    *out = bufOut;
+    return 0;
+}
+
+// newHalfBuffer returns a shared buffer holding the count values of src
+// rounded to float16, or nil.
+static id<MTLBuffer> newHalfBuffer(id<MTLDevice> device,
+                                   const float *src,
+                                   NSUInteger count) {
+    id<MTLBuffer> buf =
+        [device newBufferWithLength:count * sizeof(__fp16)
+                            options:MTLResourceStorageModeShared];
+    if (buf == nil) {
+        return nil;
+    }
+    __fp16 *dst = (__fp16 *)[buf contents];
+    for (NSUInteger i = 0; i < count; i++) {
+        dst[i] = (__fp16)src[i];
+    }
+    return buf;
+}
+
 int mpsMatMulFloat32(MPSEngineContext ctx,
                      const float *a,
                      const float *b,
                      float *c,
                      int m,
                      int n,
-                     int k) {
+                     int k,
+                     int transA,
+                     int transB,
+                     float alpha,
+                     float beta,
+                     const float *bias,
+                     int activation,
+                     int halfInputs) {
     @autoreleasepool {
         if (ctx == NULL) {
             return -1;
@@ -41,6 +133,148 @@ int mpsMatMulFloat32(MPSEngineContext ctx,
             return -2;
         }
 
+        // Descriptors describe the operands as stored: a transposed
+        // operand is stored as its k x m (or n x k) transpose.
+        const NSUInteger rowsA = transA ? (NSUInteger)k : (NSUInteger)m;
+        const NSUInteger colsA = transA ? (NSUInteger)m : (NSUInteger)k;
+        const NSUInteger rowsB = transB ? (NSUInteger)n : (NSUInteger)k;
+        const NSUInteger colsB = transB ? (NSUInteger)k : (NSUInteger)n;
+        const NSUInteger rowsC = (NSUInteger)m;
+        const NSUInteger colsC = (NSUInteger)n;
+
+        // Inputs are float32, or float16 with halfInputs; MPS converts
+        // mixed input and result types itself.
+        const MPSDataType typeIn = halfInputs ? MPSDataTypeFloat16 : MPSDataTypeFloat32;
+        const NSUInteger sizeIn = halfInputs ? sizeof(__fp16) : sizeof(float);
+        const NSUInteger bytesC = rowsC * colsC * sizeof(float);
+
+        id<MTLBuffer> bufA, bufB;
+        if (halfInputs) {
+            bufA = newHalfBuffer(g_mpsDevice, a, rowsA * colsA);
+            bufB = newHalfBuffer(g_mpsDevice, b, rowsB * colsB);
+        } else {
+            bufA = [g_mpsDevice newBufferWithBytes:a
+                                            length:rowsA * colsA * sizeof(float)
+                                           options:MTLResourceStorageModeShared];
+            bufB = [g_mpsDevice newBufferWithBytes:b
+                                            length:rowsB * colsB * sizeof(float)
+                                           options:MTLResourceStorageModeShared];
+        }
+        // C is only an input when it is blended into the result.
+        id<MTLBuffer> bufC =
+            beta != 0.0f
+                ? [g_mpsDevice newBufferWithBytes:c
+                                           length:bytesC
+                                          options:MTLResourceStorageModeShared]
+                : [g_mpsDevice newBufferWithLength:bytesC
+                                           options:MTLResourceStorageModeShared];
+
+        if (bufA == nil || bufB == nil || bufC == nil) {
+            return -3;
+        }
+
+        // Row-major layout: rowBytes is (number of columns * element size).
+        MPSMatrixDescriptor *descA =
+            [MPSMatrixDescriptor matrixDescriptorWithRows:rowsA
+                                                  columns:colsA
+                                                 rowBytes:colsA * sizeIn
+                                                 dataType:typeIn];
+        MPSMatrixDescriptor *descB =
+            [MPSMatrixDescriptor matrixDescriptorWithRows:rowsB
+                                                  columns:colsB
+                                                 rowBytes:colsB * sizeIn
+                                                 dataType:typeIn];
+        MPSMatrixDescriptor *descC =
+            [MPSMatrixDescriptor matrixDescriptorWithRows:rowsC
+                                                  columns:colsC
+                                                 rowBytes:colsC * sizeof(float)
+                                                 dataType:MPSDataTypeFloat32];
+
+        if (descA == nil || descB == nil || descC == nil) {
+            return -4;
+        }
+
+        MPSMatrix *matA = [[MPSMatrix alloc] initWithBuffer:bufA descriptor:descA];
+        MPSMatrix *matB = [[MPSMatrix alloc] initWithBuffer:bufB descriptor:descB];
+        MPSMatrix *matC = [[MPSMatrix alloc] initWithBuffer:bufC descriptor:descC];
+
+        if (matA == nil || matB == nil || matC == nil) {
+            return -5;
+        }
+
+        // C = alpha*A*B + beta*C; alpha=1, beta=0 gives a plain product.
+        MPSMatrixMultiplication *mm =
+            [[MPSMatrixMultiplication alloc] initWithDevice:g_mpsDevice
+                                             transposeLeft:(transA ? YES : NO)
+                                            transposeRight:(transB ? YES : NO)
+                                               resultRows:rowsC
+                                             resultColumns:colsC
+                                          interiorColumns:(NSUInteger)k
+                                                    alpha:(double)alpha
+                                                     beta:(double)beta];
+
+        if (mm == nil) {
+            return -6;
+        }
+
+        // A fresh command buffer per call keeps concurrent calls sharing
+        // the context's queue independent of each other.
+        id<MTLCommandBuffer> cmdBuf = [g_mpsQueue commandBuffer];
+        if (cmdBuf == nil) {
+            return -7;
+        }
+
+        [mm encodeToCommandBuffer:cmdBuf
+                       leftMatrix:matA
+                      rightMatrix:matB
+                     resultMatrix:matC];
+
+        id<MTLBuffer> bufOut = bufC;
+        if (bias != NULL || activation != MPS_ACT_NONE) {
+            int status = encodeEpilogue(g_mpsDevice, cmdBuf, matC, descC, bias,
+                                        activation, &bufOut);
+            if (status != 0) {
+                return status;
+            }
+        }
+
+        [cmdBuf commit];
+        [cmdBuf waitUntilCompleted];
+
+        // Copy results back into the caller-provided CPU buffer.
+        memcpy(c, [bufOut contents], bytesC);
+
+        return 0;
+    }
+}
+
+int mpsBatchedMatMulFloat32(MPSEngineContext ctx,
+                            const float *a,
+                            const float *b,
+                            float *c,
+                            int batch,
+                            int m,
+                            int n,
+                            int k,
+                            float alpha,
+                            float beta) {
+    @autoreleasepool {
+        if (ctx == NULL) {
+            return -1;
+        }
+        MPSEngineContextObj *obj = (__bridge MPSEngineContextObj *)ctx;
+        id<MTLDevice> device = obj.device;
+        id<MTLCommandQueue> queue = obj.queue;
+
+        if (device == nil || queue == nil) {
+            return -1;
+        }
+
+        if (a == NULL || b == NULL || c == NULL || batch <= 0) {
+            return -2;
+        }
+
+        const NSUInteger count = (NSUInteger)batch;
         const NSUInteger rowsA = (NSUInteger)m;
         const NSUInteger colsA = (NSUInteger)k;
         const NSUInteger rowsB = (NSUInteger)k;
@@ -48,41 +282,51 @@ int mpsMatMulFloat32(MPSEngineContext ctx,
         const NSUInteger rowsC = (NSUInteger)m;
         const NSUInteger colsC = (NSUInteger)n;
 
-        const NSUInteger bytesA = rowsA * colsA * sizeof(float);
-        const NSUInteger bytesB = rowsB * colsB * sizeof(float);
-        const NSUInteger bytesC = rowsC * colsC * sizeof(float);
+        const NSUInteger matBytesA = rowsA * colsA * sizeof(float);
+        const NSUInteger matBytesB = rowsB * colsB * sizeof(float);
+        const NSUInteger matBytesC = rowsC * colsC * sizeof(float);
 
         id<MTLBuffer> bufA =
-            [g_mpsDevice newBufferWithBytes:a
-                                     length:bytesA
-                                    options:MTLResourceStorageModeShared];
+            [device newBufferWithBytes:a
+                                length:count * matBytesA
+                               options:MTLResourceStorageModeShared];
         id<MTLBuffer> bufB =
-            [g_mpsDevice newBufferWithBytes:b
-                                     length:bytesB
-                                    options:MTLResourceStorageModeShared];
+            [device newBufferWithBytes:b
+                                length:count * matBytesB
+                               options:MTLResourceStorageModeShared];
         id<MTLBuffer> bufC =
-            [g_mpsDevice newBufferWithLength:bytesC
-                                     options:MTLResourceStorageModeShared];
+            beta != 0.0f
+                ? [device newBufferWithBytes:c
+                                      length:count * matBytesC
+                                     options:MTLResourceStorageModeShared]
+                : [device newBufferWithLength:count * matBytesC
+                                      options:MTLResourceStorageModeShared];
 
         if (bufA == nil || bufB == nil || bufC == nil) {
             return -3;
         }
 
-        // Row-major layout: rowBytes is (number of columns * sizeof(float)).
+        // Consecutive matrices of each operand are matrixBytes apart.
         MPSMatrixDescriptor *descA =
             [MPSMatrixDescriptor matrixDescriptorWithRows:rowsA
                                                   columns:colsA
+                                                 matrices:count
                                                  rowBytes:colsA * sizeof(float)
+                                              matrixBytes:matBytesA
                                                  dataType:MPSDataTypeFloat32];
         MPSMatrixDescriptor *descB =
             [MPSMatrixDescriptor matrixDescriptorWithRows:rowsB
                                                   columns:colsB
+                                                 matrices:count
                                                  rowBytes:colsB * sizeof(float)
+                                              matrixBytes:matBytesB
                                                  dataType:MPSDataTypeFloat32];
         MPSMatrixDescriptor *descC =
             [MPSMatrixDescriptor matrixDescriptorWithRows:rowsC
                                                   columns:colsC
+                                                 matrices:count
                                                  rowBytes:colsC * sizeof(float)
+                                              matrixBytes:matBytesC
                                                  dataType:MPSDataTypeFloat32];
 
         if (descA == nil || descB == nil || descC == nil) {
@@ -97,22 +341,25 @@ int mpsMatMulFloat32(MPSEngineContext ctx,
             return -5;
         }
 
-        // alpha=1, beta=0 gives C = A*B without blending with existing C.
         MPSMatrixMultiplication *mm =
-            [[MPSMatrixMultiplication alloc] initWithDevice:g_mpsDevice
+            [[MPSMatrixMultiplication alloc] initWithDevice:device
                                              transposeLeft:NO
                                             transposeRight:NO
                                                resultRows:rowsC
                                              resultColumns:colsC
                                           interiorColumns:colsA
-                                                    alpha:1.0f
-                                                     beta:0.0f];
+                                                    alpha:(double)alpha
+                                                     beta:(double)beta];
 
         if (mm == nil) {
             return -6;
         }
+        mm.batchStart = 0;
+        mm.batchSize = count;
 
-        id<MTLCommandBuffer> cmdBuf = [g_mpsQueue commandBuffer];
+        // A fresh command buffer per call keeps concurrent calls sharing
+        // the context's queue independent of each other.
+        id<MTLCommandBuffer> cmdBuf = [queue commandBuffer];
         if (cmdBuf == nil) {
             return -7;
         }
@@ -125,8 +372,7 @@ int mpsMatMulFloat32(MPSEngineContext ctx,
         [cmdBuf commit];
         [cmdBuf waitUntilCompleted];
 
-        // Copy results back into the caller-provided CPU buffer.
-        memcpy(c, [bufC contents], bytesC);
+        memcpy(c, [bufC contents], count * matBytesC);
 
         return 0;
     }
@@ -0,0 +1,68 @@
+// mps_reduce.h
+// Minimal C interface for invoking a Metal-based reduction along one
+// axis from Go via cgo. Each call uses the engine-level MPSEngineContext.
+//
+// This computes, for a row-major [outer x n x inner] array X:
+//   y[o, i] = op over j of X[o, j, i]
+// producing a row-major [outer x inner] output y, where op is the sum,
+// maximum, minimum or product. With inner = 1 this is the row-wise
+// reduction of an [outer x n] matrix. The argument reduction computes
+// the index j of the maximum or minimum instead.
+
+#pragma once
+
+#include "mps_engine_ctx.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Reduction operators, matching reduceOp in reduce.go. The maximum and
+// minimum treat NaNs as StdEng does: they are those of the elements
+// after the last NaN, or NaN if that is the last element. Along the
+// leading axis StdEng instead gives NaN if the first element is and
+// skips the other NaNs, as MPSReduceMaxLead and MPSReduceMinLead do.
+enum {
+    MPSReduceSum = 0,
+    MPSReduceMax = 1,
+    MPSReduceMin = 2,
+    MPSReduceProd = 3,
+    MPSReduceMaxLead = 4,
+    MPSReduceMinLead = 5,
+};
+
+// mpsReduceAxisFloat32 reduces the middle axis of a row-major
+// [outer x n x inner] float32 array X with op, writing the
+// [outer x inner] results into y using the given engine context. y must
+// not overlap X.
+//
+// Returns 0 on success, non-zero on failure. On failure, callers should
+// fall back to a CPU implementation.
+int mpsReduceAxisFloat32(MPSEngineContext ctx,
+                         int op,
+                         const float *x,
+                         float *y,
+                         int outer,
+                         int n,
+                         int inner);
+
+// mpsArgReduceAxisFloat32 writes into idx, for each of the
+// [outer x inner] columns of a row-major [outer x n x inner] float32
+// array X, the index along the middle axis of its first maximum (op
+// MPSReduceMax) or minimum (MPSReduceMin) as StdEng finds it: the first
+// NaN or infinity of the extreme's sign after the first element if
+// there is one, and otherwise the first element if it is NaN.
+//
+// Returns 0 on success, non-zero on failure, like mpsReduceAxisFloat32.
+int mpsArgReduceAxisFloat32(MPSEngineContext ctx,
+                            int op,
+                            const float *x,
+                            int *idx,
+                            int outer,
+                            int n,
+                            int inner);
+
+#ifdef __cplusplus
+}
+#endif
+
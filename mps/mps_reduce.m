@@ -0,0 +1,182 @@
+//go:build darwin && cgo
+
+// mps_reduce.m
+// Minimal Objective-C helper that uses custom Metal compute kernels to
+// reduce a float32 array along one axis using the shared engine context
+// (device + command queue): row_reduce when the axis is innermost, and
+// axis_reduce otherwise, or their argument counterparts row_argreduce
+// and axis_argreduce.
+
+#import <Foundation/Foundation.h>
+#import <Metal/Metal.h>
+
+#import "mps_reduce.h"
+
+// Re-declare the engine context ObjC class so we can downcast the
+// opaque MPSEngineContext handle back to a usable object. The actual
+// implementation lives in mps_engine_ctx.m.
+@interface MPSEngineContextObj : NSObject
+@property(nonatomic, readonly) id<MTLDevice> device;
+@property(nonatomic, readonly) id<MTLCommandQueue> queue;
+@property(nonatomic, readonly) id<MTLComputePipelineState> rowReducePSO;
+@property(nonatomic, readonly) id<MTLComputePipelineState> axisReducePSO;
+@property(nonatomic, readonly) id<MTLComputePipelineState> rowArgReducePSO;
+@property(nonatomic, readonly) id<MTLComputePipelineState> axisArgReducePSO;
+@end
+
+// runAxisKernel runs pso, one of the row or axis kernels, over the
+// row-major [outer x n x inner] array x with op, writing the
+// [outer x inner] results of elemSize bytes each into y. rows tells
+// whether pso is a row kernel, which needs inner = 1.
+static int runAxisKernel(MPSEngineContextObj *obj,
+                         id<MTLComputePipelineState> pso,
+                         BOOL rows,
+                         int op,
+                         const float *x,
+                         void *y,
+                         NSUInteger elemSize,
+                         int outer,
+                         int n,
+                         int inner) {
+    id<MTLDevice> device = obj.device;
+    id<MTLCommandQueue> queue = obj.queue;
+
+    if (device == nil || queue == nil || pso == nil) {
+        return -1;
+    }
+
+    if (x == NULL || y == NULL) {
+        return -2;
+    }
+
+    const NSUInteger uOuter = (NSUInteger)outer;
+    const NSUInteger uN = (NSUInteger)n;
+    const NSUInteger uInner = (NSUInteger)inner;
+    const NSUInteger bytesX = uOuter * uN * uInner * sizeof(float);
+    const NSUInteger bytesY = uOuter * uInner * elemSize;
+
+    // Go slices are rarely page-aligned, as wrapping them without a copy
+    // requires, so x is copied in and the results copied out.
+    id<MTLBuffer> bufX =
+        [device newBufferWithBytes:x
+                            length:bytesX
+                           options:MTLResourceStorageModeShared];
+    id<MTLBuffer> bufY =
+        [device newBufferWithLength:bytesY
+                            options:MTLResourceStorageModeShared];
+    if (bufX == nil || bufY == nil) {
+        return -6;
+    }
+
+    // The row kernels read (rows, cols) as a uint2, the axis kernels
+    // (outer, n, inner) as a packed_uint3.
+    uint shape[3] = { (uint)outer, (uint)n, (uint)inner };
+    id<MTLBuffer> bufShape =
+        [device newBufferWithBytes:shape
+                            length:(rows ? 2 : 3) * sizeof(uint)
+                           options:MTLResourceStorageModeShared];
+    if (bufShape == nil) {
+        return -7;
+    }
+
+    // A fresh command buffer per call keeps concurrent calls sharing
+    // the context's queue independent of each other.
+    id<MTLCommandBuffer> cmdBuf = [queue commandBuffer];
+    if (cmdBuf == nil) {
+        return -8;
+    }
+
+    id<MTLComputeCommandEncoder> enc = [cmdBuf computeCommandEncoder];
+    if (enc == nil) {
+        return -9;
+    }
+
+    [enc setComputePipelineState:pso];
+    [enc setBuffer:bufX offset:0 atIndex:0];
+    [enc setBuffer:bufY offset:0 atIndex:1];
+    [enc setBuffer:bufShape offset:0 atIndex:2];
+    uint uOp = (uint)op;
+    [enc setBytes:&uOp length:sizeof(uOp) atIndex:3];
+
+    NSUInteger maxThreads = pso.maxTotalThreadsPerThreadgroup;
+    if (maxThreads == 0) {
+        maxThreads = 1;
+    }
+    if (rows) {
+        // Launch one threadgroup per row, with multiple threads per
+        // row cooperating via threadgroup memory.
+        const NSUInteger maxPerRow = 256;
+        // Don't launch more threads per row than we have columns.
+        NSUInteger threadsPerThreadgroup = MIN(maxThreads, MIN(uN, maxPerRow));
+
+        MTLSize numThreadgroups = MTLSizeMake(uOuter, 1, 1);
+        MTLSize tgSize = MTLSizeMake(threadsPerThreadgroup, 1, 1);
+        [enc dispatchThreadgroups:numThreadgroups
+            threadsPerThreadgroup:tgSize];
+    } else {
+        // One thread per output element; the kernel skips the
+        // threads past the end of the last threadgroup.
+        const NSUInteger total = uOuter * uInner;
+        NSUInteger threadsPerThreadgroup = MIN(maxThreads, total);
+        MTLSize numThreadgroups =
+            MTLSizeMake((total + threadsPerThreadgroup - 1) / threadsPerThreadgroup, 1, 1);
+        MTLSize tgSize = MTLSizeMake(threadsPerThreadgroup, 1, 1);
+        [enc dispatchThreadgroups:numThreadgroups
+            threadsPerThreadgroup:tgSize];
+    }
+
+    [enc endEncoding];
+    [cmdBuf commit];
+    [cmdBuf waitUntilCompleted];
+    if (cmdBuf.status != MTLCommandBufferStatusCompleted || cmdBuf.error != nil) {
+        return -10;
+    }
+
+    memcpy(y, [bufY contents], bytesY);
+
+    return 0;
+}
+
+int mpsReduceAxisFloat32(MPSEngineContext ctx,
+                         int op,
+                         const float *x,
+                         float *y,
+                         int outer,
+                         int n,
+                         int inner) {
+    @autoreleasepool {
+        if (ctx == NULL) {
+            return -1;
+        }
+        if (op < MPSReduceSum || op > MPSReduceMinLead) {
+            return -3;
+        }
+
+        MPSEngineContextObj *obj = (__bridge MPSEngineContextObj *)ctx;
+        const BOOL rows = (inner == 1);
+        id<MTLComputePipelineState> pso = rows ? obj.rowReducePSO : obj.axisReducePSO;
+        return runAxisKernel(obj, pso, rows, op, x, y, sizeof(float), outer, n, inner);
+    }
+}
+
+int mpsArgReduceAxisFloat32(MPSEngineContext ctx,
+                            int op,
+                            const float *x,
+                            int *idx,
+                            int outer,
+                            int n,
+                            int inner) {
+    @autoreleasepool {
+        if (ctx == NULL) {
+            return -1;
+        }
+        if (op != MPSReduceMax && op != MPSReduceMin) {
+            return -3;
+        }
+
+        MPSEngineContextObj *obj = (__bridge MPSEngineContextObj *)ctx;
+        const BOOL rows = (inner == 1);
+        id<MTLComputePipelineState> pso = rows ? obj.rowArgReducePSO : obj.axisArgReducePSO;
+        return runAxisKernel(obj, pso, rows, op, x, idx, sizeof(int), outer, n, inner);
+    }
+}
@@ -0,0 +1,147 @@
+// options.go
+//
+// Functional options accepted by NewMPSEng. Options only populate the
+// engine's dispatch policy; the policy itself is evaluated in dispatch.go
+// so that it is plain Go and behaves identically on every platform.
+
+package mps
+
+import "gorgonia.org/tensor"
+
+// Option configures an MPSEng at construction time. See NewMPSEng.
+type Option func(*config)
+
+// config holds the dispatch policy of an MPSEng. It is filled in once by
+// NewMPSEng and treated as read-only afterwards.
+type config struct {
+	// thresholds are the initial per-op GPU crossover points. Smaller
+	// problems go to the fallback engine. Calibrate may replace them on
+	// the live engine later.
+	thresholds thresholdTable
+
+	// disabled marks ops that must never be dispatched to the GPU.
+	disabled [numOps]bool
+
+	// strict turns every would-be fallback into an error.
+	strict bool
+
+	// fallback is the engine used whenever an op is not accelerated. A
+	// nil fallback means the embedded tensor.StdEng.
+	fallback tensor.Engine
+
+	// backend replaces the platform's default device backend when set.
+	backend backend
+
+	// maxPoolBytes caps the idle staging buffers kept for reuse.
+	maxPoolBytes int64
+
+	// maxBufferBytes caps the device buffers of a single kernel call; 0
+	// leaves only the device's own limit.
+	maxBufferBytes int64
+
+	// cpuGEMM lets MatMul, Gemm and Linear fallbacks run on sgemm.
+	cpuGEMM bool
+
+	// stdEngSIMD records that StdEng's float32 kernels beat sgemm.
+	stdEngSIMD bool
+
+	// precision is the precision policy of MatMul, Gemm and Linear.
+	precision Precision
+}
+
+// defaultThresholds are conservative crossovers for Apple silicon below
+// which cgo and command-buffer overhead outweigh the GPU's speed. Run
+// Calibrate to fit thresholds for the actual machine.
+var defaultThresholds = thresholdTable{
+	OpMatMul: {MinFLOPs: 1 << 22}, // roughly a 128x128x128 product
+	OpSum:    {MinFLOPs: 1 << 18}, // roughly a 512x512 matrix
+
+	// The other reductions cost as much as Sum.
+	OpMax:    {MinFLOPs: 1 << 18},
+	OpMin:    {MinFLOPs: 1 << 18},
+	OpProd:   {MinFLOPs: 1 << 18},
+	OpMean:   {MinFLOPs: 1 << 18},
+	OpArgmax: {MinFLOPs: 1 << 18},
+	OpArgmin: {MinFLOPs: 1 << 18},
+
+	OpBatchedMatMul: {MinFLOPs: 1 << 22}, // over the whole batch
+	OpLinear:        {MinFLOPs: 1 << 22}, // as MatMul; the epilogue is cheap
+
+	// Vector products are bandwidth bound; the GPU only pays off on very
+	// large operands.
+	OpMatVecMul: {MinFLOPs: 1 << 23}, // roughly a 2048x2048 matrix
+	OpInner:     {MinFLOPs: 1 << 25}, // 16M-element vectors
+	OpOuter:     {MinFLOPs: 1 << 23}, // roughly a 2048x2048 result
+}
+
+// defaultConfig returns the policy used when NewMPSEng is called without
+// options: supported ops are accelerated once they exceed
+// defaultThresholds, and everything else silently falls back to
+// tensor.StdEng.
+func defaultConfig() config {
+	return config{thresholds: defaultThresholds, maxPoolBytes: defaultMaxPoolBytes, stdEngSIMD: stdEngSIMD}
+}
+
+// WithMinFLOPs sets, for every op, the minimum problem size in floating
+// point operations for which the op is dispatched to the GPU. Smaller
+// problems are handled by the fallback engine, where they are usually
+// cheaper than the cgo and command-buffer overhead of a GPU round trip.
+//
+// For MatMul the cost of an (m x k) by (k x n) product is 2*m*n*k; for
+// Sum it is the number of input elements. MatVecMul, Inner and Outer are
+// costed as the equivalent MatMul with n = 1, m = n = 1 and k = 1
+// respectively.
+func WithMinFLOPs(flops int64) Option {
+	return func(c *config) {
+		if flops < 0 {
+			flops = 0
+		}
+		for op := range c.thresholds {
+			c.thresholds[op].MinFLOPs = flops
+		}
+	}
+}
+
+// WithThreshold sets the GPU crossover point of a single op, replacing
+// any earlier WithMinFLOPs for that op. Unknown ops are ignored.
+func WithThreshold(op Op, t Threshold) Option {
+	return func(c *config) {
+		if !op.valid() {
+			return
+		}
+		c.thresholds[op] = t
+	}
+}
+
+// WithOpEnabled enables or disables GPU dispatch for a single op. A
+// disabled op is always handled by the fallback engine. Unknown ops are
+// ignored.
+func WithOpEnabled(op Op, enabled bool) Option {
+	return func(c *config) {
+		if !op.valid() {
+			return
+		}
+		c.disabled[op] = !enabled
+	}
+}
+
+// WithStrict controls whether the engine may fall back to the CPU. In
+// strict mode any input that would not run on the GPU makes the op
+// return a *FallbackError instead of being silently handled by the
+// fallback engine. Strict-mode fallbacks are still counted in Stats.
+func WithStrict(strict bool) Option {
+	return func(c *config) {
+		c.strict = strict
+	}
+}
+
+// WithFallbackEngine sets the engine used for inputs that are not
+// accelerated. The engine must implement the corresponding tensor
+// interface (tensor.MatMuler, tensor.Sumer, ...) for the op in question;
+// ops it does not implement are handled by the embedded tensor.StdEng.
+// Passing nil restores the default.
+func WithFallbackEngine(eng tensor.Engine) Option {
+	return func(c *config) {
+		c.fallback = eng
+	}
+}
@@ -0,0 +1,135 @@
+package mps
+
+import (
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// countingEngine is a fallback engine that records how often each op is
+// delegated to it before running it on StdEng.
+type countingEngine struct {
+	tensor.StdEng
+	matMuls int
+	sums    int
+}
+
+func (c *countingEngine) MatMul(a, b, prealloc tensor.Tensor) error {
+	c.matMuls++
+	return c.StdEng.MatMul(a, b, prealloc)
+}
+
+func (c *countingEngine) Sum(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	c.sums++
+	return c.StdEng.Sum(a, along...)
+}
+
+func TestNewMPSEngDefaultConfig(t *testing.T) {
+	e := NewMPSEng()
+	if e.cfg.thresholds != defaultThresholds || e.cfg.strict || e.cfg.fallback != nil {
+		t.Fatalf("unexpected default config: %+v", e.cfg)
+	}
+	if r := e.policyReason(OpMatMul, matMulCost(4, 5, 3)); r != ReasonSizeThreshold {
+		t.Fatalf("tiny MatMul should stay on the CPU by default, got reason %v", r)
+	}
+	for op := Op(0); op < numOps; op++ {
+		if r := e.policyReason(op, opCost{flops: 1 << 40, bytes: 1 << 40}); r != ReasonNone {
+			t.Fatalf("large %v should be accelerated by default, got reason %v", op, r)
+		}
+	}
+}
+
+func TestConfigPolicyReason(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  []Option
+		op    Op
+		flops int64
+		want  FallbackReason
+	}{
+		{"below threshold", []Option{WithMinFLOPs(1000)}, OpMatMul, 999, ReasonSizeThreshold},
+		{"at threshold", []Option{WithMinFLOPs(1000)}, OpMatMul, 1000, ReasonNone},
+		{"negative threshold clamps", []Option{WithMinFLOPs(-5)}, OpSum, 0, ReasonNone},
+		{"op disabled", []Option{WithOpEnabled(OpSum, false)}, OpSum, 1 << 30, ReasonDisabled},
+		{"other op unaffected", []Option{WithMinFLOPs(0), WithOpEnabled(OpSum, false)}, OpMatMul, 1, ReasonNone},
+		{"re-enabled", []Option{WithMinFLOPs(0), WithOpEnabled(OpSum, false), WithOpEnabled(OpSum, true)}, OpSum, 1, ReasonNone},
+		{"unknown op ignored", []Option{WithMinFLOPs(0), WithOpEnabled(Op(42), false)}, OpMatMul, 1, ReasonNone},
+		{"per-op threshold", []Option{WithThreshold(OpMatMul, Threshold{MinBytes: 64})}, OpMatMul, 1 << 30, ReasonSizeThreshold},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewMPSEng(tc.opts...)
+			defer e.Close()
+			if got := e.policyReason(tc.op, opCost{flops: tc.flops}); got != tc.want {
+				t.Fatalf("policyReason(%v, %d) = %v, want %v", tc.op, tc.flops, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpString(t *testing.T) {
+	if got := OpMatMul.String(); got != "MatMul" {
+		t.Fatalf("OpMatMul.String() = %q", got)
+	}
+	if got := Op(-1).String(); got != "Op(-1)" {
+		t.Fatalf("Op(-1).String() = %q", got)
+	}
+}
+
+// Test that problems rejected by the dispatch policy are handed to the
+// custom fallback engine and still produce StdEng results.
+func TestMPSEngFallbackEngineHonored(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	a := newRandomFloat32Matrix(t, 4, 3, r)
+	b := newRandomFloat32Matrix(t, 3, 5, r)
+
+	for _, opt := range []Option{WithMinFLOPs(1 << 40), WithOpEnabled(OpMatMul, false)} {
+		fb := &countingEngine{}
+		e := NewMPSEng(opt, WithFallbackEngine(fb), WithOpEnabled(OpSum, false))
+
+		got := newZeroFloat32Matrix(4, 5)
+		if err := e.MatMul(a, b, got); err != nil {
+			t.Fatalf("MatMul error: %v", err)
+		}
+		want := newZeroFloat32Matrix(4, 5)
+		var cpu tensor.StdEng
+		if err := cpu.MatMul(a, b, want); err != nil {
+			t.Fatalf("StdEng.MatMul error: %v", err)
+		}
+		if !equalApprox(extractFloat32Backing(t, got), extractFloat32Backing(t, want), 1e-6) {
+			t.Fatalf("fallback result differs from StdEng")
+		}
+		if fb.matMuls != 1 {
+			t.Fatalf("fallback MatMul calls = %d, want 1", fb.matMuls)
+		}
+
+		if _, err := e.Sum(a, 1); err != nil {
+			t.Fatalf("Sum error: %v", err)
+		}
+		if fb.sums != 1 {
+			t.Fatalf("fallback Sum calls = %d, want 1", fb.sums)
+		}
+	}
+}
+
+// Test that strict mode turns a fallback into an error instead of
+// running on the CPU.
+func TestMPSEngStrictRejectsFallback(t *testing.T) {
+	fb := &countingEngine{}
+	e := NewMPSEng(WithStrict(true), WithFallbackEngine(fb))
+
+	a := tensor.New(tensor.WithShape(2, 3), tensor.WithBacking(make([]float64, 6)))
+	b := tensor.New(tensor.WithShape(3, 2), tensor.WithBacking(make([]float64, 6)))
+	c := tensor.New(tensor.WithShape(2, 2), tensor.WithBacking(make([]float64, 4)))
+
+	if err := e.MatMul(a, b, c); err == nil {
+		t.Fatalf("expected strict-mode error for float64 MatMul, got nil")
+	}
+	if _, err := e.Sum(a, 1); err == nil {
+		t.Fatalf("expected strict-mode error for float64 Sum, got nil")
+	}
+	if fb.matMuls != 0 || fb.sums != 0 {
+		t.Fatalf("strict mode must not call the fallback engine (matmuls=%d sums=%d)", fb.matMuls, fb.sums)
+	}
+}
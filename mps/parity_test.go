@@ -0,0 +1,250 @@
+package mps
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// naiveMatMul computes a x b through At, as float64, for 2D tensors of
+// any float dtype and layout.
+func naiveMatMul(t *testing.T, a, b *tensor.Dense) []float64 {
+	t.Helper()
+	m, k, n := a.Shape()[0], a.Shape()[1], b.Shape()[1]
+	av, bv := denseValues(t, a), denseValues(t, b)
+	out := make([]float64, m*n)
+	for i := 0; i < m; i++ {
+		for j := 0; j < n; j++ {
+			for p := 0; p < k; p++ {
+				out[i*n+j] += float64(av[i*k+p]) * float64(bv[p*n+j])
+			}
+		}
+	}
+	return out
+}
+
+// randomMatrix returns a rows x cols row-major matrix of dtype dt.
+func randomMatrix(r *rand.Rand, dt tensor.Dtype, rows, cols int) *tensor.Dense {
+	if dt == tensor.Float64 {
+		data := make([]float64, rows*cols)
+		for i := range data {
+			data[i] = r.NormFloat64()
+		}
+		return tensor.New(tensor.WithShape(rows, cols), tensor.WithBacking(data))
+	}
+	return randomDenseF32(r, rows, cols)
+}
+
+// Test that MatMul behaves as a drop-in replacement for StdEng across
+// shapes StdEng panics on, empty products and outputs that alias an
+// input, on the device and through the fallback, for float32 and
+// float64.
+func TestMatMulParity(t *testing.T) {
+	type operands struct{ a, b, c *tensor.Dense }
+	view := func(d *tensor.Dense, slices ...tensor.Slice) *tensor.Dense {
+		v, err := d.Slice(slices...)
+		if err != nil {
+			t.Fatalf("Slice error: %v", err)
+		}
+		return v.(*tensor.Dense)
+	}
+	transpose := func(d *tensor.Dense) *tensor.Dense {
+		if err := d.T(); err != nil {
+			t.Fatalf("T error: %v", err)
+		}
+		return d
+	}
+	cases := []struct {
+		name string
+		make func(r *rand.Rand, dt tensor.Dtype) operands
+		// wantErr means MatMul must return an error rather than panic.
+		wantErr bool
+		// want is the expected output; nil means naiveMatMul of the
+		// operands as they were before the call.
+		want []float64
+	}{
+		{name: "row-major", make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{randomMatrix(r, dt, 4, 3), randomMatrix(r, dt, 3, 5), randomMatrix(r, dt, 4, 5)}
+		}},
+		{name: "transposed and sliced", make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			a := transpose(randomMatrix(r, dt, 3, 4))
+			b := view(randomMatrix(r, dt, 5, 7), tensor.S(1, 4), tensor.S(2, 7))
+			c := view(randomMatrix(r, dt, 6, 6), tensor.S(1, 5), tensor.S(0, 5))
+			return operands{a, b, c}
+		}},
+		{name: "1-D a", wantErr: true, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{tensor.New(tensor.WithShape(3), tensor.Of(dt)), randomMatrix(r, dt, 3, 2), tensor.New(tensor.WithShape(2), tensor.Of(dt))}
+		}},
+		{name: "1-D b", wantErr: true, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{randomMatrix(r, dt, 2, 3), tensor.New(tensor.WithShape(3), tensor.Of(dt)), tensor.New(tensor.WithShape(2), tensor.Of(dt))}
+		}},
+		{name: "3-D", wantErr: true, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{tensor.New(tensor.WithShape(2, 2, 3), tensor.Of(dt)), randomMatrix(r, dt, 3, 2), tensor.New(tensor.WithShape(2, 2, 2), tensor.Of(dt))}
+		}},
+		{name: "scalar", wantErr: true, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{tensor.New(tensor.WithShape(), tensor.Of(dt)), randomMatrix(r, dt, 1, 1), randomMatrix(r, dt, 1, 1)}
+		}},
+		{name: "inner mismatch", wantErr: true, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{randomMatrix(r, dt, 2, 3), randomMatrix(r, dt, 4, 2), randomMatrix(r, dt, 2, 2)}
+		}},
+		{name: "prealloc mismatch", wantErr: true, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{randomMatrix(r, dt, 2, 3), randomMatrix(r, dt, 3, 2), randomMatrix(r, dt, 3, 2)}
+		}},
+		{name: "no rows", want: []float64{}, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{tensor.New(tensor.WithShape(0, 3), tensor.Of(dt)), randomMatrix(r, dt, 3, 2), tensor.New(tensor.WithShape(0, 2), tensor.Of(dt))}
+		}},
+		{name: "no columns", want: []float64{}, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			return operands{randomMatrix(r, dt, 2, 3), tensor.New(tensor.WithShape(3, 0), tensor.Of(dt)), tensor.New(tensor.WithShape(2, 0), tensor.Of(dt))}
+		}},
+		{name: "empty inner", want: []float64{0, 0, 0, 0, 0, 0}, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			// The output starts out random and must be zeroed.
+			return operands{tensor.New(tensor.WithShape(2, 0), tensor.Of(dt)), tensor.New(tensor.WithShape(0, 3), tensor.Of(dt)), randomMatrix(r, dt, 2, 3)}
+		}},
+		{name: "empty inner sliced output", want: []float64{0, 0, 0, 0}, make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			c := view(randomMatrix(r, dt, 3, 3), tensor.S(1, 3), tensor.S(0, 2))
+			return operands{tensor.New(tensor.WithShape(2, 0), tensor.Of(dt)), tensor.New(tensor.WithShape(0, 2), tensor.Of(dt)), c}
+		}},
+		{name: "prealloc is a", make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			a := randomMatrix(r, dt, 4, 4)
+			return operands{a, randomMatrix(r, dt, 4, 4), a}
+		}},
+		{name: "prealloc is b", make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			b := randomMatrix(r, dt, 4, 4)
+			return operands{randomMatrix(r, dt, 4, 4), b, b}
+		}},
+		{name: "prealloc is a transposed", make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			c := randomMatrix(r, dt, 4, 4)
+			return operands{transpose(c.ShallowClone()), randomMatrix(r, dt, 4, 4), c}
+		}},
+		{name: "prealloc overlaps a", make: func(r *rand.Rand, dt tensor.Dtype) operands {
+			base := randomMatrix(r, dt, 6, 4)
+			return operands{view(base, tensor.S(0, 4), nil), randomMatrix(r, dt, 4, 4), view(base, tensor.S(2, 6), nil)}
+		}},
+	}
+	engines := []struct {
+		name string
+		opts []Option
+	}{
+		{"device", []Option{withBackend(newRefBackend())}},
+		{"tiled", []Option{withBackend(newRefBackend()), WithMaxBufferBytes(5 * 4)}},
+		{"fallback", []Option{WithOpEnabled(OpMatMul, false)}},
+	}
+
+	for _, eng := range engines {
+		for _, dt := range []tensor.Dtype{tensor.Float32, tensor.Float64} {
+			for i, tc := range cases {
+				name := fmt.Sprintf("%s/%v/%s", eng.name, dt, tc.name)
+				r := rand.New(rand.NewSource(int64(101 + i)))
+				ops := tc.make(r, dt)
+				want := tc.want
+				if want == nil && !tc.wantErr {
+					want = naiveMatMul(t, ops.a, ops.b)
+				}
+
+				e := NewMPSEng(append([]Option{WithMinFLOPs(0)}, eng.opts...)...)
+				err := func() (err error) {
+					defer func() {
+						if p := recover(); p != nil {
+							err = fmt.Errorf("panic: %v", p)
+							t.Errorf("%s: MatMul panicked: %v", name, p)
+						}
+					}()
+					return e.MatMul(ops.a, ops.b, ops.c)
+				}()
+				e.Close()
+
+				if tc.wantErr {
+					if err == nil {
+						t.Errorf("%s: expected an error", name)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: MatMul error: %v", name, err)
+					continue
+				}
+				got := denseValues(t, ops.c)
+				if len(got) != len(want) {
+					t.Errorf("%s: got %d elements, want %d", name, len(got), len(want))
+					continue
+				}
+				for j := range got {
+					if math.Abs(float64(got[j])-want[j]) > 1e-4 {
+						t.Errorf("%s: got %v, want %v", name, got, want)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// Test that Gemm, which reads its output, and Linear, whose bias may live
+// in its output, handle aliasing and empty inner dimensions too.
+func TestGemmLinearAliasing(t *testing.T) {
+	r := rand.New(rand.NewSource(102))
+	for _, eng := range []struct {
+		name string
+		opts []Option
+	}{
+		{"device", []Option{withBackend(newRefBackend())}},
+		{"fallback", []Option{WithOpEnabled(OpMatMul, false), WithOpEnabled(OpLinear, false)}},
+	} {
+		e := NewMPSEng(append([]Option{WithMinFLOPs(0)}, eng.opts...)...)
+
+		// c = 2 * c x b + c with c as the left operand.
+		c, b := randomDenseF32(r, 3, 3), randomDenseF32(r, 3, 3)
+		c0 := denseValues(t, c)
+		want := gemmWant(t, 2, tensor.New(tensor.WithShape(3, 3), tensor.WithBacking(append([]float32(nil), c0...))), b, 1, c0)
+		if err := e.Gemm(2, c, b, 1, c); err != nil {
+			t.Fatalf("%s: Gemm error: %v", eng.name, err)
+		}
+		if got := denseValues(t, c); !equalApprox(got, want, 1e-4) {
+			t.Fatalf("%s: aliased Gemm got %v, want %v", eng.name, got, want)
+		}
+
+		// The empty inner product scales c by beta.
+		c = randomDenseF32(r, 2, 2)
+		c0 = denseValues(t, c)
+		empty := func(shape ...int) *tensor.Dense {
+			return tensor.New(tensor.WithShape(shape...), tensor.Of(tensor.Float32))
+		}
+		if err := e.Gemm(3, empty(2, 0), empty(0, 2), 0.5, c); err != nil {
+			t.Fatalf("%s: empty Gemm error: %v", eng.name, err)
+		}
+		for i, v := range denseValues(t, c) {
+			if v != 0.5*c0[i] {
+				t.Fatalf("%s: empty Gemm got %v, want half of %v", eng.name, denseValues(t, c), c0)
+			}
+		}
+
+		// Linear whose bias is the first row of its output.
+		x, w := randomDenseF32(r, 3, 2), randomDenseF32(r, 2, 4)
+		out := randomDenseF32(r, 3, 4)
+		bias, err := out.Slice(tensor.S(0))
+		if err != nil {
+			t.Fatalf("Slice error: %v", err)
+		}
+		biasCopy := tensor.New(tensor.WithShape(4), tensor.WithBacking(denseValues(t, bias.(*tensor.Dense))))
+		wantLin := linearWant(t, x, w, biasCopy, ActReLU)
+		if err := e.Linear(x, w, bias, ActReLU, out); err != nil {
+			t.Fatalf("%s: Linear error: %v", eng.name, err)
+		}
+		if got := denseValues(t, out); !equalApprox(got, wantLin, 1e-5) {
+			t.Fatalf("%s: aliased Linear got %v, want %v", eng.name, got, wantLin)
+		}
+
+		// Linear with an empty inner dimension is act(bias) on every row.
+		out = randomDenseF32(r, 2, 3)
+		if err := e.Linear(empty(2, 0), empty(0, 3), tensor.New(tensor.WithShape(3), tensor.WithBacking([]float32{-1, 0, 2})), ActReLU, out); err != nil {
+			t.Fatalf("%s: empty Linear error: %v", eng.name, err)
+		}
+		if got, want := denseValues(t, out), []float32{0, 0, 2, 0, 0, 2}; !equalApprox(got, want, 0) {
+			t.Fatalf("%s: empty Linear got %v, want %v", eng.name, got, want)
+		}
+		e.Close()
+	}
+}
@@ -0,0 +1,145 @@
+// pool.go
+//
+// Size-classed pool of float32 staging buffers. Operands that are not
+// row-major contiguous are packed into temporary buffers before a device
+// call; recycling those buffers through an engine-owned pool keeps
+// training loops that repeatedly hit the same shapes from churning the
+// garbage collector.
+
+package mps
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultMaxPoolBytes is the default cap on the bytes an engine's staging
+// pool keeps for reuse.
+const defaultMaxPoolBytes = 64 << 20
+
+// numSizeClasses covers every power-of-two buffer length an int can hold.
+const numSizeClasses = bits.UintSize
+
+// PoolStats describes an engine's staging buffer pool.
+type PoolStats struct {
+	// Hits and Misses count staging buffer requests served from the pool
+	// and by a fresh allocation, respectively.
+	Hits, Misses uint64
+
+	// BytesInUse is the size of the buffers currently handed out.
+	BytesInUse int64
+
+	// BytesRetained is the size of the idle buffers kept for reuse. It
+	// never exceeds the cap set with WithMaxPoolBytes.
+	BytesRetained int64
+}
+
+// stagingPool recycles float32 buffers by power-of-two size class. A
+// buffer of class c has capacity 1<<c; get rounds requests up to their
+// class so that any retained buffer of that class can serve them.
+//
+// The zero value is not usable; see newStagingPool. A stagingPool is safe
+// for concurrent use.
+type stagingPool struct {
+	maxBytes int64
+
+	mu       sync.Mutex
+	free     [numSizeClasses][][]float32
+	retained int64
+
+	hits, misses atomic.Uint64
+	inUse        atomic.Int64
+}
+
+func newStagingPool(maxBytes int64) *stagingPool {
+	return &stagingPool{maxBytes: maxBytes}
+}
+
+// sizeClass returns the smallest c with 1<<c >= n.
+func sizeClass(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// get returns a buffer of length n. Its contents are unspecified. Return
+// it with put once it is no longer referenced.
+func (p *stagingPool) get(n int) []float32 {
+	c := sizeClass(n)
+	p.mu.Lock()
+	if k := len(p.free[c]); k > 0 {
+		buf := p.free[c][k-1]
+		p.free[c][k-1] = nil
+		p.free[c] = p.free[c][:k-1]
+		p.retained -= bufBytes(buf)
+		p.mu.Unlock()
+
+		p.hits.Add(1)
+		p.inUse.Add(bufBytes(buf))
+		return buf[:n]
+	}
+	p.mu.Unlock()
+
+	buf := make([]float32, n, 1<<c)
+	p.misses.Add(1)
+	p.inUse.Add(bufBytes(buf))
+	return buf
+}
+
+// put hands a buffer obtained from get back to the pool, which keeps it
+// for reuse unless that would exceed the pool's byte cap.
+func (p *stagingPool) put(buf []float32) {
+	size := bufBytes(buf)
+	p.inUse.Add(-size)
+
+	c := sizeClass(cap(buf))
+	if cap(buf) != 1<<c {
+		// Not one of ours; let the GC have it.
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retained+size > p.maxBytes {
+		return
+	}
+	p.free[c] = append(p.free[c], buf[:cap(buf)])
+	p.retained += size
+}
+
+func (p *stagingPool) stats() PoolStats {
+	p.mu.Lock()
+	retained := p.retained
+	p.mu.Unlock()
+	return PoolStats{
+		Hits:          p.hits.Load(),
+		Misses:        p.misses.Load(),
+		BytesInUse:    p.inUse.Load(),
+		BytesRetained: retained,
+	}
+}
+
+// resetCounters zeroes the hit and miss counters. The byte gauges
+// describe live buffers and are left alone.
+func (p *stagingPool) resetCounters() {
+	p.hits.Store(0)
+	p.misses.Store(0)
+}
+
+// bufBytes is the size of buf's backing array in bytes.
+func bufBytes(buf []float32) int64 {
+	return int64(cap(buf)) * 4
+}
+
+// WithMaxPoolBytes caps the bytes of idle staging buffers the engine
+// keeps for reuse (64 MiB by default). Buffers returned while the pool is
+// full are left to the garbage collector; 0 disables pooling.
+func WithMaxPoolBytes(n int64) Option {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxPoolBytes = n
+	}
+}
@@ -0,0 +1,129 @@
+package mps
+
+import (
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+func TestSizeClass(t *testing.T) {
+	cases := []struct{ n, want int }{
+		{0, 0}, {1, 0}, {2, 1}, {3, 2}, {4, 2}, {5, 3}, {1024, 10}, {1025, 11},
+	}
+	for _, tc := range cases {
+		if got := sizeClass(tc.n); got != tc.want {
+			t.Fatalf("sizeClass(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestStagingPoolReuse(t *testing.T) {
+	p := newStagingPool(1 << 20)
+
+	a := p.get(100)
+	if len(a) != 100 || cap(a) != 128 {
+		t.Fatalf("get(100): len %d cap %d, want 100 and 128", len(a), cap(a))
+	}
+	if st := p.stats(); st.Misses != 1 || st.BytesInUse != 128*4 {
+		t.Fatalf("after get: %+v", st)
+	}
+	p.put(a)
+	if st := p.stats(); st.BytesInUse != 0 || st.BytesRetained != 128*4 {
+		t.Fatalf("after put: %+v", st)
+	}
+
+	// Any request in the same size class is served by the retained buffer.
+	b := p.get(120)
+	if len(b) != 120 || &b[0] != &a[0] {
+		t.Fatalf("get(120) did not reuse the retained buffer")
+	}
+	p.get(300)
+	if st := p.stats(); st.Hits != 1 || st.Misses != 2 || st.BytesRetained != 0 || st.BytesInUse != (128+512)*4 {
+		t.Fatalf("after reuse: %+v", st)
+	}
+
+	p.resetCounters()
+	if st := p.stats(); st.Hits != 0 || st.Misses != 0 || st.BytesInUse == 0 {
+		t.Fatalf("resetCounters must clear only the counters: %+v", st)
+	}
+}
+
+func TestStagingPoolCap(t *testing.T) {
+	p := newStagingPool(512 * 4)
+	a, b := p.get(512), p.get(512)
+	p.put(a)
+	p.put(b)
+	if st := p.stats(); st.BytesRetained != 512*4 || st.BytesInUse != 0 {
+		t.Fatalf("cap not enforced: %+v", st)
+	}
+
+	off := newStagingPool(0)
+	off.put(off.get(8))
+	off.get(8)
+	if st := off.stats(); st.Hits != 0 || st.BytesRetained != 0 {
+		t.Fatalf("disabled pool retained a buffer: %+v", st)
+	}
+}
+
+// Test that repeated MatMuls on sliced views recycle their staging
+// buffers and return all of them to the pool.
+func TestMatMulStagingUsesPool(t *testing.T) {
+	r := rand.New(rand.NewSource(31))
+	e := newRefEngine(t)
+
+	for i := 0; i < 3; i++ {
+		a, b := slicedView(t, 6, 5, r), slicedView(t, 5, 4, r)
+		if err := e.MatMul(a, b, slicedView(t, 6, 4, r)); err != nil {
+			t.Fatalf("MatMul error: %v", err)
+		}
+	}
+
+	st := e.Stats()
+	if st.Ops[OpMatMul].Accelerated != 3 {
+		t.Fatalf("MatMul not accelerated: %+v", st.Ops[OpMatMul])
+	}
+	// Three staging buffers (A, B and C) per call, all but the first
+	// call's served from the pool.
+	if st.Pool.Misses != 3 || st.Pool.Hits != 6 {
+		t.Fatalf("unexpected pool stats %+v", st.Pool)
+	}
+	if st.Pool.BytesInUse != 0 || st.Pool.BytesRetained == 0 {
+		t.Fatalf("staging buffers not returned to the pool: %+v", st.Pool)
+	}
+}
+
+// BenchmarkMatMulStaged measures a MatMul on sliced views with and
+// without the staging pool; run with -benchmem to compare allocations.
+func BenchmarkMatMulStaged(b *testing.B) {
+	const n = 64
+	for _, bc := range []struct {
+		name     string
+		maxBytes int64
+	}{
+		{"pooled", defaultMaxPoolBytes},
+		{"unpooled", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			r := rand.New(rand.NewSource(32))
+			x, err := randomDenseF32(r, n, n+1).Slice(nil, tensor.S(1, n+1))
+			if err != nil {
+				b.Fatal(err)
+			}
+			y, err := randomDenseF32(r, n, n+1).Slice(nil, tensor.S(0, n))
+			if err != nil {
+				b.Fatal(err)
+			}
+			c := newZeroFloat32Matrix(n, n)
+
+			e := newRefEngine(b, WithMaxPoolBytes(bc.maxBytes))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := e.MatMul(x, y, c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
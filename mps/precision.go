@@ -0,0 +1,286 @@
+// precision.go
+//
+// Precision policies for matrix products. Standard products multiply and
+// accumulate in float32; fast ones let the device round the operands to
+// float16; compensated ones split the inner dimension into blocks whose
+// float32 partial products are summed in float64, so that rounding error
+// grows with the block length rather than with K. The splitting, the
+// reference rounding and the error measurements are plain Go, so they
+// behave identically on every platform.
+
+package mps
+
+import (
+	"fmt"
+	"math"
+
+	"gorgonia.org/tensor"
+)
+
+// Precision selects how a matrix product trades accuracy for speed.
+type Precision int
+
+const (
+	// PrecisionStandard multiplies and accumulates in float32. It is
+	// the default.
+	PrecisionStandard Precision = iota
+	// PrecisionFast lets the device round the operands to float16 before
+	// multiplying, accumulating in float32. Backends that cannot, and
+	// the CPU, compute standard products instead.
+	PrecisionFast
+	// PrecisionCompensated computes the product in blocks of
+	// compensatedBlock along the inner dimension, each in float32 on the
+	// device, and accumulates the blocks in float64. Fallbacks compute
+	// the whole product in float64. It costs an extra pass over the
+	// output per block.
+	PrecisionCompensated
+
+	numPrecisions
+)
+
+var precisionNames = [numPrecisions]string{
+	PrecisionStandard:    "standard",
+	PrecisionFast:        "fast",
+	PrecisionCompensated: "compensated",
+}
+
+func (p Precision) valid() bool { return p >= 0 && p < numPrecisions }
+
+func (p Precision) String() string {
+	if !p.valid() {
+		return fmt.Sprintf("Precision(%d)", int(p))
+	}
+	return precisionNames[p]
+}
+
+// compensatedBlock is the length of the blocks of the inner dimension
+// whose partial products PrecisionCompensated computes in float32.
+const compensatedBlock = 256
+
+// WithPrecision sets the precision policy of MatMul, Gemm and Linear.
+// MatMulPrecision overrides it per call. Unknown policies are ignored.
+func WithPrecision(p Precision) Option {
+	return func(c *config) {
+		if !p.valid() {
+			return
+		}
+		c.precision = p
+	}
+}
+
+// MatMulPrecision is MatMul with the precision policy prec instead of
+// the engine's (see WithPrecision).
+func (e *MPSEng) MatMulPrecision(a, b tensor.Tensor, prec Precision, prealloc tensor.Tensor) error {
+	if !prec.valid() {
+		return fmt.Errorf("mps: MatMul with unknown precision %v", prec)
+	}
+	return e.matMul(a, b, prec, prealloc)
+}
+
+// compensatedGemm computes g in blocks of compensatedBlock along k: run
+// computes each block's float32 product, and the blocks are summed in
+// float64, to which alpha, beta and the epilogue are applied. g.c is
+// only written once every block succeeded.
+func (e *MPSEng) compensatedGemm(g gemmArgs, run func(gemmArgs) FallbackReason) FallbackReason {
+	m, n, k := g.m, g.n, g.k
+	kb := min(k, compensatedBlock)
+
+	// Element strides (row, column) of the operands as stored.
+	ar, ac := k, 1
+	if g.transA {
+		ar, ac = 1, m
+	}
+	br, bc := n, 1
+	if g.transB {
+		br, bc = 1, k
+	}
+
+	atile := e.pool.get(m * kb)
+	defer e.pool.put(atile)
+	btile := e.pool.get(kb * n)
+	defer e.pool.put(btile)
+	part := e.pool.get(m * n)
+	defer e.pool.put(part)
+
+	acc := make([]float64, m*n)
+	for p0 := 0; p0 < k; p0 += kb {
+		kp := min(kb, k-p0)
+		a, b := atile[:m*kp], btile[:kp*n]
+		gatherStrided(a, g.a[p0*ac:], m, kp, ar, ac)
+		gatherStrided(b, g.b[p0*br:], kp, n, br, bc)
+		if reason := run(gemmArgs{a: a, b: b, c: part, m: m, n: n, k: kp, alpha: 1}); reason != ReasonNone {
+			return reason
+		}
+		for i, v := range part {
+			acc[i] += float64(v)
+		}
+	}
+
+	alpha, beta := float64(g.alpha), float64(g.beta)
+	for i := 0; i < m; i++ {
+		row := g.c[i*n : (i+1)*n]
+		for j := range row {
+			v := alpha * acc[i*n+j]
+			if beta != 0 {
+				v += beta * float64(row[j])
+			}
+			row[j] = float32(v)
+		}
+		if g.bias != nil || g.act != ActNone {
+			epilogueRowF32(row, g.bias, g.act)
+		}
+	}
+	return ReasonNone
+}
+
+// roundToHalf rounds x to the nearest float16 value, ties to even, as
+// PrecisionFast does to the operands on the device. Values beyond the
+// float16 range become infinities; NaNs stay NaN.
+func roundToHalf(x float32) float32 {
+	v := float64(x)
+	if v == 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return x
+	}
+	// float16 has 10 fraction bits and a smallest exponent of -14, below
+	// which values are subnormal with a fixed quantum of 2^-24.
+	_, exp := math.Frexp(math.Abs(v))
+	q := math.Ldexp(1, max(exp-11, -24))
+	r := math.RoundToEven(v/q) * q
+	if math.Abs(r) > 65504 {
+		return float32(math.Copysign(math.Inf(1), v))
+	}
+	return float32(r)
+}
+
+// roundedToHalf returns a copy of xs with every value rounded by
+// roundToHalf.
+func roundedToHalf(xs []float32) []float32 {
+	out := make([]float32, len(xs))
+	for i, x := range xs {
+		out[i] = roundToHalf(x)
+	}
+	return out
+}
+
+// widenedMatMuler computes float32 products with the float64 MatMul of
+// the wrapped engine and rounds the result, for PrecisionCompensated
+// fallbacks. Other products go to the wrapped engine unchanged.
+type widenedMatMuler struct {
+	tensor.MatMuler
+}
+
+func (w widenedMatMuler) MatMul(a, b, prealloc tensor.Tensor) error {
+	da, okA := a.(*tensor.Dense)
+	db, okB := b.(*tensor.Dense)
+	dc, okC := prealloc.(*tensor.Dense)
+	if !okA || !okB || !okC || da.Dims() != 2 || db.Dims() != 2 ||
+		da.Dtype() != tensor.Float32 || db.Dtype() != tensor.Float32 || dc.Dtype() != tensor.Float32 {
+		return w.MatMuler.MatMul(a, b, prealloc)
+	}
+	a64, err := widenF32(da)
+	if err != nil {
+		return err
+	}
+	b64, err := widenF32(db)
+	if err != nil {
+		return err
+	}
+	c64 := tensor.New(tensor.WithShape(da.Shape()[0], db.Shape()[1]), tensor.Of(tensor.Float64))
+	if err := w.MatMuler.MatMul(a64, b64, c64); err != nil {
+		return err
+	}
+	// Temporaries are read with their typed accessors: Data does not keep
+	// a tensor alive while it builds the slice.
+	out := make([]float32, c64.Shape().TotalSize())
+	for i, v := range c64.Float64s() {
+		out[i] = float32(v)
+	}
+	return scatterF32(out, dc, dc.Data().([]float32))
+}
+
+// widenF32 returns a row-major float64 copy of the float32 matrix d.
+func widenF32(d *tensor.Dense) (*tensor.Dense, error) {
+	buf := make([]float32, d.Shape().TotalSize())
+	if err := gatherF32(buf, d, d.Data().([]float32)); err != nil {
+		return nil, err
+	}
+	wide := make([]float64, len(buf))
+	for i, v := range buf {
+		wide[i] = float64(v)
+	}
+	return tensor.New(tensor.WithShape(d.Shape().Clone()...), tensor.WithBacking(wide)), nil
+}
+
+// ErrorStats measures how far a float32 product is from its float64
+// reference.
+type ErrorStats struct {
+	// MaxAbs is the largest absolute error of an element.
+	MaxAbs float64
+	// RMS is the root mean square of the elements' errors.
+	RMS float64
+	// Rel is the norm of the error relative to the norm of the
+	// reference (Frobenius), 0 if the reference is all zeros.
+	Rel float64
+}
+
+// MeasurePrecision computes a x b under every Precision, as
+// MatMulPrecision calls counted in Stats, and returns the error of each
+// against a float64 product of the same operands. a and b must be 2D
+// float32 tensors. Use it on representative operands to choose a
+// policy.
+func (e *MPSEng) MeasurePrecision(a, b tensor.Tensor) (map[Precision]ErrorStats, error) {
+	da, okA := a.(*tensor.Dense)
+	db, okB := b.(*tensor.Dense)
+	if !okA || !okB || da.Dtype() != tensor.Float32 || db.Dtype() != tensor.Float32 {
+		return nil, fmt.Errorf("mps: MeasurePrecision requires float32 *tensor.Dense operands, got %T and %T", a, b)
+	}
+	if da.Dims() != 2 || db.Dims() != 2 || da.Shape()[1] != db.Shape()[0] {
+		return nil, fmt.Errorf("mps: MeasurePrecision requires matrices with matching inner dimensions, got a=%v, b=%v", da.Shape(), db.Shape())
+	}
+	m, n := da.Shape()[0], db.Shape()[1]
+
+	a64, err := widenF32(da)
+	if err != nil {
+		return nil, err
+	}
+	b64, err := widenF32(db)
+	if err != nil {
+		return nil, err
+	}
+	ref := tensor.New(tensor.WithShape(m, n), tensor.Of(tensor.Float64))
+	if m*n > 0 && da.Shape()[1] > 0 {
+		if err := e.StdEng.MatMul(a64, b64, ref); err != nil {
+			return nil, fmt.Errorf("mps: MeasurePrecision reference product: %w", err)
+		}
+	}
+	want := ref.Float64s()
+
+	out := make(map[Precision]ErrorStats, numPrecisions)
+	for prec := Precision(0); prec < numPrecisions; prec++ {
+		c := tensor.New(tensor.WithShape(m, n), tensor.Of(tensor.Float32))
+		if err := e.MatMulPrecision(a, b, prec, c); err != nil {
+			return nil, err
+		}
+		out[prec] = errorStats(c.Float32s(), want)
+	}
+	return out, nil
+}
+
+// errorStats compares got with its reference want.
+func errorStats(got []float32, want []float64) ErrorStats {
+	var s ErrorStats
+	var sumSq, refSq float64
+	for i, w := range want {
+		d := math.Abs(float64(got[i]) - w)
+		s.MaxAbs = max(s.MaxAbs, d)
+		sumSq += d * d
+		refSq += w * w
+	}
+	if len(want) > 0 {
+		s.RMS = math.Sqrt(sumSq / float64(len(want)))
+	}
+	if refSq > 0 {
+		s.Rel = math.Sqrt(sumSq / refSq)
+	}
+	return s
+}
@@ -0,0 +1,197 @@
+package mps
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+func TestRoundToHalf(t *testing.T) {
+	cases := []struct{ in, want float32 }{
+		{1, 1},
+		{-2.5, -2.5},
+		{1 + 1.0/2048, 1},            // tie, to even
+		{1 + 3.0/2048, 1 + 4.0/2048}, // tie, to even
+		{1 + 1.0/2048 + 1e-6, 1 + 1.0/1024},
+		{0.1, 0.0999755859375},
+		{65504, 65504},
+		{65519, 65504},
+		{65520, float32(math.Inf(1))},
+		{-1e6, float32(math.Inf(-1))},
+		{1.0 / (1 << 24), 1.0 / (1 << 24)}, // smallest subnormal
+		{1.0 / (1 << 25), 0},               // tie, to even
+		{0.75 / (1 << 24), 1.0 / (1 << 24)},
+		{1.5 / (1 << 14), 1.5 / (1 << 14)}, // smallest normal exponent
+	}
+	for _, tc := range cases {
+		if got := roundToHalf(tc.in); got != tc.want {
+			t.Errorf("roundToHalf(%g) = %g, want %g", tc.in, got, tc.want)
+		}
+	}
+	if got := roundToHalf(float32(math.NaN())); !math.IsNaN(float64(got)) {
+		t.Errorf("roundToHalf(NaN) = %g", got)
+	}
+
+	// Rounding is idempotent and within half a float16 ulp.
+	r := rand.New(rand.NewSource(81))
+	for i := 0; i < 10000; i++ {
+		x := float32(r.NormFloat64() * math.Pow(2, float64(r.Intn(40)-25)))
+		h := roundToHalf(x)
+		if roundToHalf(h) != h {
+			t.Fatalf("roundToHalf(%g) = %g is not a float16 value", x, h)
+		}
+		_, exp := math.Frexp(math.Abs(float64(x)))
+		if ulp := math.Ldexp(1, max(exp-11, -24)); math.Abs(float64(h-x)) > ulp/2 {
+			t.Fatalf("roundToHalf(%g) = %g is more than half an ulp (%g) off", x, h, ulp)
+		}
+	}
+}
+
+// longDot returns operands whose product has a long inner dimension of
+// positive terms, on which float32 accumulation error grows with k.
+func longDot(r *rand.Rand, m, n, k int) (*tensor.Dense, *tensor.Dense) {
+	a, b := make([]float32, m*k), make([]float32, k*n)
+	for i := range a {
+		a[i] = r.Float32()
+	}
+	for i := range b {
+		b[i] = r.Float32()
+	}
+	return tensor.New(tensor.WithShape(m, k), tensor.WithBacking(a)), tensor.New(tensor.WithShape(k, n), tensor.WithBacking(b))
+}
+
+// Test the measured error of every policy on a long inner dimension, on
+// the device and through the fallback.
+func TestMeasurePrecision(t *testing.T) {
+	a, b := longDot(rand.New(rand.NewSource(82)), 4, 3, 20000)
+
+	e := newRefEngine(t)
+	errs, err := e.MeasurePrecision(a, b)
+	if err != nil {
+		t.Fatalf("MeasurePrecision error: %v", err)
+	}
+	std, fast, comp := errs[PrecisionStandard], errs[PrecisionFast], errs[PrecisionCompensated]
+	if comp.Rel*10 > std.Rel || std.Rel > fast.Rel || comp.Rel > 1e-6 {
+		t.Fatalf("unexpected device errors: standard %+v, fast %+v, compensated %+v", std, fast, comp)
+	}
+	if comp.MaxAbs > comp.RMS*math.Sqrt(12) || comp.RMS > comp.MaxAbs {
+		t.Fatalf("inconsistent error stats %+v", comp)
+	}
+	if st := e.Stats().Ops[OpMatMul]; st.Accelerated != uint64(numPrecisions) {
+		t.Fatalf("expected %d accelerated products: %+v", numPrecisions, st)
+	}
+
+	// The fallback computes compensated products in float64, and has no
+	// reduced precision.
+	e = NewMPSEng(WithOpEnabled(OpMatMul, false))
+	defer e.Close()
+	errs, err = e.MeasurePrecision(a, b)
+	if err != nil {
+		t.Fatalf("fallback MeasurePrecision error: %v", err)
+	}
+	if errs[PrecisionFast] != errs[PrecisionStandard] || errs[PrecisionCompensated].Rel > 1e-7 {
+		t.Fatalf("unexpected fallback errors: %+v", errs)
+	}
+
+	if _, err := e.MeasurePrecision(a, a); err == nil {
+		t.Fatalf("MeasurePrecision accepted mismatched shapes")
+	}
+}
+
+// Test compensated products against float64 references with every
+// feature of the product: transposed and sliced operands, alpha, beta
+// and the Linear epilogue, on the device whole and tiled, on sgemm and
+// through the fallback.
+func TestCompensatedParity(t *testing.T) {
+	r := rand.New(rand.NewSource(83))
+	const m, k, n = 9, 700, 6
+	engines := []struct {
+		name string
+		opts []Option
+	}{
+		{"device", []Option{withBackend(newRefBackend())}},
+		{"tiled", []Option{withBackend(newRefBackend()), WithMaxBufferBytes(64 * 4)}},
+		{"sgemm", []Option{withStdEngSIMD(false), WithCPUGEMM(true), WithOpEnabled(OpMatMul, false), WithOpEnabled(OpLinear, false)}},
+		{"fallback", []Option{WithOpEnabled(OpMatMul, false), WithOpEnabled(OpLinear, false)}},
+	}
+	for _, eng := range engines {
+		e := NewMPSEng(append([]Option{WithMinFLOPs(0), WithPrecision(PrecisionCompensated)}, eng.opts...)...)
+
+		a, b := transposedView(t, m, k, r), slicedView(t, k, n, r)
+		ab := naiveMatMul(t, a, b)
+
+		c := newRandomFloat32Matrix(t, m, n, r)
+		want := make([]float32, m*n)
+		for i, v := range denseValues(t, c) {
+			want[i] = float32(0.5*ab[i] + 2*float64(v))
+		}
+		if err := e.Gemm(0.5, a, b, 2, c); err != nil {
+			t.Fatalf("%s: Gemm error: %v", eng.name, err)
+		}
+		if got := denseValues(t, c); !equalApprox(got, want, 1e-4) {
+			t.Fatalf("%s: compensated Gemm differs from float64\n got:  %v\n want: %v", eng.name, got, want)
+		}
+
+		bias := randomF32(r, n)
+		out := newZeroFloat32Matrix(m, n)
+		for i := range want {
+			want[i] = float32(ab[i])
+		}
+		for i := 0; i < m; i++ {
+			epilogueRowF32(want[i*n:(i+1)*n], extractFloat32Backing(t, bias), ActReLU)
+		}
+		if err := e.Linear(a, b, bias, ActReLU, out); err != nil {
+			t.Fatalf("%s: Linear error: %v", eng.name, err)
+		}
+		if got := denseValues(t, out); !equalApprox(got, want, 1e-4) {
+			t.Fatalf("%s: compensated Linear differs from float64\n got:  %v\n want: %v", eng.name, got, want)
+		}
+		if st := e.Stats().Pool; st.BytesInUse != 0 {
+			t.Fatalf("%s: %d pool bytes still in use", eng.name, st.BytesInUse)
+		}
+		e.Close()
+	}
+}
+
+// Test that the engine's policy applies to MatMul and that
+// MatMulPrecision overrides it.
+func TestPrecisionPolicy(t *testing.T) {
+	a, b := longDot(rand.New(rand.NewSource(84)), 3, 2, 3000)
+	product := func(e *MPSEng, prec Precision, perCall bool) []float32 {
+		t.Helper()
+		c := newZeroFloat32Matrix(3, 2)
+		var err error
+		if perCall {
+			err = e.MatMulPrecision(a, b, prec, c)
+		} else {
+			err = e.MatMul(a, b, c)
+		}
+		if err != nil {
+			t.Fatalf("%v: MatMul error: %v", prec, err)
+		}
+		return extractFloat32Backing(t, c)
+	}
+
+	e := newRefEngine(t)
+	for prec := Precision(0); prec < numPrecisions; prec++ {
+		pe := newRefEngine(t, WithPrecision(prec))
+		if got, want := product(pe, 0, false), product(e, prec, true); !equalApprox(got, want, 0) {
+			t.Fatalf("%v: engine policy %v differs from per-call %v", prec, got, want)
+		}
+		if got, want := product(pe, PrecisionStandard, true), product(e, PrecisionStandard, false); !equalApprox(got, want, 0) {
+			t.Fatalf("%v: MatMulPrecision did not override the engine policy", prec)
+		}
+	}
+	if got, want := product(e, PrecisionFast, true), product(e, PrecisionStandard, true); equalApprox(got, want, 0) {
+		t.Fatalf("fast product equals the standard one")
+	}
+
+	if err := e.MatMulPrecision(a, b, Precision(7), newZeroFloat32Matrix(3, 2)); err == nil {
+		t.Fatalf("MatMulPrecision accepted an unknown precision")
+	}
+	if newRefEngine(t, WithPrecision(-1)).cfg.precision != PrecisionStandard {
+		t.Fatalf("WithPrecision accepted an unknown precision")
+	}
+}
@@ -0,0 +1,140 @@
+// profile.go
+//
+// Persisted tuning profiles. A TuningProfile captures the per-op
+// dispatch thresholds of an engine (typically after Calibrate) together
+// with the device they were measured on, so that production binaries can
+// ship thresholds tuned ahead of time instead of calibrating on start.
+
+package mps
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version identifies this release of the package. It is recorded in
+// tuning profiles for diagnostics.
+const Version = "v0.1.0"
+
+// ProfileSchemaVersion is the tuning profile format written by this
+// package. LoadProfile rejects profiles with any other schema version.
+const ProfileSchemaVersion = 1
+
+// noDeviceName is the device name reported on platforms without Metal.
+const noDeviceName = "none"
+
+var (
+	// ErrProfileSchema is returned by LoadProfile for profiles written in
+	// an incompatible schema version.
+	ErrProfileSchema = errors.New("mps: incompatible tuning profile schema")
+
+	// ErrProfileDevice is returned by LoadProfile for profiles tuned on a
+	// different device.
+	ErrProfileDevice = errors.New("mps: tuning profile is for a different device")
+)
+
+// TuningProfile is the JSON-serializable form of an engine's dispatch
+// thresholds.
+type TuningProfile struct {
+	SchemaVersion  int              `json:"schema_version"`
+	Device         string           `json:"device"`
+	PackageVersion string           `json:"package_version"`
+	Thresholds     map[Op]Threshold `json:"thresholds"`
+}
+
+// Profile returns a tuning profile holding the engine's current
+// thresholds, ready to be saved with Save.
+func (e *MPSEng) Profile() *TuningProfile {
+	return &TuningProfile{
+		SchemaVersion:  ProfileSchemaVersion,
+		Device:         e.deviceName(),
+		PackageVersion: Version,
+		Thresholds:     e.Thresholds(),
+	}
+}
+
+// Save writes p to w as indented JSON.
+func (p *TuningProfile) Save(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p); err != nil {
+		return fmt.Errorf("mps: saving tuning profile: %w", err)
+	}
+	return nil
+}
+
+// LoadProfile reads a tuning profile written by Save and checks that it
+// is usable here: the schema version must be ProfileSchemaVersion and the
+// device must be the platform's default device, which engines created by
+// NewMPSEng run on. Thresholds of ops this package does not know, such
+// as those of a later release, are skipped. Pass the result to NewMPSEng
+// with WithProfile.
+func LoadProfile(r io.Reader) (*TuningProfile, error) {
+	return loadProfile(r, defaultDeviceName())
+}
+
+// loadProfile is LoadProfile against an explicit device name.
+func loadProfile(r io.Reader, device string) (*TuningProfile, error) {
+	// Thresholds are decoded by name, which shadows the map keyed by Op,
+	// so that unknown names can be skipped rather than fail the decoding.
+	var raw struct {
+		TuningProfile
+		Thresholds map[string]Threshold `json:"thresholds"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("mps: loading tuning profile: %w", err)
+	}
+	p := raw.TuningProfile
+	p.Thresholds = make(map[Op]Threshold, len(raw.Thresholds))
+	for name, t := range raw.Thresholds {
+		var op Op
+		if op.UnmarshalText([]byte(name)) == nil {
+			p.Thresholds[op] = t
+		}
+	}
+	if p.SchemaVersion != ProfileSchemaVersion {
+		return nil, fmt.Errorf("%w: got version %d, want %d", ErrProfileSchema, p.SchemaVersion, ProfileSchemaVersion)
+	}
+	if p.Device != device {
+		return nil, fmt.Errorf("%w: profile is for %q, running on %q", ErrProfileDevice, p.Device, device)
+	}
+	return &p, nil
+}
+
+// WithProfile applies the thresholds of a tuning profile obtained from
+// LoadProfile. Ops missing from the profile keep their thresholds; a nil
+// profile is ignored.
+func WithProfile(p *TuningProfile) Option {
+	return func(c *config) {
+		if p == nil {
+			return
+		}
+		for op, t := range p.Thresholds {
+			if op.valid() {
+				c.thresholds[op] = t
+			}
+		}
+	}
+}
+
+// MarshalText encodes op by name, so that ops read naturally as JSON map
+// keys in tuning profiles.
+func (op Op) MarshalText() ([]byte, error) {
+	if !op.valid() {
+		return nil, fmt.Errorf("mps: cannot marshal unknown %v", op)
+	}
+	return []byte(op.String()), nil
+}
+
+// UnmarshalText decodes an op name written by MarshalText.
+func (op *Op) UnmarshalText(text []byte) error {
+	for o := Op(0); o < numOps; o++ {
+		if opNames[o] == string(text) {
+			*op = o
+			return nil
+		}
+	}
+	return fmt.Errorf("mps: unknown op %q", text)
+}
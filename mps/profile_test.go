@@ -0,0 +1,103 @@
+package mps
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTuningProfileRoundTrip(t *testing.T) {
+	want := map[Op]Threshold{
+		OpMatMul: {MinFLOPs: 123456, MinBytes: 789},
+		OpSum:    Never,
+	}
+	src := NewMPSEng(WithThreshold(OpMatMul, want[OpMatMul]), WithThreshold(OpSum, want[OpSum]))
+	defer src.Close()
+
+	var buf bytes.Buffer
+	if err := src.Profile().Save(&buf); err != nil {
+		t.Fatalf("Save error: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"MatMul"`) {
+		t.Fatalf("profile should key thresholds by op name:\n%s", buf.String())
+	}
+
+	p, err := LoadProfile(&buf)
+	if err != nil {
+		t.Fatalf("LoadProfile error: %v", err)
+	}
+	if p.SchemaVersion != ProfileSchemaVersion || p.PackageVersion != Version || p.Device != defaultDeviceName() {
+		t.Fatalf("unexpected profile header: %+v", p)
+	}
+
+	dst := NewMPSEng(WithProfile(p))
+	defer dst.Close()
+	got := dst.Thresholds()
+	for op, th := range want {
+		if got[op] != th {
+			t.Fatalf("%v threshold = %+v, want %+v", op, got[op], th)
+		}
+	}
+}
+
+func TestLoadProfileValidation(t *testing.T) {
+	cases := []struct {
+		name    string
+		json    string
+		wantErr error
+	}{
+		{
+			name: "ok",
+			json: `{"schema_version":1,"device":"Apple M2","thresholds":{"Sum":{"min_flops":5}}}`,
+		},
+		{
+			name: "unknown op",
+			json: `{"schema_version":1,"device":"Apple M2","thresholds":{"Conv":{"min_flops":7},"Sum":{"min_flops":5}}}`,
+		},
+		{
+			name:    "other device",
+			json:    `{"schema_version":1,"device":"Apple M1","thresholds":{}}`,
+			wantErr: ErrProfileDevice,
+		},
+		{
+			name:    "newer schema",
+			json:    `{"schema_version":2,"device":"Apple M2","thresholds":{}}`,
+			wantErr: ErrProfileSchema,
+		},
+		{
+			name:    "missing schema",
+			json:    `{"device":"Apple M2"}`,
+			wantErr: ErrProfileSchema,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := loadProfile(strings.NewReader(tc.json), "Apple M2")
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(p.Thresholds) != 1 || p.Thresholds[OpSum].MinFLOPs != 5 {
+					t.Fatalf("unexpected thresholds: %+v", p.Thresholds)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err := loadProfile(strings.NewReader(`not json`), "Apple M2"); err == nil {
+		t.Fatalf("expected error for invalid JSON")
+	}
+}
+
+func TestWithNilProfile(t *testing.T) {
+	e := NewMPSEng(WithProfile(nil))
+	defer e.Close()
+	if got := e.Thresholds()[OpMatMul]; got != defaultThresholds[OpMatMul] {
+		t.Fatalf("nil profile changed thresholds: %+v", got)
+	}
+}
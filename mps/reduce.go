@@ -0,0 +1,404 @@
+// reduce.go
+//
+// Platform-independent reductions for MPSEng: Sum, Max, Min, Prod and
+// Mean share planning, the axis-reduction kernels of the engine's
+// backend and fallback. Reductions never write to their input: the
+// result goes to a new tensor or, for SumOpts, to one supplied with
+// tensor.WithReuse. The KeepDims variants keep the reduced axes with
+// size 1, for results that broadcast back against their input.
+
+package mps
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"gorgonia.org/tensor"
+)
+
+// reduceOp selects how a reduction kernel combines elements. The values
+// are shared with the C bridge (see mps_reduce.h).
+type reduceOp int
+
+const (
+	reduceSum reduceOp = iota
+	reduceMax
+	reduceMin
+	reduceProd
+	reduceMaxLead
+	reduceMinLead
+
+	numReduceOps
+)
+
+func (op reduceOp) valid() bool { return op >= 0 && op < numReduceOps }
+
+// identity is the result of reducing no elements.
+func (op reduceOp) identity() float32 {
+	switch op {
+	case reduceMax, reduceMaxLead:
+		return float32(math.Inf(-1))
+	case reduceMin, reduceMinLead:
+		return float32(math.Inf(1))
+	case reduceProd:
+		return 1
+	}
+	return 0
+}
+
+// combine folds v, the next element, into the partial result acc, in
+// order from the first element, as StdEng's Max and Min do. A NaN
+// element becomes the maximum or minimum, and the element after it
+// replaces it, so that the result is the extreme of the elements after
+// the last NaN, or NaN if that is the last element. Along the leading
+// axis StdEng keeps a NaN first element and skips the other NaNs
+// instead, as reduceMaxLead and reduceMinLead do.
+func (op reduceOp) combine(acc, v float32) float32 {
+	switch op {
+	case reduceMax:
+		if acc > v {
+			return acc
+		}
+		return v
+	case reduceMin:
+		if acc < v {
+			return acc
+		}
+		return v
+	case reduceMaxLead:
+		if v > acc {
+			return v
+		}
+		return acc
+	case reduceMinLead:
+		if v < acc {
+			return v
+		}
+		return acc
+	case reduceProd:
+		return acc * v
+	}
+	return acc + v
+}
+
+// lead returns the op reducing an axis that StdEng reduces as the
+// leading one of what remains of the tensor.
+func (op reduceOp) lead() reduceOp {
+	switch op {
+	case reduceMax:
+		return reduceMaxLead
+	case reduceMin:
+		return reduceMinLead
+	}
+	return op
+}
+
+// better reports whether v displaces best as the maximum (reduceMax) or
+// minimum (reduceMin) that Argmax and Argmin look for, scanning in order
+// from the first element as StdEng does. Ties go to the first extreme,
+// and only an element that ends the scan displaces a NaN first element.
+func (op reduceOp) better(v, best float32) bool {
+	if op == reduceMin {
+		return v < best
+	}
+	return v > best
+}
+
+// ends reports whether v, an element after the first, ends StdEng's scan
+// for the argument of the maximum (reduceMax) or minimum (reduceMin): a
+// NaN, or an infinity of the extreme's sign, is the argument as soon as
+// it comes.
+func (op reduceOp) ends(v float32) bool {
+	if op == reduceMin {
+		return v != v || math.IsInf(float64(v), -1)
+	}
+	return v != v || math.IsInf(float64(v), 1)
+}
+
+// reduceOps maps the reductions to the kernels computing them; Mean is a
+// sum divided afterwards, and Argmax and Argmin look for the extremes of
+// Max and Min.
+var reduceOps = map[Op]reduceOp{
+	OpSum:    reduceSum,
+	OpMean:   reduceSum,
+	OpMax:    reduceMax,
+	OpMin:    reduceMin,
+	OpProd:   reduceProd,
+	OpArgmax: reduceMax,
+	OpArgmin: reduceMin,
+}
+
+// Sum sums a over the axes along, accelerating float32 *tensor.Dense
+// tensors of any rank and layout reduced over any of their axes,
+// negative axes included, or over all of them when along is empty. The
+// reduction runs on the backend's reduction kernels (dedicated Metal
+// kernels on darwin), one pass per run of adjacent reduced axes. Other
+// inputs, and problems the engine's dispatch policy rejects, defer to
+// the configured fallback engine.
+//
+// a is left untouched, and the result is a new tensor shaped as
+// StdEng.Sum shapes it: a scalar for total sums. Use SumOpts to write it
+// into an existing one, and SumKeepDims to keep the reduced axes.
+func (e *MPSEng) Sum(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	return e.reduce(OpSum, a, along, false, nil)
+}
+
+// SumOpts computes Sum(a, along...), honoring the WithReuse function
+// option: WithReuse(reuse) writes the sum into reuse, which must have
+// the shape and dtype of the result, and returns it. Other options are
+// ignored.
+func (e *MPSEng) SumOpts(a tensor.Tensor, along []int, opts ...tensor.FuncOpt) (tensor.Tensor, error) {
+	return e.reduce(OpSum, a, along, false, tensor.ParseFuncOpts(opts...).Reuse())
+}
+
+// Max returns the maximum of a over the axes along. It accelerates and
+// falls back like Sum, and its result has the same shape.
+//
+// NaNs propagate as in StdEng.Max, which reduces one axis at a time,
+// outermost first, and treats them according to where they are. A total
+// maximum, or one along an axis that follows a kept axis, is that of the
+// elements after the last NaN, or NaN if that is the last element.
+// Along an axis that only reduced axes precede, a maximum is NaN if its
+// first element is, and ignores the other NaNs.
+func (e *MPSEng) Max(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	return e.reduce(OpMax, a, along, false, nil)
+}
+
+// Min returns the minimum of a over the axes along, like Max.
+func (e *MPSEng) Min(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	return e.reduce(OpMin, a, along, false, nil)
+}
+
+// Prod returns the product of a over the axes along. It accelerates like
+// Sum. StdEng has no Prod, so it falls back to the fallback engine's
+// Prod if it has one, and otherwise computes float32 products on the CPU
+// with the reference kernels; other fallbacks are errors.
+func (e *MPSEng) Prod(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	return e.reduce(OpProd, a, along, false, nil)
+}
+
+// Mean returns the mean of a over the axes along: its Sum divided by the
+// number of elements summed into each result. It accelerates like Sum,
+// and falls back to the fallback engine's Sum for float32 and float64
+// tensors.
+func (e *MPSEng) Mean(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	return e.reduce(OpMean, a, along, false, nil)
+}
+
+// SumKeepDims is Sum keeping the reduced axes with size 1, so that the
+// result broadcasts against a: summing a [rows, cols] tensor along 1
+// gives [rows, 1], and along no axes [1, 1].
+func (e *MPSEng) SumKeepDims(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	return e.reduce(OpSum, a, along, true, nil)
+}
+
+// ReduceKeepDims computes the reduction op, one of OpSum, OpMax, OpMin,
+// OpProd and OpMean, of a over along like the method of the same name,
+// keeping the reduced axes with size 1 like SumKeepDims. Fallbacks
+// reshape the fallback engine's result.
+func (e *MPSEng) ReduceKeepDims(op Op, a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	switch op {
+	case OpSum, OpMax, OpMin, OpProd, OpMean:
+	default:
+		return nil, fmt.Errorf("mps: %v is not a reduction", op)
+	}
+	return e.reduce(op, a, along, true, nil)
+}
+
+// reduce computes the reduction op of a over along into reuse, or into a
+// new tensor if reuse is nil, keeping the reduced axes if keepDims is
+// set.
+func (e *MPSEng) reduce(op Op, a tensor.Tensor, along []int, keepDims bool, reuse tensor.Tensor) (tensor.Tensor, error) {
+	if err := e.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	p, reason := e.planReduce(op, a, along, keepDims)
+	if reason != ReasonNone {
+		return e.fallbackReduce(reason, p, a, reuse)
+	}
+	out, err := e.reduceOutput(p, reuse)
+	if err != nil {
+		return nil, err
+	}
+	if reason := e.execReduce(p, out); reason != ReasonNone {
+		return e.fallbackReduce(reason, p, a, reuse)
+	}
+
+	e.stats.recordAccelerated(op)
+	return out, nil
+}
+
+// reduceOutput returns the float32 tensor that the planned reduction p
+// writes: reuse, once checked, or a new tensor using this engine.
+func (e *MPSEng) reduceOutput(p reducePlan, reuse tensor.Tensor) (*tensor.Dense, error) {
+	if reuse == nil {
+		return tensor.New(tensor.WithShape(p.shape.Clone()...), tensor.Of(tensor.Float32), tensor.WithEngine(e)), nil
+	}
+	d, ok := reuse.(*tensor.Dense)
+	if !ok || d.Dtype() != tensor.Float32 || !d.Shape().Eq(p.shape) {
+		return nil, fmt.Errorf("mps: %v reuse must be a float32 *tensor.Dense of shape %v, got %T %v of %v", p.op, p.shape, reuse, reuse.Shape(), reuse.Dtype())
+	}
+	return d, nil
+}
+
+// execReduce computes a planned reduction on the engine's backend, or on
+// the reference kernels if p is marked cpu, into out. It returns
+// ReasonNone on success, or the reason to fall back otherwise.
+//
+// Each reduced group of the plan takes one reduceAxisF32 pass,
+// outermost first as in StdEng, through staging buffers; the last pass
+// writes out directly when it is contiguous and separate from the input.
+// Inputs that are not row-major contiguous are gathered first. Means are
+// divided once the sums are complete.
+func (e *MPSEng) execReduce(p reducePlan, out *tensor.Dense) FallbackReason {
+	x := p.data
+	if !p.contiguous {
+		x = e.pool.get(p.a.Shape().TotalSize())
+		defer e.pool.put(x)
+		if err := gatherF32(x, p.a, p.data); err != nil {
+			return ReasonLayout
+		}
+	}
+
+	size := p.shape.TotalSize()
+	y := out.Float32s()
+	dst := y
+	direct := isRowMajorContiguous(out) && !sharesMemory(p.a, out)
+	if !direct {
+		dst = e.pool.get(size)
+		defer e.pool.put(dst)
+	}
+
+	last := len(p.reduce) - 1
+	for !p.reduce[last] {
+		last--
+	}
+	dims := slices.Clone(p.dims)
+	run := func(be backend) int {
+		src := x
+		for g, reduced := range p.reduce {
+			if !reduced {
+				continue
+			}
+			outer, inner := product(dims[:g]), product(dims[g+1:])
+			next := dst
+			if g != last {
+				next = e.pool.get(outer * inner)
+				defer e.pool.put(next)
+			}
+			op := reduceOps[p.op]
+			if p.lead[g] {
+				op = op.lead()
+			}
+			if status := be.reduceAxisF32(op, src, next[:outer*inner], outer, dims[g], inner); status != 0 {
+				return status
+			}
+			src = next
+			dims[g] = 1
+		}
+		return 0
+	}
+	var reason FallbackReason
+	if p.cpu {
+		if run(newRefBackend()) != 0 {
+			reason = ReasonDeviceError
+		}
+	} else {
+		reason = e.runBackend(run)
+	}
+	if reason != ReasonNone {
+		// GPU path failed – fall back to CPU.
+		return reason
+	}
+
+	if p.op == OpMean {
+		n := float32(p.count)
+		for i := range dst[:size] {
+			dst[i] /= n
+		}
+	}
+
+	if !direct {
+		if err := scatterF32(dst[:size], out, y); err != nil {
+			return ReasonLayout
+		}
+	}
+	return ReasonNone
+}
+
+// product returns the product of dims, 1 if there are none.
+func product(dims []int) int {
+	n := 1
+	for _, d := range dims {
+		n *= d
+	}
+	return n
+}
+
+// copyReduced writes the fallback engine's result res of op into reuse,
+// which must have its shape and dtype, and returns reuse; with a nil
+// reuse it returns res.
+func copyReduced(op Op, res, reuse tensor.Tensor) (tensor.Tensor, error) {
+	if reuse == nil {
+		return res, nil
+	}
+	if reuse.Dtype() != res.Dtype() || !reuse.Shape().Eq(res.Shape()) {
+		return nil, fmt.Errorf("mps: %v reuse must have shape %v and dtype %v, got %v of %v", op, res.Shape(), res.Dtype(), reuse.Shape(), reuse.Dtype())
+	}
+	if err := tensor.Copy(reuse, res); err != nil {
+		return nil, fmt.Errorf("mps: %v copying into reuse: %w", op, err)
+	}
+	return reuse, nil
+}
+
+// keepReducedDims reshapes res, the fallback engine's reduction op of a
+// tensor of the given shape over along, to keep the reduced axes with
+// size 1. No axes reduce all of them.
+func keepReducedDims(op Op, res tensor.Tensor, shape tensor.Shape, along []int) (tensor.Tensor, error) {
+	kept := slices.Clone(shape)
+	if len(along) == 0 {
+		for axis := range kept {
+			kept[axis] = 1
+		}
+	}
+	for _, axis := range along {
+		if axis < -len(kept) || axis >= len(kept) {
+			return nil, fmt.Errorf("mps: %v of %v over %v: axis %d out of range", op, shape, along, axis)
+		}
+		kept[resolveAxis(axis, len(kept))] = 1
+	}
+	if err := res.Reshape(kept...); err != nil {
+		return nil, fmt.Errorf("mps: %v keeping the reduced axes of %v: %w", op, shape, err)
+	}
+	return res, nil
+}
+
+// divideMean turns res, the fallback engine's Sum of a tensor of total
+// elements, into a mean by dividing each sum by the number of elements
+// summed into it.
+func divideMean(res tensor.Tensor, total int) error {
+	d, ok := res.(*tensor.Dense)
+	if !ok {
+		return fmt.Errorf("mps: Mean requires a *tensor.Dense sum, got %T", res)
+	}
+	count := total / product(d.Shape())
+	switch data := d.Data().(type) {
+	case []float32:
+		for i := range data {
+			data[i] /= float32(count)
+		}
+	case []float64:
+		for i := range data {
+			data[i] /= float64(count)
+		}
+	case float32:
+		d.Set(0, data/float32(count))
+	case float64:
+		d.Set(0, data/float64(count))
+	default:
+		return fmt.Errorf("mps: Mean does not support dtype %v", d.Dtype())
+	}
+	return nil
+}
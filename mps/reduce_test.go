@@ -0,0 +1,463 @@
+package mps
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// reduction is a reduction under test, with the StdEng method computing
+// it, if it has one.
+type reduction struct {
+	op  Op
+	run func(e *MPSEng, a tensor.Tensor, along ...int) (tensor.Tensor, error)
+	std func(a tensor.Tensor, along ...int) (tensor.Tensor, error)
+}
+
+// reductions are the reductions under test.
+var reductions = []reduction{
+	{OpSum, (*MPSEng).Sum, tensor.StdEng{}.Sum},
+	{OpMax, (*MPSEng).Max, tensor.StdEng{}.Max},
+	{OpMin, (*MPSEng).Min, tensor.StdEng{}.Min},
+	{OpProd, (*MPSEng).Prod, nil},
+	{OpMean, (*MPSEng).Mean, nil},
+}
+
+// naiveReduce reduces the float32 tensor a over axes with op in float64,
+// one element at a time. Its maxima and minima ignore the order of the
+// elements, so they only hold without NaNs; TestReduceNaN checks those
+// against StdEng.
+func naiveReduce(t *testing.T, op Op, a *tensor.Dense, axes []int) []float32 {
+	t.Helper()
+	shape := a.Shape()
+	reduced := make([]bool, len(shape))
+	for _, axis := range axes {
+		reduced[axis] = true
+	}
+	outSize := 1
+	for axis, size := range shape {
+		if !reduced[axis] {
+			outSize *= size
+		}
+	}
+
+	acc := make([]float64, outSize)
+	for i := range acc {
+		acc[i] = float64(reduceOps[op].identity())
+	}
+	for pos, v := range denseValues(t, a) {
+		// Walk pos's coordinates from the innermost axis, keeping those
+		// of the axes that are not reduced.
+		out, stride := 0, 1
+		for axis := len(shape) - 1; axis >= 0; axis-- {
+			c := pos % shape[axis]
+			pos /= shape[axis]
+			if !reduced[axis] {
+				out += c * stride
+				stride *= shape[axis]
+			}
+		}
+		x := float64(v)
+		switch op {
+		case OpMax:
+			acc[out] = math.Max(acc[out], x)
+		case OpMin:
+			acc[out] = math.Min(acc[out], x)
+		case OpProd:
+			acc[out] *= x
+		default:
+			acc[out] += x
+		}
+	}
+
+	res := make([]float32, outSize)
+	for i, v := range acc {
+		if op == OpMean {
+			v /= float64(a.Shape().TotalSize() / outSize)
+		}
+		res[i] = float32(v)
+	}
+	return res
+}
+
+// closeF32 reports whether got matches want to a relative tolerance,
+// with NaNs matching NaNs.
+func closeF32(got, want []float32, tol float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i, w := range want {
+		g := float64(got[i])
+		if math.IsNaN(float64(w)) != math.IsNaN(g) {
+			return false
+		}
+		if math.Abs(g-float64(w)) > tol*math.Max(1, math.Abs(float64(w))) {
+			return false
+		}
+	}
+	return true
+}
+
+// stdEngReduceWrong reports whether StdEng's reductions miscompute, or
+// panic on, a reduction of a rank-dimensional tensor over the ascending
+// axes. They reduce one axis at a time, and their kernel for an axis that
+// is neither the first nor the last only handles a single axis before it.
+func stdEngReduceWrong(rank int, axes []int) bool {
+	for i, axis := range axes {
+		if axis-i >= 2 && axis-i < rank-i-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Test every reduction for every combination of axes up to rank 4,
+// given in order, reversed and negated, on contiguous tensors,
+// transposed views and strided slices, against naiveReduce and, wherever
+// StdEng has the reduction and gets it right, against StdEng. All of
+// them, total reductions over no axes included, run on the device.
+func TestReduceAxesMatchStdEng(t *testing.T) {
+	r := rand.New(rand.NewSource(101))
+	shapes := [][]int{
+		{7},
+		{5, 6}, {1, 6},
+		{3, 4, 5}, {3, 1, 4},
+		{2, 3, 4, 5}, {4, 1, 3, 2},
+	}
+	type input struct {
+		name string
+		a    *tensor.Dense
+	}
+	var inputs []input
+	for _, shape := range shapes {
+		x := randomF32(r, shape...)
+		inputs = append(inputs, input{"contiguous", x})
+		if len(shape) > 1 {
+			tr := x.Clone().(*tensor.Dense)
+			if err := tr.T(); err != nil {
+				t.Fatalf("T error: %v", err)
+			}
+			inputs = append(inputs, input{"transposed", tr})
+		}
+		if shape[0] >= 3 {
+			sl, err := x.Slice(tensor.S(0, shape[0], 2))
+			if err != nil {
+				t.Fatalf("Slice error: %v", err)
+			}
+			inputs = append(inputs, input{"strided", sl.(*tensor.Dense)})
+		}
+	}
+
+	for _, red := range reductions {
+		e := newRefEngine(t)
+		var accelerated uint64
+		for _, in := range inputs {
+			rank := in.a.Dims()
+			for mask := 1; mask < 1<<rank; mask++ {
+				var axes []int
+				wantShape := tensor.Shape{}
+				for axis, size := range in.a.Shape() {
+					if mask&(1<<axis) != 0 {
+						axes = append(axes, axis)
+					} else {
+						wantShape = append(wantShape, size)
+					}
+				}
+				reversed, negated := slices.Clone(axes), slices.Clone(axes)
+				slices.Reverse(reversed)
+				for i := range negated {
+					negated[i] -= rank
+				}
+				name := func(along []int) string {
+					return fmt.Sprintf("%v of %v %s over %v", red.op, in.a.Shape(), in.name, along)
+				}
+
+				var want *tensor.Dense
+				if red.std != nil && !stdEngReduceWrong(rank, axes) {
+					res, err := red.std(in.a, slices.Clone(axes)...)
+					if err != nil {
+						t.Fatalf("StdEng %s error: %v", name(axes), err)
+					}
+					want = res.(*tensor.Dense)
+					if !want.Shape().Eq(wantShape) {
+						t.Fatalf("StdEng %s has shape %v, want %v", name(axes), want.Shape(), wantShape)
+					}
+				}
+
+				alongs := [][]int{axes, reversed, negated}
+				if len(axes) == rank {
+					alongs = append(alongs, nil)
+				}
+				for _, along := range alongs {
+					got, err := red.run(e, in.a, along...)
+					if err != nil {
+						t.Fatalf("%s error: %v", name(along), err)
+					}
+					if !got.Shape().Eq(wantShape) {
+						t.Fatalf("%s has shape %v, want %v", name(along), got.Shape(), wantShape)
+					}
+					accelerated++
+					gv := denseValues(t, got.(*tensor.Dense))
+					if ref := naiveReduce(t, red.op, in.a, axes); !closeF32(gv, ref, 1e-5) {
+						t.Fatalf("%s differs from the reference\n got:  %v\n want: %v", name(along), gv, ref)
+					}
+					if want == nil {
+						continue
+					}
+					if wv := denseValues(t, want); !closeF32(gv, wv, 1e-5) {
+						t.Fatalf("%s differs from StdEng\n got:  %v\n want: %v", name(along), gv, wv)
+					}
+				}
+			}
+		}
+		if st := e.Stats().Ops[red.op]; st.Accelerated != accelerated || st.TotalFallbacks() != 0 {
+			t.Fatalf("%v: expected %d accelerated reductions and no fallbacks: %+v", red.op, accelerated, st)
+		}
+		if st := e.Stats().Pool; st.BytesInUse != 0 {
+			t.Fatalf("%v: %d pool bytes still in use", red.op, st.BytesInUse)
+		}
+	}
+}
+
+// Test that NaNs among the reduced elements make sums, products and
+// means NaN, and that maxima and minima treat them as StdEng does, which
+// depends on the axis, along every axis and over several in any order,
+// wherever the NaNs are.
+func TestReduceNaN(t *testing.T) {
+	nan := float32(math.NaN())
+	alongs := [][]int{{0}, {1}, {2}, {0, 1}, {0, 2}, {1, 2}, {1, 0}, {2, 0}, {0, 1, 2}, {2, 1, 0}, nil}
+	e := newRefEngine(t)
+	check := func(red reduction, x *tensor.Dense, along []int, name string) {
+		t.Helper()
+		got, err := red.run(e, x, along...)
+		if err != nil {
+			t.Fatalf("%s error: %v", name, err)
+		}
+		gv := denseValues(t, got.(*tensor.Dense))
+		if red.op == OpMax || red.op == OpMin {
+			want, err := red.std(x, slices.Clone(along)...)
+			if err != nil {
+				t.Fatalf("StdEng %s error: %v", name, err)
+			}
+			if wv := denseValues(t, want.(*tensor.Dense)); !closeF32(gv, wv, 0) {
+				t.Fatalf("%s differs from StdEng\n got:  %v\n want: %v", name, gv, wv)
+			}
+			return
+		}
+		axes := along
+		if axes == nil {
+			axes = []int{0, 1, 2}[:x.Dims()]
+		}
+		if want := naiveReduce(t, red.op, x, axes); !closeF32(gv, want, 1e-6) {
+			t.Fatalf("%s differs from the reference\n got:  %v\n want: %v", name, gv, want)
+		}
+		if !slices.ContainsFunc(gv, func(v float32) bool { return v != v }) {
+			t.Fatalf("%s lost the NaN: %v", name, gv)
+		}
+	}
+
+	for _, red := range reductions {
+		for pos := 0; pos < 12; pos++ {
+			for _, other := range []int{pos, (pos + 7) % 12} {
+				data := make([]float32, 12)
+				for i := range data {
+					data[i] = float32(i%5) - 2
+				}
+				data[pos], data[other] = nan, nan
+				x := tensor.New(tensor.WithShape(2, 3, 2), tensor.WithBacking(data))
+				for _, along := range alongs {
+					check(red, x, along, fmt.Sprintf("%v over %v with NaNs at %d and %d", red.op, along, pos, other))
+				}
+			}
+		}
+
+		// Long rows take the cooperative row kernel on the device: the
+		// first has its last element NaN, the second NaNs within, and
+		// the last a NaN first.
+		x := randomF32(rand.New(rand.NewSource(104)), 4, 300)
+		data := x.Float32s()
+		for _, i := range []int{0, 5, 299, 317, 423, 900} {
+			data[i] = nan
+		}
+		for _, along := range [][]int{{0}, {1}, {1, 0}, nil} {
+			check(red, x, along, fmt.Sprintf("%v of %v over %v", red.op, x.Shape(), along))
+		}
+	}
+}
+
+// Test that the KeepDims reductions keep the reduced axes with size 1,
+// total reductions included, on the device and through the fallbacks,
+// with the values of the plain reductions.
+func TestReduceKeepDims(t *testing.T) {
+	r := rand.New(rand.NewSource(103))
+	x := randomF32(r, 3, 4, 5)
+	tr := randomF32(r, 5, 4, 3)
+	if err := tr.T(); err != nil {
+		t.Fatalf("T error: %v", err)
+	}
+	cases := []struct {
+		along, axes []int
+		shape       tensor.Shape
+	}{
+		{[]int{1}, []int{1}, tensor.Shape{3, 1, 5}},
+		{[]int{-1}, []int{2}, tensor.Shape{3, 4, 1}},
+		{[]int{2, 0}, []int{0, 2}, tensor.Shape{1, 4, 1}},
+		{[]int{0, 1, 2}, []int{0, 1, 2}, tensor.Shape{1, 1, 1}},
+		{nil, []int{0, 1, 2}, tensor.Shape{1, 1, 1}},
+	}
+
+	for _, fallback := range []bool{false, true} {
+		e := newRefEngine(t)
+		if fallback {
+			e = newRefEngine(t, WithMinFLOPs(1<<40))
+		}
+		for _, red := range reductions {
+			for _, in := range []*tensor.Dense{x, tr} {
+				for _, tc := range cases {
+					name := fmt.Sprintf("%v of %v over %v (fallback %v)", red.op, in.Shape(), tc.along, fallback)
+					got, err := e.ReduceKeepDims(red.op, in, tc.along...)
+					if err != nil {
+						t.Fatalf("%s error: %v", name, err)
+					}
+					if !slices.Equal(got.Shape(), tc.shape) {
+						t.Fatalf("%s has shape %v, want %v", name, got.Shape(), tc.shape)
+					}
+					gv, want := denseValues(t, got.(*tensor.Dense)), naiveReduce(t, red.op, in, tc.axes)
+					if !closeF32(gv, want, 1e-5) {
+						t.Fatalf("%s differs from the reference\n got:  %v\n want: %v", name, gv, want)
+					}
+				}
+			}
+			st := e.Stats().Ops[red.op]
+			calls := st.Accelerated
+			if fallback {
+				calls = st.Fallbacks[ReasonSizeThreshold]
+			}
+			if calls != uint64(2*len(cases)) || calls != st.Accelerated+st.TotalFallbacks() {
+				t.Fatalf("%v (fallback %v): expected %d calls, all on the same path: %+v", red.op, fallback, 2*len(cases), st)
+			}
+		}
+	}
+
+	e := newRefEngine(t)
+	sum, err := e.SumKeepDims(x, 1)
+	if err != nil || !slices.Equal(sum.Shape(), tensor.Shape{3, 1, 5}) {
+		t.Fatalf("SumKeepDims = %v, %v; want shape (3, 1, 5)", sum, err)
+	}
+
+	// Total sums, as losses compute them, write into scalars.
+	loss := tensor.New(tensor.FromScalar(float32(0)))
+	if res, err := e.SumOpts(x, nil, tensor.WithReuse(loss)); err != nil || res != loss {
+		t.Fatalf("SumOpts into a scalar = %v, %v", res, err)
+	}
+	if got, want := denseValues(t, loss), naiveReduce(t, OpSum, x, []int{0, 1, 2}); !closeF32(got, want, 1e-5) {
+		t.Fatalf("total sum = %v, want %v", got, want)
+	}
+	if _, err := e.ReduceKeepDims(OpArgmax, x, 1); err == nil {
+		t.Fatalf("ReduceKeepDims accepted Argmax")
+	}
+}
+
+// proderEngine is a fallback engine with a Prod, which StdEng lacks.
+type proderEngine struct {
+	tensor.StdEng
+	prods int
+}
+
+func (p *proderEngine) Prod(a tensor.Tensor, along ...int) (tensor.Tensor, error) {
+	p.prods++
+	return tensor.New(tensor.WithShape(a.Shape()[0]), tensor.Of(a.Dtype())), nil
+}
+
+// Test the fallbacks of the reductions StdEng lacks: Prod on the
+// reference kernels or the fallback engine's Prod, and Mean from the
+// fallback engine's Sum.
+func TestReduceFallbacks(t *testing.T) {
+	r := rand.New(rand.NewSource(102))
+	x := randomF32(r, 4, 3, 5)
+	along := []int{2, 0}
+
+	e := NewMPSEng(WithOpEnabled(OpProd, false), WithOpEnabled(OpMean, false))
+	defer e.Close()
+	for _, op := range []Op{OpProd, OpMean} {
+		got, err := e.reduce(op, x, along, false, nil)
+		if err != nil {
+			t.Fatalf("%v fallback error: %v", op, err)
+		}
+		if gv, want := denseValues(t, got.(*tensor.Dense)), naiveReduce(t, op, x, along); !closeF32(gv, want, 1e-5) {
+			t.Fatalf("%v fallback differs from the reference\n got:  %v\n want: %v", op, gv, want)
+		}
+		if st := e.Stats().Ops[op]; st.Fallbacks[ReasonDisabled] != 1 {
+			t.Fatalf("%v: expected a disabled fallback: %+v", op, st)
+		}
+	}
+
+	// Products of no elements, over empty tensors or zero-length axes,
+	// are ones, in the shape StdEng gives reductions.
+	for _, tc := range []struct {
+		shape, along []int
+		want         tensor.Shape
+	}{
+		{[]int{0}, nil, tensor.Shape{}},
+		{[]int{2, 0, 3}, nil, tensor.Shape{}},
+		{[]int{3, 0}, []int{1}, tensor.Shape{3}},
+		{[]int{3, 0, 2}, []int{1}, tensor.Shape{3, 2}},
+		{[]int{0, 4}, []int{1}, tensor.Shape{0}},
+	} {
+		name := fmt.Sprintf("Prod of %v over %v", tc.shape, tc.along)
+		got, err := e.Prod(tensor.New(tensor.WithShape(tc.shape...), tensor.Of(tensor.Float32)), tc.along...)
+		if err != nil {
+			t.Fatalf("%s error: %v", name, err)
+		}
+		if !got.Shape().Eq(tc.want) {
+			t.Fatalf("%s has shape %v, want %v", name, got.Shape(), tc.want)
+		}
+		gv := denseValues(t, got.(*tensor.Dense))
+		if slices.ContainsFunc(gv, func(v float32) bool { return v != 1 }) {
+			t.Fatalf("%s = %v, want ones", name, gv)
+		}
+	}
+	if got, err := e.ReduceKeepDims(OpProd, tensor.New(tensor.WithShape(3, 0, 2), tensor.Of(tensor.Float32)), 1); err != nil ||
+		!got.Shape().Eq(tensor.Shape{3, 1, 2}) || !slices.Equal(denseValues(t, got.(*tensor.Dense)), []float32{1, 1, 1, 1, 1, 1}) {
+		t.Fatalf("Prod keeping a zero-length axis = %v, %v; want ones of shape [3 1 2]", got, err)
+	}
+
+	// float64 means divide the fallback engine's sums.
+	x64 := tensor.New(tensor.WithShape(2, 3), tensor.WithBacking([]float64{1, 2, 3, 4, 5, 9}))
+	got, err := e.Mean(x64, 1)
+	if err != nil {
+		t.Fatalf("float64 Mean error: %v", err)
+	}
+	if gv := got.(*tensor.Dense).Float64s(); !slices.Equal(gv, []float64{2, 6}) {
+		t.Fatalf("float64 Mean = %v, want [2 6]", gv)
+	}
+
+	// Without a Proder, only float32 products can fall back; with one,
+	// every product goes to it.
+	var fe *FallbackError
+	if _, err := e.Prod(x64, 1); err == nil || errors.As(err, &fe) {
+		t.Fatalf("float64 Prod without a Proder: got %v, want a plain error", err)
+	}
+	pe := &proderEngine{}
+	ep := NewMPSEng(WithFallbackEngine(pe), WithOpEnabled(OpProd, false))
+	defer ep.Close()
+	for _, a := range []tensor.Tensor{x64, x} {
+		if _, err := ep.Prod(a, 1); err != nil {
+			t.Fatalf("Prod with a Proder error: %v", err)
+		}
+	}
+	if pe.prods != 2 {
+		t.Fatalf("fallback Proder ran %d times, want 2", pe.prods)
+	}
+
+	strict := NewMPSEng(WithStrict(true))
+	defer strict.Close()
+	if _, err := strict.Max(x64, 0); !errors.As(err, &fe) || fe.Op != OpMax || fe.Reason != ReasonDtype {
+		t.Fatalf("strict Max: expected a dtype FallbackError, got %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+// sgemm.go
+//
+// A pure-Go float32 GEMM for CPUs: cache-blocked over packed panels of A
+// and B, with a register-blocked micro-kernel, and parallel over blocks
+// of rows of C. It computes the same gemmArgs as the device backends,
+// including transposed operands, alpha, beta and the Linear epilogue, so
+// that fallbacks can use it in place of the fallback engine's MatMul
+// (see WithCPUGEMM).
+
+package mps
+
+import (
+	"runtime"
+	"sync"
+)
+
+// WithCPUGEMM lets float32 MatMul, Gemm and Linear fallbacks run on the
+// engine's blocked, multi-threaded CPU GEMM instead of the fallback
+// engine's MatMul wherever it is the faster of the two: on architectures
+// where StdEng's float32 kernels are plain Go (all but amd64), for
+// products from about 64x64x64 up. On amd64 StdEng's SIMD kernels always
+// win, so there WithCPUGEMM does nothing.
+//
+// It only replaces fallbacks the inputs did not force: the GPU must have
+// been skipped by policy (disabled, below the size threshold or without
+// a device) or have failed. Such fallbacks are still recorded under
+// their reason, and also counted in OpStats.CPUGEMM. Results may round
+// differently from StdEng's. In strict mode fallbacks remain errors.
+// The default is off.
+func WithCPUGEMM(enabled bool) Option {
+	return func(c *config) {
+		c.cpuGEMM = enabled
+	}
+}
+
+// cpuGEMMThreshold is the crossover above which sgemm beats StdEng's
+// plain Go kernels: below it, packing and scheduling cost more than the
+// blocking saves. Measured with BenchmarkSGEMM under the noasm build tag.
+var cpuGEMMThreshold = Threshold{MinFLOPs: 1 << 19} // roughly a 64x64x64 product
+
+// stdEngSIMD reports whether StdEng's float32 kernels (gonum's) use SIMD
+// assembly, which they only do on amd64. sgemm's scalar kernel does not
+// beat them.
+const stdEngSIMD = runtime.GOARCH == "amd64"
+
+// withStdEngSIMD overrides whether the engine takes StdEng's float32
+// kernels to be SIMD (see stdEngSIMD). It exists for tests, which use it
+// to exercise sgemm fallbacks on amd64.
+func withStdEngSIMD(simd bool) Option {
+	return func(c *config) {
+		c.stdEngSIMD = simd
+	}
+}
+
+// cpuGEMMEligible reports whether a fallback for reason may be computed
+// by sgemm: WithCPUGEMM is set and the GPU was skipped by policy or
+// failed, rather than rejected the inputs.
+func (e *MPSEng) cpuGEMMEligible(reason FallbackReason) bool {
+	if !e.cfg.cpuGEMM {
+		return false
+	}
+	switch reason {
+	case ReasonDisabled, ReasonSizeThreshold, ReasonNoDevice, ReasonDeviceError:
+		return true
+	}
+	return false
+}
+
+// cpuGEMMWins reports whether sgemm computes p faster than the fallback
+// engine's MatMul (see WithCPUGEMM).
+func (e *MPSEng) cpuGEMMWins(p matMulPlan) bool {
+	return !e.cfg.stdEngSIMD && cpuGEMMThreshold.admits(matMulCost(p.m, p.n, p.k))
+}
+
+// tryCPUGEMM computes the planned product p with sgemm if that beats the
+// fallback engine, and reports whether it did. On false, p.c is as the
+// fallback found it.
+func (e *MPSEng) tryCPUGEMM(op Op, p matMulPlan) bool {
+	if !e.cpuGEMMWins(p) {
+		return false
+	}
+	p.cpu = true
+	if e.execMatMul(p) != ReasonNone {
+		return false
+	}
+	e.stats.recordCPUGEMM(op)
+	return true
+}
+
+// tryCPULinear is tryCPUGEMM for a planned Linear.
+func (e *MPSEng) tryCPULinear(p linearPlan) bool {
+	if !e.cpuGEMMWins(p.mm) {
+		return false
+	}
+	p.mm.cpu = true
+	if e.execLinear(p) != ReasonNone {
+		return false
+	}
+	e.stats.recordCPUGEMM(OpLinear)
+	return true
+}
+
+// Blocking parameters. A kc-deep sliver of B (kc x sgemmNR) stays in L1
+// across a micro-kernel row, an mc x kc block of A in L2, and a kc x nc
+// panel of B in L3.
+const (
+	sgemmMR = 2 // rows of the micro-kernel's C tile
+	sgemmNR = 4 // columns of the micro-kernel's C tile
+	sgemmMC = 64
+	sgemmKC = 256
+	sgemmNC = 1024
+)
+
+// sgemm computes g.c = g.alpha * op(A) x op(B) + g.beta * g.c followed by
+// g's epilogue, where op transposes the operands g.transA and g.transB
+// mark.
+func sgemm(g gemmArgs) {
+	m, n, k := g.m, g.n, g.k
+
+	// Apply beta first, so that the blocks below only accumulate.
+	forRowRanges(m, n, func(r0, r1 int) {
+		c := g.c[r0*n : r1*n]
+		switch g.beta {
+		case 0:
+			for i := range c {
+				c[i] = 0
+			}
+		case 1:
+		default:
+			for i := range c {
+				c[i] *= g.beta
+			}
+		}
+	})
+
+	// Element strides of A and B as stored.
+	ai, ap := k, 1
+	if g.transA {
+		ai, ap = 1, m
+	}
+	bp, bj := n, 1
+	if g.transB {
+		bp, bj = 1, k
+	}
+
+	if g.alpha != 0 && k > 0 {
+		// Blocks of mc rows of C are independent; each worker packs its
+		// own blocks of A against the shared panel of B.
+		blocks := (m + sgemmMC - 1) / sgemmMC
+		workers := min(runtime.GOMAXPROCS(0), blocks)
+		bpack := make([]float32, min(k, sgemmKC)*roundUp(min(n, sgemmNC), sgemmNR))
+		apacks := make([][]float32, workers)
+		for w := range apacks {
+			apacks[w] = make([]float32, min(k, sgemmKC)*roundUp(min(m, sgemmMC), sgemmMR))
+		}
+		for jc := 0; jc < n; jc += sgemmNC {
+			nc := min(sgemmNC, n-jc)
+			for pc := 0; pc < k; pc += sgemmKC {
+				kc := min(sgemmKC, k-pc)
+				packB(bpack, g.b, bp, bj, pc, jc, kc, nc)
+				rowBlock := func(apack []float32, ic int) {
+					mc := min(sgemmMC, m-ic)
+					packA(apack, g.a, ai, ap, ic, pc, mc, kc, g.alpha)
+					macroKernel(apack, bpack, g.c[ic*n+jc:], n, mc, nc, kc)
+				}
+				if workers == 1 {
+					for ic := 0; ic < m; ic += sgemmMC {
+						rowBlock(apacks[0], ic)
+					}
+					continue
+				}
+
+				next := make(chan int, blocks)
+				for ic := 0; ic < m; ic += sgemmMC {
+					next <- ic
+				}
+				close(next)
+				var wg sync.WaitGroup
+				for _, apack := range apacks {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for ic := range next {
+							rowBlock(apack, ic)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		}
+	}
+
+	if g.bias != nil || g.act != ActNone {
+		forRowRanges(m, n, func(r0, r1 int) {
+			for i := r0; i < r1; i++ {
+				epilogueRowF32(g.c[i*n:(i+1)*n], g.bias, g.act)
+			}
+		})
+	}
+}
+
+// roundUp rounds n up to a multiple of m.
+func roundUp(n, m int) int {
+	return (n + m - 1) / m * m
+}
+
+// packA packs the mc x kc block of alpha * A at (i0, p0) into dst as
+// slivers of sgemmMR rows, each stored column by column, padding the
+// last sliver with zeros. A(i, p) is a[i*ai + p*ap].
+func packA(dst, a []float32, ai, ap, i0, p0, mc, kc int, alpha float32) {
+	for ir := 0; ir < mc; ir += sgemmMR {
+		mr := min(sgemmMR, mc-ir)
+		sliver := dst[ir*kc : ir*kc+kc*sgemmMR]
+		for p := 0; p < kc; p++ {
+			col := sliver[p*sgemmMR : p*sgemmMR+sgemmMR]
+			base := (i0+ir)*ai + (p0+p)*ap
+			for r := 0; r < mr; r++ {
+				col[r] = alpha * a[base+r*ai]
+			}
+			for r := mr; r < sgemmMR; r++ {
+				col[r] = 0
+			}
+		}
+	}
+}
+
+// packB packs the kc x nc panel of B at (p0, j0) into dst as slivers of
+// sgemmNR columns, each stored row by row, padding the last sliver with
+// zeros. B(p, j) is b[p*bp + j*bj].
+func packB(dst, b []float32, bp, bj, p0, j0, kc, nc int) {
+	for jr := 0; jr < nc; jr += sgemmNR {
+		nr := min(sgemmNR, nc-jr)
+		sliver := dst[jr*kc : jr*kc+kc*sgemmNR]
+		for p := 0; p < kc; p++ {
+			row := sliver[p*sgemmNR : p*sgemmNR+sgemmNR]
+			base := (p0+p)*bp + (j0+jr)*bj
+			if bj == 1 && nr == sgemmNR {
+				copy(row, b[base:base+sgemmNR])
+				continue
+			}
+			for j := 0; j < nr; j++ {
+				row[j] = b[base+j*bj]
+			}
+			for j := nr; j < sgemmNR; j++ {
+				row[j] = 0
+			}
+		}
+	}
+}
+
+// macroKernel adds the product of a packed mc x kc block of A and a
+// packed kc x nc panel of B to the mc x nc block of C at c, whose rows
+// are ldc apart.
+func macroKernel(apack, bpack, c []float32, ldc, mc, nc, kc int) {
+	for jr := 0; jr < nc; jr += sgemmNR {
+		nr := min(sgemmNR, nc-jr)
+		b := bpack[jr*kc : jr*kc+kc*sgemmNR]
+		for ir := 0; ir < mc; ir += sgemmMR {
+			mr := min(sgemmMR, mc-ir)
+			a := apack[ir*kc : ir*kc+kc*sgemmMR]
+			microKernel(kc, a, b, c[ir*ldc+jr:], ldc, mr, nr)
+		}
+	}
+}
+
+// microKernel adds the product of a 2 x kc sliver of A and a kc x 4
+// sliver of B, both packed, to the top-left mr x nr corner of the C tile
+// at c, whose rows are ldc apart. Eight accumulators and the six values
+// loaded per step are as many as fit in registers on amd64 and arm64;
+// larger tiles spill.
+func microKernel(kc int, a, b, c []float32, ldc, mr, nr int) {
+	var (
+		c00, c01, c02, c03 float32
+		c10, c11, c12, c13 float32
+	)
+	a, b = a[:kc*sgemmMR], b[:kc*sgemmNR]
+	for len(a) >= sgemmMR && len(b) >= sgemmNR {
+		a0, a1 := a[0], a[1]
+		b0, b1, b2, b3 := b[0], b[1], b[2], b[3]
+		c00 += a0 * b0
+		c01 += a0 * b1
+		c02 += a0 * b2
+		c03 += a0 * b3
+		c10 += a1 * b0
+		c11 += a1 * b1
+		c12 += a1 * b2
+		c13 += a1 * b3
+		a, b = a[sgemmMR:], b[sgemmNR:]
+	}
+
+	if mr == sgemmMR && nr == sgemmNR {
+		r := c[0:4:4]
+		r[0] += c00
+		r[1] += c01
+		r[2] += c02
+		r[3] += c03
+		r = c[ldc : ldc+4 : ldc+4]
+		r[0] += c10
+		r[1] += c11
+		r[2] += c12
+		r[3] += c13
+		return
+	}
+	tile := [sgemmMR][sgemmNR]float32{
+		{c00, c01, c02, c03},
+		{c10, c11, c12, c13},
+	}
+	for i := 0; i < mr; i++ {
+		for j := 0; j < nr; j++ {
+			c[i*ldc+j] += tile[i][j]
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package mps
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// Test sgemm against StdEng on random shapes that straddle every block
+// size, for all transpose flags, alpha and beta and the epilogue, serially
+// and in parallel.
+func TestSGEMMMatchesStdEng(t *testing.T) {
+	r := rand.New(rand.NewSource(72))
+	shapes := []struct{ m, n, k int }{
+		{1, 1, 1}, {2, 4, 1}, {7, 3, 5}, {65, 9, 257}, {130, 5, 3}, {70, 1030, 300},
+	}
+	blends := []struct{ alpha, beta float32 }{{1, 0}, {0.5, 2}, {0, 1}}
+
+	for _, procs := range []int{1, 4} {
+		prev := runtime.GOMAXPROCS(procs)
+		for _, sh := range shapes {
+			a, b := randomDenseF32(r, sh.m, sh.k), randomDenseF32(r, sh.k, sh.n)
+			ab := stdMatMul(t, a, b)
+			bias := extractFloat32Backing(t, randomF32(r, sh.n))
+			for _, transA := range []bool{false, true} {
+				for _, transB := range []bool{false, true} {
+					for _, bl := range blends {
+						for act := ActNone; act < numActivations; act++ {
+							g := gemmArgs{
+								a: storedAs(t, a, transA), b: storedAs(t, b, transB),
+								c: extractFloat32Backing(t, randomDenseF32(r, sh.m, sh.n)),
+								m: sh.m, n: sh.n, k: sh.k,
+								transA: transA, transB: transB,
+								alpha: bl.alpha, beta: bl.beta, act: act,
+							}
+							if act != ActNone {
+								g.bias = bias
+							}
+							want := make([]float32, len(g.c))
+							for i, c := range g.c {
+								want[i] = bl.alpha * ab[i]
+								if bl.beta != 0 {
+									want[i] += bl.beta * c
+								}
+							}
+							for i := 0; i < sh.m; i++ {
+								epilogueRowF32(want[i*sh.n:(i+1)*sh.n], g.bias, act)
+							}
+
+							sgemm(g)
+							if !equalApprox(g.c, want, 1e-3) {
+								t.Fatalf("procs %d, %dx%dx%d, transA %v, transB %v, %+v, %v: sgemm differs from StdEng",
+									procs, sh.m, sh.n, sh.k, transA, transB, bl, act)
+							}
+						}
+					}
+				}
+			}
+		}
+		runtime.GOMAXPROCS(prev)
+	}
+}
+
+// storedAs returns the backing of the row-major matrix d, or of its
+// transpose if trans is set, as the backends receive it.
+func storedAs(t *testing.T, d *tensor.Dense, trans bool) []float32 {
+	t.Helper()
+	if !trans {
+		return extractFloat32Backing(t, d)
+	}
+	rows, cols := d.Shape()[0], d.Shape()[1]
+	src, dst := extractFloat32Backing(t, d), make([]float32, rows*cols)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			dst[j*rows+i] = src[i*cols+j]
+		}
+	}
+	return dst
+}
+
+// Test which fallbacks WithCPUGEMM hands to sgemm, as it would off amd64,
+// and that they are correct and counted.
+func TestCPUGEMMFallback(t *testing.T) {
+	r := rand.New(rand.NewSource(73))
+	const m, k, n = 70, 90, 80
+
+	cases := []struct {
+		name string
+		opts []Option
+		run  func(e *MPSEng) (got, want []float32, err error)
+		op   Op
+		cpu  bool
+	}{
+		{"transposed MatMul", nil, func(e *MPSEng) ([]float32, []float32, error) {
+			a, b, c := transposedView(t, m, k, r), newRandomFloat32Matrix(t, k, n, r), newZeroFloat32Matrix(m, n)
+			err := e.MatMul(a, b, c)
+			return denseValues(t, c), stdMatMul(t, a, b), err
+		}, OpMatMul, true},
+		{"row-major MatMul", nil, func(e *MPSEng) ([]float32, []float32, error) {
+			a, b, c := newRandomFloat32Matrix(t, m, k, r), newRandomFloat32Matrix(t, k, n, r), newZeroFloat32Matrix(m, n)
+			err := e.MatMul(a, b, c)
+			return denseValues(t, c), stdMatMul(t, a, b), err
+		}, OpMatMul, true},
+		{"small MatMul", nil, func(e *MPSEng) ([]float32, []float32, error) {
+			a, b, c := transposedView(t, 8, 8, r), newRandomFloat32Matrix(t, 8, 8, r), newZeroFloat32Matrix(8, 8)
+			err := e.MatMul(a, b, c)
+			return denseValues(t, c), stdMatMul(t, a, b), err
+		}, OpMatMul, false},
+		{"Gemm", nil, func(e *MPSEng) ([]float32, []float32, error) {
+			a, b, c := newRandomFloat32Matrix(t, m, k, r), newRandomFloat32Matrix(t, k, n, r), slicedView(t, m, n, r)
+			want := stdMatMul(t, a, b)
+			for i, v := range denseValues(t, c) {
+				want[i] = 2*want[i] + 0.5*v
+			}
+			err := e.Gemm(2, a, b, 0.5, c)
+			return denseValues(t, c), want, err
+		}, OpMatMul, true},
+		{"Linear", nil, func(e *MPSEng) ([]float32, []float32, error) {
+			x, w, bias, out := newRandomFloat32Matrix(t, m, k, r), newRandomFloat32Matrix(t, k, n, r), randomF32(r, n), newZeroFloat32Matrix(m, n)
+			err := e.Linear(x, w, bias, ActGELU, out)
+			return denseValues(t, out), linearWant(t, x, w, bias, ActGELU), err
+		}, OpLinear, true},
+		{"off", []Option{WithCPUGEMM(false)}, func(e *MPSEng) ([]float32, []float32, error) {
+			a, b, c := transposedView(t, m, k, r), newRandomFloat32Matrix(t, k, n, r), newZeroFloat32Matrix(m, n)
+			err := e.MatMul(a, b, c)
+			return denseValues(t, c), stdMatMul(t, a, b), err
+		}, OpMatMul, false},
+	}
+
+	for _, tc := range cases {
+		opts := append([]Option{withStdEngSIMD(false), WithCPUGEMM(true), WithOpEnabled(OpMatMul, false), WithOpEnabled(OpLinear, false)}, tc.opts...)
+		e := NewMPSEng(opts...)
+		got, want, err := tc.run(e)
+		if err != nil {
+			t.Fatalf("%s: error: %v", tc.name, err)
+		}
+		if !equalApprox(got, want, 1e-3) {
+			t.Fatalf("%s: result differs from StdEng", tc.name)
+		}
+		st := e.Stats().Ops[tc.op]
+		if st.Fallbacks[ReasonDisabled] != 1 || (st.CPUGEMM == 1) != tc.cpu {
+			t.Fatalf("%s: expected a disabled fallback, on sgemm %v: %+v", tc.name, tc.cpu, st)
+		}
+		if p := e.Stats().Pool; p.BytesInUse != 0 {
+			t.Fatalf("%s: %d pool bytes still in use", tc.name, p.BytesInUse)
+		}
+		e.Close()
+	}
+
+	// StdEng's SIMD kernels keep every product.
+	e := NewMPSEng(withStdEngSIMD(true), WithCPUGEMM(true), WithOpEnabled(OpMatMul, false))
+	defer e.Close()
+	if err := e.MatMul(transposedView(t, m, k, r), newRandomFloat32Matrix(t, k, n, r), newZeroFloat32Matrix(m, n)); err != nil {
+		t.Fatalf("MatMul error: %v", err)
+	}
+	if st := e.Stats().Ops[OpMatMul]; st.CPUGEMM != 0 {
+		t.Fatalf("sgemm used over SIMD StdEng: %+v", st)
+	}
+}
+
+// BenchmarkSGEMM compares the blocked CPU GEMM with StdEng's MatMul on
+// square row-major products. Run it with -tags noasm to compare with
+// StdEng's plain Go kernels, as used off amd64.
+func BenchmarkSGEMM(b *testing.B) {
+	for _, n := range []int{32, 64, 128, 256, 512, 1024} {
+		r := rand.New(rand.NewSource(71))
+		x, y := randomDenseF32(r, n, n), randomDenseF32(r, n, n)
+		out := tensor.New(tensor.WithShape(n, n), tensor.Of(tensor.Float32))
+		g := gemmArgs{
+			a: x.Data().([]float32), b: y.Data().([]float32), c: out.Data().([]float32),
+			m: n, n: n, k: n, alpha: 1,
+		}
+		b.Run(fmt.Sprintf("blocked/%d", n), func(b *testing.B) {
+			b.SetBytes(int64(2 * n * n * n)) // reported MB/s is MFLOP/s
+			for i := 0; i < b.N; i++ {
+				sgemm(g)
+			}
+		})
+		b.Run(fmt.Sprintf("StdEng/%d", n), func(b *testing.B) {
+			var std tensor.StdEng
+			b.SetBytes(int64(2 * n * n * n))
+			for i := 0; i < b.N; i++ {
+				if err := std.MatMul(x, y, out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
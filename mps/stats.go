@@ -0,0 +1,157 @@
+// stats.go
+//
+// Per-op dispatch counters. Every accelerated method records either a
+// GPU execution or the reason it fell back to the CPU, so callers can
+// check whether their workload actually reached the device.
+
+package mps
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// FallbackReason explains why an op was not executed on the GPU.
+type FallbackReason int
+
+const (
+	// ReasonNone means the op was not rejected; it is never recorded.
+	ReasonNone FallbackReason = iota
+	// ReasonDisabled: the op was disabled with WithOpEnabled.
+	ReasonDisabled
+	// ReasonNotDense: an operand is not a *tensor.Dense.
+	ReasonNotDense
+	// ReasonDtype: an operand's dtype is not supported (only Float32 is).
+	ReasonDtype
+	// ReasonRank: an operand's rank is not supported by the kernel.
+	ReasonRank
+	// ReasonAxis: the requested reduction axes are not supported.
+	ReasonAxis
+	// ReasonLayout: an operand's memory layout could not be staged for
+	// the device, or the result could not be written back.
+	ReasonLayout
+	// ReasonEmpty: the problem has a zero-sized dimension.
+	ReasonEmpty
+	// ReasonSizeThreshold: the problem is smaller than the configured
+	// GPU dispatch threshold.
+	ReasonSizeThreshold
+	// ReasonNoDevice: no Metal device is available on this platform.
+	ReasonNoDevice
+	// ReasonDeviceError: the GPU kernel reported a failure.
+	ReasonDeviceError
+
+	numReasons
+)
+
+var reasonNames = [numReasons]string{
+	ReasonNone:          "none",
+	ReasonDisabled:      "disabled",
+	ReasonNotDense:      "not-dense",
+	ReasonDtype:         "dtype",
+	ReasonRank:          "rank",
+	ReasonAxis:          "axis",
+	ReasonLayout:        "layout",
+	ReasonEmpty:         "empty",
+	ReasonSizeThreshold: "size-threshold",
+	ReasonNoDevice:      "no-device",
+	ReasonDeviceError:   "device-error",
+}
+
+func (r FallbackReason) String() string {
+	if r < 0 || r >= numReasons {
+		return fmt.Sprintf("FallbackReason(%d)", int(r))
+	}
+	return reasonNames[r]
+}
+
+// OpStats counts how often one op ran on the GPU and, per reason, how
+// often it fell back to the CPU.
+type OpStats struct {
+	Accelerated uint64
+	// Fallbacks only holds reasons with a non-zero count.
+	Fallbacks map[FallbackReason]uint64
+	// CPUGEMM counts the fallbacks computed by the engine's blocked CPU
+	// GEMM instead of the fallback engine (see WithCPUGEMM). They are
+	// also counted in Fallbacks.
+	CPUGEMM uint64
+}
+
+// TotalFallbacks returns the number of fallbacks across all reasons.
+func (s OpStats) TotalFallbacks() uint64 {
+	var n uint64
+	for _, c := range s.Fallbacks {
+		n += c
+	}
+	return n
+}
+
+// Stats is a point-in-time snapshot of an engine's dispatch counters.
+type Stats struct {
+	// Ops holds an entry for every Op, including ones never called.
+	Ops map[Op]OpStats
+
+	// Pool describes the staging buffer pool.
+	Pool PoolStats
+}
+
+// counters is the live, lock-free counterpart of Stats.
+type counters struct {
+	accelerated [numOps]atomic.Uint64
+	fallbacks   [numOps][numReasons]atomic.Uint64
+	cpuGEMM     [numOps]atomic.Uint64
+}
+
+func (c *counters) recordAccelerated(op Op) {
+	c.accelerated[op].Add(1)
+}
+
+func (c *counters) recordFallback(op Op, reason FallbackReason) {
+	c.fallbacks[op][reason].Add(1)
+}
+
+func (c *counters) recordCPUGEMM(op Op) {
+	c.cpuGEMM[op].Add(1)
+}
+
+func (c *counters) snapshot() Stats {
+	s := Stats{Ops: make(map[Op]OpStats, numOps)}
+	for op := Op(0); op < numOps; op++ {
+		os := OpStats{
+			Accelerated: c.accelerated[op].Load(),
+			Fallbacks:   make(map[FallbackReason]uint64),
+			CPUGEMM:     c.cpuGEMM[op].Load(),
+		}
+		for r := FallbackReason(0); r < numReasons; r++ {
+			if n := c.fallbacks[op][r].Load(); n > 0 {
+				os.Fallbacks[r] = n
+			}
+		}
+		s.Ops[op] = os
+	}
+	return s
+}
+
+func (c *counters) reset() {
+	for op := Op(0); op < numOps; op++ {
+		c.accelerated[op].Store(0)
+		c.cpuGEMM[op].Store(0)
+		for r := FallbackReason(0); r < numReasons; r++ {
+			c.fallbacks[op][r].Store(0)
+		}
+	}
+}
+
+// Stats returns a snapshot of the engine's dispatch counters. It is safe
+// to call concurrently with running ops.
+func (e *MPSEng) Stats() Stats {
+	s := e.stats.snapshot()
+	s.Pool = e.pool.stats()
+	return s
+}
+
+// ResetStats zeroes the engine's dispatch counters and the staging
+// pool's hit and miss counters.
+func (e *MPSEng) ResetStats() {
+	e.stats.reset()
+	e.pool.resetCounters()
+}
@@ -0,0 +1,118 @@
+package mps
+
+import (
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// Test that each kind of rejected input is counted under its reason.
+func TestMPSEngFallbackReasons(t *testing.T) {
+	f64 := func(shape ...int) *tensor.Dense {
+		return tensor.New(tensor.WithShape(shape...), tensor.Of(tensor.Float64))
+	}
+
+	cases := []struct {
+		name string
+		opts []Option
+		run  func(e *MPSEng) error
+		op   Op
+		want FallbackReason
+	}{
+		{
+			name: "matmul dtype",
+			run:  func(e *MPSEng) error { return e.MatMul(f64(2, 3), f64(3, 4), f64(2, 4)) },
+			op:   OpMatMul,
+			want: ReasonDtype,
+		},
+		{
+			name: "matmul disabled",
+			opts: []Option{WithOpEnabled(OpMatMul, false)},
+			run: func(e *MPSEng) error {
+				return e.MatMul(newZeroFloat32Matrix(2, 3), newZeroFloat32Matrix(3, 4), newZeroFloat32Matrix(2, 4))
+			},
+			op:   OpMatMul,
+			want: ReasonDisabled,
+		},
+		{
+			name: "matmul size threshold",
+			opts: []Option{WithMinFLOPs(1 << 20)},
+			run: func(e *MPSEng) error {
+				return e.MatMul(newZeroFloat32Matrix(2, 3), newZeroFloat32Matrix(3, 4), newZeroFloat32Matrix(2, 4))
+			},
+			op:   OpMatMul,
+			want: ReasonSizeThreshold,
+		},
+		{
+			name: "sum repeated axis",
+			run: func(e *MPSEng) error {
+				_, err := e.Sum(newZeroFloat32Matrix(3, 4), 1, 1)
+				return err
+			},
+			op:   OpSum,
+			want: ReasonAxis,
+		},
+		{
+			name: "sum dtype",
+			run: func(e *MPSEng) error {
+				_, err := e.Sum(f64(3, 4), 1)
+				return err
+			},
+			op:   OpSum,
+			want: ReasonDtype,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewMPSEng(tc.opts...)
+			defer e.Close()
+
+			if err := tc.run(e); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			st := e.Stats().Ops[tc.op]
+			if st.Accelerated != 0 {
+				t.Fatalf("Accelerated = %d, want 0", st.Accelerated)
+			}
+			if got := st.Fallbacks[tc.want]; got != 1 || st.TotalFallbacks() != 1 {
+				t.Fatalf("Fallbacks = %v, want exactly one %v", st.Fallbacks, tc.want)
+			}
+		})
+	}
+}
+
+// Test that a supported MatMul is either accelerated or, without a Metal
+// device, counted as ReasonNoDevice, and that ResetStats clears counters.
+func TestMPSEngStatsSupportedAndReset(t *testing.T) {
+	e := NewMPSEng(WithMinFLOPs(0))
+	defer e.Close()
+
+	if err := e.MatMul(newZeroFloat32Matrix(2, 3), newZeroFloat32Matrix(3, 4), newZeroFloat32Matrix(2, 4)); err != nil {
+		t.Fatalf("MatMul error: %v", err)
+	}
+
+	st := e.Stats().Ops[OpMatMul]
+	if st.Accelerated+st.Fallbacks[ReasonNoDevice] != 1 || st.Accelerated+st.TotalFallbacks() != 1 {
+		t.Fatalf("unexpected MatMul stats %+v", st)
+	}
+	if e.hasDevice() != (st.Accelerated == 1) {
+		t.Fatalf("hasDevice=%v but stats %+v", e.hasDevice(), st)
+	}
+
+	e.ResetStats()
+	for op, st := range e.Stats().Ops {
+		if st.Accelerated != 0 || st.TotalFallbacks() != 0 {
+			t.Fatalf("%v stats not reset: %+v", op, st)
+		}
+	}
+}
+
+func TestFallbackReasonString(t *testing.T) {
+	if got := ReasonSizeThreshold.String(); got != "size-threshold" {
+		t.Fatalf("ReasonSizeThreshold.String() = %q", got)
+	}
+	if got := FallbackReason(99).String(); got != "FallbackReason(99)" {
+		t.Fatalf("FallbackReason(99).String() = %q", got)
+	}
+}
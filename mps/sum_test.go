@@ -1,7 +1,6 @@
 package mps
 
 import (
-	"math"
 	"math/rand"
 	"testing"
 
@@ -23,20 +22,6 @@ func newRandomFloat32MatrixForSum(t *testing.T, rows, cols int, r *rand.Rand) *t
 	)
 }
 
-// equalApproxF32 reports whether two float32 slices are equal within a tolerance.
-func equalApproxF32(a, b []float32, tol float32) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := range a {
-		diff := float32(math.Abs(float64(a[i] - b[i])))
-		if diff > tol {
-			return false
-		}
-	}
-	return true
-}
-
 // Test that for the supported case (2D float32, axis last dim), MPSEng.Sum
 // matches StdEng.Sum within a small numerical tolerance.
 func TestMPSEngSumLastAxisMatchesStdEng(t *testing.T) {
@@ -55,7 +40,7 @@ func TestMPSEngSumLastAxisMatchesStdEng(t *testing.T) {
 		t.Fatalf("StdEng.Sum error: %v", err)
 	}
 
-	mpsEng := NewMPSEng()
+	mpsEng := NewMPSEng(WithMinFLOPs(0))
 	mpsOut, err := mpsEng.Sum(x, 1)
 	if err != nil {
 		t.Fatalf("MPSEng.Sum error: %v", err)
@@ -74,11 +59,124 @@ func TestMPSEngSumLastAxisMatchesStdEng(t *testing.T) {
 	got := cpuDense.Data().([]float32)[:logicalLen]
 	want := mpsDense.Data().([]float32)[:logicalLen]
 
-	if !equalApproxF32(got, want, 1e-4) {
+	if !equalApprox(got, want, 1e-4) {
 		t.Fatalf("MPSEng.Sum result differs from StdEng.Sum.\n got:  %v\n want: %v", got, want)
 	}
 }
 
+// Test that Sum leaves its input untouched and returns a new tensor
+// shaped like StdEng's result, and that SumOpts writes into reuse
+// tensors of any layout, including one sharing memory with the input,
+// on the device and through the fallback.
+func TestSumLeavesInputUntouched(t *testing.T) {
+	r := rand.New(rand.NewSource(100))
+	const rows, cols = 5, 7
+
+	x := newRandomFloat32MatrixForSum(t, rows, cols, r)
+	orig := append([]float32(nil), extractFloat32Backing(t, x)...)
+	var cpu tensor.StdEng
+	wantT, err := cpu.Sum(x, 1)
+	if err != nil {
+		t.Fatalf("StdEng.Sum error: %v", err)
+	}
+	want := denseValues(t, wantT.(*tensor.Dense))
+
+	checkInput := func(name string) {
+		t.Helper()
+		if !x.Shape().Eq(tensor.Shape{rows, cols}) {
+			t.Fatalf("%s: input reshaped to %v", name, x.Shape())
+		}
+		if got := extractFloat32Backing(t, x); !equalApprox(got, orig, 0) {
+			t.Fatalf("%s: input overwritten\n got:  %v\n want: %v", name, got, orig)
+		}
+	}
+	checkResult := func(name string, got tensor.Tensor) {
+		t.Helper()
+		d, ok := got.(*tensor.Dense)
+		if !ok || !d.Shape().Eq(wantT.Shape()) {
+			t.Fatalf("%s: got %T of shape %v, want shape %v", name, got, got.Shape(), wantT.Shape())
+		}
+		if v := denseValues(t, d); !equalApprox(v, want, 1e-4) {
+			t.Fatalf("%s: sum differs from StdEng\n got:  %v\n want: %v", name, v, want)
+		}
+	}
+
+	e := newRefEngine(t)
+	for i := 0; i < 2; i++ {
+		got, err := e.Sum(x, -1)
+		if err != nil {
+			t.Fatalf("Sum error: %v", err)
+		}
+		checkInput("Sum")
+		checkResult("Sum", got)
+		if got.(*tensor.Dense).Engine() != e {
+			t.Fatalf("Sum result does not use the engine")
+		}
+	}
+
+	// Reuse tensors: contiguous, strided (a column of a matrix) and a
+	// column of a copy of the input that is summed in place of it.
+	strided := tensor.New(tensor.WithShape(rows, 3), tensor.Of(tensor.Float32))
+	col, err := strided.Slice(nil, tensor.S(1))
+	if err != nil {
+		t.Fatalf("Slice error: %v", err)
+	}
+	xc := x.Clone().(*tensor.Dense)
+	alias, err := xc.Slice(nil, tensor.S(0))
+	if err != nil {
+		t.Fatalf("Slice error: %v", err)
+	}
+	reuses := []struct {
+		name  string
+		in    *tensor.Dense
+		reuse tensor.Tensor
+	}{
+		{"contiguous reuse", x, tensor.New(tensor.WithShape(rows), tensor.Of(tensor.Float32))},
+		{"strided reuse", x, col},
+		{"aliased reuse", xc, alias},
+	}
+	for _, tc := range reuses {
+		got, err := e.SumOpts(tc.in, []int{1}, tensor.WithReuse(tc.reuse))
+		if err != nil {
+			t.Fatalf("%s: SumOpts error: %v", tc.name, err)
+		}
+		if got != tc.reuse {
+			t.Fatalf("%s: SumOpts did not return reuse", tc.name)
+		}
+		checkInput(tc.name)
+		checkResult(tc.name, got)
+	}
+	if st := e.Stats().Ops[OpSum]; st.Accelerated != 5 {
+		t.Fatalf("expected 5 accelerated sums: %+v", st)
+	}
+	if st := e.Stats().Pool; st.BytesInUse != 0 {
+		t.Fatalf("%d pool bytes still in use", st.BytesInUse)
+	}
+
+	// The fallback's result is copied into reuse.
+	fb := NewMPSEng(WithOpEnabled(OpSum, false))
+	defer fb.Close()
+	reuse := tensor.New(tensor.WithShape(rows), tensor.Of(tensor.Float32))
+	got, err := fb.SumOpts(x, []int{1}, tensor.WithReuse(reuse))
+	if err != nil || got != reuse {
+		t.Fatalf("fallback SumOpts = %v, %v; want reuse", got, err)
+	}
+	checkInput("fallback")
+	checkResult("fallback", got)
+
+	for _, eng := range []*MPSEng{e, fb} {
+		for _, bad := range []tensor.Tensor{
+			tensor.New(tensor.WithShape(rows+1), tensor.Of(tensor.Float32)),
+			tensor.New(tensor.WithShape(rows), tensor.Of(tensor.Float64)),
+		} {
+			if _, err := eng.SumOpts(x, []int{1}, tensor.WithReuse(bad)); err == nil {
+				t.Fatalf("SumOpts accepted reuse %v of %v", bad.Shape(), bad.Dtype())
+			}
+		}
+	}
+	checkInput("rejected reuse")
+}
+
 // --- Benchmarks ------------------------------------------------------------
 
 // benchmarkSum is a helper that benchmarks either StdEng.Sum or MPSEng.Sum
@@ -93,7 +191,7 @@ func benchmarkSum(b *testing.B, rows, cols int, useMPS bool) {
 
 	var (
 		cpu    tensor.StdEng
-		mpsEng = NewMPSEng()
+		mpsEng = NewMPSEng(WithMinFLOPs(0))
 		x      tensor.Tensor
 	)
 
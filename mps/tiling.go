@@ -0,0 +1,146 @@
+// tiling.go
+//
+// Tiling of matrix products whose operands exceed the largest buffer a
+// device call may use (the device's own limit or WithMaxBufferBytes).
+// Such products are split into row, column and, if need be, inner tiles
+// that are packed from the staged operands, multiplied one by one on the
+// device and stitched back into the staged output. Planning and
+// stitching are plain Go, so they behave identically on every platform.
+
+package mps
+
+// tiling is the tile size of a split (m x k) by (k x n) product: C is
+// computed in tm x tn blocks, each accumulated over inner blocks of tk.
+type tiling struct {
+	tm, tn, tk int
+}
+
+// planTiles picks tiles for an (m x k) by (k x n) product such that
+// every A (tm x tk), B (tk x tn) and C (tm x tn) tile holds at most
+// maxElems elements. It keeps k whole when it can, since splitting it
+// costs an extra pass over C per inner tile, and otherwise uses roughly
+// square C tiles.
+func planTiles(m, n, k, maxElems int) tiling {
+	if maxElems < 1 {
+		maxElems = 1
+	}
+	s := isqrt(maxElems)
+	tm, tn := min(m, s), min(n, s)
+	tk := min(k, maxElems/max(tm, tn))
+	if tk == k {
+		// k fits whole: grow the C tile to use the remaining budget.
+		tm = min(m, maxElems/max(tk, tn))
+		tn = min(n, maxElems/max(tk, tm))
+	}
+	return tiling{tm: tm, tn: tn, tk: tk}
+}
+
+// isqrt returns the largest s with s*s <= n, for n >= 1.
+func isqrt(n int) int {
+	s := 1
+	for (s+1)*(s+1) <= n {
+		s++
+	}
+	return s
+}
+
+// fitsBuffers reports whether the operands of g each hold at most
+// maxElems elements; maxElems <= 0 means there is no limit.
+func fitsBuffers(g gemmArgs, maxElems int) bool {
+	if maxElems <= 0 {
+		return true
+	}
+	return g.m*g.k <= maxElems && g.k*g.n <= maxElems && g.m*g.n <= maxElems
+}
+
+// maxBufferElems is the number of float32 elements the largest buffer of
+// a call on be may hold: the smaller of the device's limit and the one
+// set with WithMaxBufferBytes, or 0 if neither is set.
+func (e *MPSEng) maxBufferElems(be backend) int {
+	limit := e.cfg.maxBufferBytes
+	if dev := be.maxBufferBytes(); dev > 0 && (limit == 0 || dev < limit) {
+		limit = dev
+	}
+	return int(limit / 4)
+}
+
+// matMulTiled runs g on be, in tiles if an operand exceeds the engine's
+// buffer limit. It returns the first non-zero backend status. g.c is
+// only written through tile results, so on failure it holds a mix of old
+// and new values; callers that blend with C (beta != 0) pass a staged
+// copy.
+func (e *MPSEng) matMulTiled(be backend, g gemmArgs) int {
+	maxElems := e.maxBufferElems(be)
+	if fitsBuffers(g, maxElems) {
+		return be.matMulF32(g)
+	}
+
+	t := planTiles(g.m, g.n, g.k, maxElems)
+	atile := e.pool.get(t.tm * t.tk)
+	defer e.pool.put(atile)
+	btile := e.pool.get(t.tk * t.tn)
+	defer e.pool.put(btile)
+	ctile := e.pool.get(t.tm * t.tn)
+	defer e.pool.put(ctile)
+
+	// Element strides (row, column) of the operands as stored.
+	ar, ac := g.k, 1
+	if g.transA {
+		ar, ac = 1, g.m
+	}
+	br, bc := g.n, 1
+	if g.transB {
+		br, bc = 1, g.k
+	}
+
+	for i0 := 0; i0 < g.m; i0 += t.tm {
+		mi := min(t.tm, g.m-i0)
+		for j0 := 0; j0 < g.n; j0 += t.tn {
+			nj := min(t.tn, g.n-j0)
+			c := ctile[:mi*nj]
+			if g.beta != 0 {
+				gatherStrided(c, g.c[i0*g.n+j0:], mi, nj, g.n, 1)
+			}
+			for p0 := 0; p0 < g.k; p0 += t.tk {
+				kp := min(t.tk, g.k-p0)
+				a, b := atile[:mi*kp], btile[:kp*nj]
+				gatherStrided(a, g.a[i0*ar+p0*ac:], mi, kp, ar, ac)
+				gatherStrided(b, g.b[p0*br+j0*bc:], kp, nj, br, bc)
+
+				// The first inner tile applies beta; later ones add to it,
+				// and the last one runs the epilogue.
+				beta := float32(1)
+				if p0 == 0 {
+					beta = g.beta
+				}
+				tile := gemmArgs{a: a, b: b, c: c, m: mi, n: nj, k: kp, alpha: g.alpha, beta: beta, prec: g.prec}
+				if p0+kp == g.k {
+					tile.act = g.act
+					if g.bias != nil {
+						tile.bias = g.bias[j0 : j0+nj]
+					}
+				}
+				if status := be.matMulF32(tile); status != 0 {
+					return status
+				}
+			}
+			scatterStrided(g.c[i0*g.n+j0:], mi, nj, g.n, 1, c)
+		}
+	}
+	return 0
+}
+
+// WithMaxBufferBytes caps the size of every device buffer a single
+// kernel call may use. Matrix products with a larger operand are split
+// into tiles that fit, run one by one on the device and stitched into
+// the result, instead of failing on the device and falling back to the
+// CPU. The device's own buffer limit always applies; 0 (the default)
+// sets no further cap.
+func WithMaxBufferBytes(n int64) Option {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxBufferBytes = n
+	}
+}
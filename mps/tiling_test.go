@@ -0,0 +1,123 @@
+package mps
+
+import (
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// limitedBackend is a reference backend whose device rejects buffers
+// larger than limit bytes, as Metal does past maxBufferLength. It
+// records the number of calls and the largest operand it was given.
+type limitedBackend struct {
+	refBackend
+	limit   int64
+	calls   int
+	largest int
+}
+
+func (lb *limitedBackend) maxBufferBytes() int64 { return lb.limit }
+
+func (lb *limitedBackend) matMulF32(g gemmArgs) int {
+	lb.calls++
+	lb.largest = max(lb.largest, g.m*g.k, g.k*g.n, g.m*g.n)
+	maxElems := int(lb.limit / 4)
+	if g.m*g.k > maxElems || g.k*g.n > maxElems || g.m*g.n > maxElems {
+		return -3
+	}
+	return lb.refBackend.matMulF32(g)
+}
+
+func TestPlanTiles(t *testing.T) {
+	cases := []struct {
+		m, n, k, maxElems int
+		wholeK            bool
+	}{
+		{100, 100, 10, 400, true},
+		{7, 5, 9, 12, false},
+		{1, 1, 1000, 64, false},
+		{1000, 3, 2, 50, true},
+		{3, 1000, 2, 50, true},
+		{64, 64, 64, 1, false},
+		{5, 5, 5, 1 << 20, true},
+	}
+	for _, tc := range cases {
+		tl := planTiles(tc.m, tc.n, tc.k, tc.maxElems)
+		if tl.tm < 1 || tl.tn < 1 || tl.tk < 1 || tl.tm > tc.m || tl.tn > tc.n || tl.tk > tc.k {
+			t.Fatalf("planTiles(%d, %d, %d, %d) = %+v out of range", tc.m, tc.n, tc.k, tc.maxElems, tl)
+		}
+		if tl.tm*tl.tk > tc.maxElems || tl.tk*tl.tn > tc.maxElems || tl.tm*tl.tn > tc.maxElems {
+			t.Fatalf("planTiles(%d, %d, %d, %d) = %+v exceeds the limit", tc.m, tc.n, tc.k, tc.maxElems, tl)
+		}
+		if (tl.tk == tc.k) != tc.wholeK {
+			t.Fatalf("planTiles(%d, %d, %d, %d) = %+v, want whole k %v", tc.m, tc.n, tc.k, tc.maxElems, tl, tc.wholeK)
+		}
+	}
+}
+
+// Test that oversized products are tiled, stay on the device and are
+// stitched into outputs of any layout, for plain products and for Gemm
+// with a split inner dimension.
+func TestMatMulTiled(t *testing.T) {
+	r := rand.New(rand.NewSource(81))
+	const m, n, k = 7, 5, 9
+
+	cases := []struct {
+		name        string
+		a, b, c     func() *tensor.Dense
+		alpha, beta float32
+	}{
+		{"row-major", func() *tensor.Dense { return newRandomFloat32Matrix(t, m, k, r) }, func() *tensor.Dense { return newRandomFloat32Matrix(t, k, n, r) }, func() *tensor.Dense { return newZeroFloat32Matrix(m, n) }, 1, 0},
+		{"transposed", func() *tensor.Dense { return transposedView(t, m, k, r) }, func() *tensor.Dense { return transposedView(t, k, n, r) }, func() *tensor.Dense { return newZeroFloat32Matrix(m, n) }, 1, 0},
+		{"sliced output", func() *tensor.Dense { return newRandomFloat32Matrix(t, m, k, r) }, func() *tensor.Dense { return transposedView(t, k, n, r) }, func() *tensor.Dense { return slicedView(t, m, n, r) }, 1, 0},
+		{"gemm", func() *tensor.Dense { return transposedView(t, m, k, r) }, func() *tensor.Dense { return newRandomFloat32Matrix(t, k, n, r) }, func() *tensor.Dense { return newRandomFloat32Matrix(t, m, n, r) }, 0.5, 2},
+	}
+	for _, tc := range cases {
+		for _, limit := range []int64{12 * 4, 30 * 4} {
+			be := &limitedBackend{limit: 1 << 20}
+			e := NewMPSEng(WithMinFLOPs(0), withBackend(be), WithMaxBufferBytes(limit))
+			a, b, c := tc.a(), tc.b(), tc.c()
+			c0 := denseValues(t, c)
+
+			if err := e.Gemm(float64(tc.alpha), a, b, float64(tc.beta), c); err != nil {
+				t.Fatalf("%s/%d: Gemm error: %v", tc.name, limit, err)
+			}
+			if got, want := denseValues(t, c), gemmWant(t, tc.alpha, a, b, tc.beta, c0); !equalApprox(got, want, 1e-4) {
+				t.Fatalf("%s/%d: result differs from reference\n got:  %v\n want: %v", tc.name, limit, got, want)
+			}
+			st := e.Stats()
+			if st.Ops[OpMatMul].Accelerated != 1 || be.calls < 2 {
+				t.Fatalf("%s/%d: expected a tiled device MatMul, got %d calls and %+v", tc.name, limit, be.calls, st.Ops[OpMatMul])
+			}
+			if int64(be.largest)*4 > limit {
+				t.Fatalf("%s/%d: a tile operand has %d elements", tc.name, limit, be.largest)
+			}
+			if st.Pool.BytesInUse != 0 {
+				t.Fatalf("%s/%d: tile buffers not returned: %+v", tc.name, limit, st.Pool)
+			}
+			e.Close()
+		}
+	}
+}
+
+// Test that the device's own buffer limit triggers tiling without any
+// option, so oversized products no longer fail over to the CPU.
+func TestMatMulTiledDeviceLimit(t *testing.T) {
+	r := rand.New(rand.NewSource(82))
+	be := &limitedBackend{limit: 16 * 4}
+	e := NewMPSEng(WithMinFLOPs(0), withBackend(be))
+	defer e.Close()
+
+	a, b := newRandomFloat32Matrix(t, 6, 10, r), newRandomFloat32Matrix(t, 10, 4, r)
+	c := newZeroFloat32Matrix(6, 4)
+	if err := e.MatMul(a, b, c); err != nil {
+		t.Fatalf("MatMul error: %v", err)
+	}
+	if got, want := extractFloat32Backing(t, c), stdMatMul(t, a, b); !equalApprox(got, want, 1e-5) {
+		t.Fatalf("result differs from StdEng\n got:  %v\n want: %v", got, want)
+	}
+	if st := e.Stats().Ops[OpMatMul]; st.Accelerated != 1 {
+		t.Fatalf("oversized MatMul not accelerated: %+v", st)
+	}
+}
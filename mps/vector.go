@@ -0,0 +1,203 @@
+// vector.go
+//
+// Matrix-vector, inner and outer products for MPSEng. Each is run as the
+// equivalent MatMul over 2D views of its vectors, so they share MatMul's
+// staging of float32 layouts and its backend kernel.
+
+package mps
+
+import (
+	"fmt"
+
+	"gorgonia.org/tensor"
+)
+
+// MatVecMul computes prealloc = a x b for a 2D matrix a (M x N), a vector
+// b of N elements and a vector prealloc of M elements. Row and column
+// vectors of shape [N, 1] or [1, N] are accepted wherever a vector is.
+//
+// float32 Dense operands of any layout run on the GPU; like MatMul,
+// everything else falls back to the fallback engine (StdEng by default),
+// recording the reason in Stats.
+func (e *MPSEng) MatVecMul(a, b, prealloc tensor.Tensor) error {
+	if err := e.checkOpen(); err != nil {
+		return err
+	}
+
+	p, reason, err := e.planMatVecMul(a, b, prealloc)
+	if err != nil {
+		return err
+	}
+	if reason != ReasonNone {
+		return e.fallbackMatVecMul(reason, a, b, prealloc)
+	}
+	if reason := e.execMatVecMul(p); reason != ReasonNone {
+		return e.fallbackMatVecMul(reason, a, b, prealloc)
+	}
+
+	e.stats.recordAccelerated(OpMatVecMul)
+	return nil
+}
+
+// Inner returns the inner product of the vectors a and b, as a float32
+// for float32 operands. Other dtypes, and problems the dispatch policy
+// rejects, are handed to the fallback engine.
+func (e *MPSEng) Inner(a, b tensor.Tensor) (interface{}, error) {
+	if err := e.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	p, reason, err := e.planInner(a, b)
+	if err != nil {
+		return nil, err
+	}
+	if reason != ReasonNone {
+		return e.fallbackInner(reason, a, b)
+	}
+	v, reason := e.execInner(p)
+	if reason != ReasonNone {
+		return e.fallbackInner(reason, a, b)
+	}
+
+	e.stats.recordAccelerated(OpInner)
+	return v, nil
+}
+
+// Outer adds the outer product a x b^T of the vectors a (M elements) and
+// b (N elements) to the M x N matrix prealloc, as StdEng.Outer does: on
+// the GPU for float32 Dense operands and on the fallback engine
+// otherwise. Zero prealloc first for the product alone.
+func (e *MPSEng) Outer(a, b, prealloc tensor.Tensor) error {
+	if err := e.checkOpen(); err != nil {
+		return err
+	}
+
+	p, reason, err := e.planOuter(a, b, prealloc)
+	if err != nil {
+		return err
+	}
+	if reason != ReasonNone {
+		return e.fallbackOuter(reason, a, b, prealloc)
+	}
+	if reason := e.execOuter(p); reason != ReasonNone {
+		return e.fallbackOuter(reason, a, b, prealloc)
+	}
+
+	e.stats.recordAccelerated(OpOuter)
+	return nil
+}
+
+// execMatVecMul runs a planned MatVecMul as the MatMul of a (m x k) by b
+// viewed as a k x 1 matrix into prealloc viewed as an m x 1 matrix.
+func (e *MPSEng) execMatVecMul(p vecPlan) FallbackReason {
+	var sv stagedViews
+	defer sv.release(e.pool)
+
+	x, err := sv.vector(e.pool, p.b, p.k, 1, true)
+	if err != nil {
+		return ReasonLayout
+	}
+	y, err := sv.vector(e.pool, p.c, p.m, 1, false)
+	if err != nil {
+		return ReasonLayout
+	}
+	if reason := e.execMatMul(matMulPlan{a: p.a, b: x, c: y, m: p.m, n: 1, k: p.k, alpha: 1}); reason != ReasonNone {
+		return reason
+	}
+	if err := sv.writeBack(y, p.c); err != nil {
+		return ReasonLayout
+	}
+	return ReasonNone
+}
+
+// execInner runs a planned Inner as the MatMul of a viewed as a 1 x k
+// matrix by b viewed as a k x 1 matrix.
+func (e *MPSEng) execInner(p vecPlan) (float32, FallbackReason) {
+	var sv stagedViews
+	defer sv.release(e.pool)
+
+	x, err := sv.vector(e.pool, p.a, 1, p.k, true)
+	if err != nil {
+		return 0, ReasonLayout
+	}
+	y, err := sv.vector(e.pool, p.b, p.k, 1, true)
+	if err != nil {
+		return 0, ReasonLayout
+	}
+	res := make([]float32, 1)
+	c := tensor.New(tensor.WithShape(1, 1), tensor.WithBacking(res))
+	if reason := e.execMatMul(matMulPlan{a: x, b: y, c: c, m: 1, n: 1, k: p.k, alpha: 1}); reason != ReasonNone {
+		return 0, reason
+	}
+	return res[0], ReasonNone
+}
+
+// execOuter runs a planned Outer as the MatMul of a viewed as an m x 1
+// matrix by b viewed as a 1 x n matrix, added to prealloc (beta 1).
+// With beta non-zero, execMatMul leaves prealloc intact if it fails.
+func (e *MPSEng) execOuter(p vecPlan) FallbackReason {
+	var sv stagedViews
+	defer sv.release(e.pool)
+
+	x, err := sv.vector(e.pool, p.a, p.m, 1, true)
+	if err != nil {
+		return ReasonLayout
+	}
+	y, err := sv.vector(e.pool, p.b, 1, p.n, true)
+	if err != nil {
+		return ReasonLayout
+	}
+	return e.execMatMul(matMulPlan{a: x, b: y, c: p.c, m: p.m, n: p.n, k: 1, alpha: 1, beta: 1})
+}
+
+// stagedViews tracks the pool buffers behind the matrix views of one
+// vector product.
+type stagedViews struct {
+	bufs [][]float32
+}
+
+// vector returns a rows x cols row-major matrix over the elements of the
+// float32 vector d. A contiguous vector is viewed in place. Any other is
+// staged in a buffer from pool, holding a copy of d's elements if fill
+// is set; an output staged that way must be passed to writeBack.
+func (sv *stagedViews) vector(pool *stagingPool, d *tensor.Dense, rows, cols int, fill bool) (*tensor.Dense, error) {
+	n := rows * cols
+	data, ok := d.Data().([]float32)
+	if !ok {
+		return nil, fmt.Errorf("mps: vector backing is %T, want []float32", d.Data())
+	}
+	if isRowMajorContiguous(d) && len(data) >= n {
+		return tensor.New(tensor.WithShape(rows, cols), tensor.WithBacking(data[:n])), nil
+	}
+
+	buf := pool.get(n)
+	sv.bufs = append(sv.bufs, buf)
+	if fill {
+		if err := gatherF32(buf, d, data); err != nil {
+			return nil, fmt.Errorf("mps: staging vector: %w", err)
+		}
+	}
+	return tensor.New(tensor.WithShape(rows, cols), tensor.WithBacking(buf)), nil
+}
+
+// writeBack copies the view v returned by vector for the output d into d,
+// unless v already shares d's storage.
+func (sv *stagedViews) writeBack(v, d *tensor.Dense) error {
+	buf := v.Data().([]float32)
+	data := d.Data().([]float32)
+	if len(buf) > 0 && len(data) > 0 && &buf[0] == &data[0] {
+		return nil
+	}
+	if err := scatterF32(buf, d, data); err != nil {
+		return fmt.Errorf("mps: writing vector result: %w", err)
+	}
+	return nil
+}
+
+// release returns the staged buffers to pool.
+func (sv *stagedViews) release(pool *stagingPool) {
+	for _, buf := range sv.bufs {
+		pool.put(buf)
+	}
+	sv.bufs = nil
+}
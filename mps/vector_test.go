@@ -0,0 +1,244 @@
+package mps
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"gorgonia.org/tensor"
+)
+
+// columnView returns a vector of n elements that is the second column of
+// a fresh n x 3 matrix, so its elements are 3 apart.
+func columnView(t *testing.T, n int, r *rand.Rand) *tensor.Dense {
+	t.Helper()
+	v, err := newRandomFloat32Matrix(t, n, 3, r).Slice(nil, tensor.S(1))
+	if err != nil {
+		t.Fatalf("Slice error: %v", err)
+	}
+	return v.(*tensor.Dense)
+}
+
+func TestMatVecMulLayouts(t *testing.T) {
+	r := rand.New(rand.NewSource(71))
+	const m, k = 5, 4
+
+	mats := map[string]func() *tensor.Dense{
+		"row-major":  func() *tensor.Dense { return newRandomFloat32Matrix(t, m, k, r) },
+		"transposed": func() *tensor.Dense { return transposedView(t, m, k, r) },
+		"sliced":     func() *tensor.Dense { return slicedView(t, m, k, r) },
+	}
+	vecs := map[string]func(n int) *tensor.Dense{
+		"contiguous": func(n int) *tensor.Dense { return randomF32(r, n) },
+		"column":     func(n int) *tensor.Dense { return randomF32(r, n, 1) },
+		"strided":    func(n int) *tensor.Dense { return columnView(t, n, r) },
+	}
+
+	for an, newA := range mats {
+		for bn, newB := range vecs {
+			for cn, newC := range vecs {
+				a, b, c := newA(), newB(k), newC(m)
+				e := newRefEngine(t)
+				if err := e.MatVecMul(a, b, c); err != nil {
+					t.Fatalf("%s/%s/%s: MatVecMul error: %v", an, bn, cn, err)
+				}
+
+				av, bv := denseValues(t, a), denseValues(t, b)
+				want := make([]float32, m)
+				for i := range want {
+					for p := 0; p < k; p++ {
+						want[i] += av[i*k+p] * bv[p]
+					}
+				}
+				if got := denseValues(t, c); !equalApprox(got, want, 1e-5) {
+					t.Fatalf("%s/%s/%s: got %v, want %v", an, bn, cn, got, want)
+				}
+				if st := e.Stats(); st.Ops[OpMatVecMul].Accelerated != 1 || st.Pool.BytesInUse != 0 {
+					t.Fatalf("%s/%s/%s: unexpected stats %+v", an, bn, cn, st)
+				}
+			}
+		}
+	}
+}
+
+func TestInnerOuterLayouts(t *testing.T) {
+	r := rand.New(rand.NewSource(72))
+	vecs := map[string]func(n int) *tensor.Dense{
+		"contiguous": func(n int) *tensor.Dense { return randomF32(r, n) },
+		"row":        func(n int) *tensor.Dense { return randomF32(r, 1, n) },
+		"strided":    func(n int) *tensor.Dense { return columnView(t, n, r) },
+	}
+
+	for an, newA := range vecs {
+		for bn, newB := range vecs {
+			e := newRefEngine(t)
+
+			a, b := newA(6), newB(6)
+			got, err := e.Inner(a, b)
+			if err != nil {
+				t.Fatalf("%s/%s: Inner error: %v", an, bn, err)
+			}
+			var want float32
+			for i, v := range denseValues(t, a) {
+				want += v * denseValues(t, b)[i]
+			}
+			if f, ok := got.(float32); !ok || math.Abs(float64(f-want)) > 1e-5 {
+				t.Fatalf("%s/%s: Inner = %v (%T), want %v", an, bn, got, got, want)
+			}
+
+			a, b = newA(4), newB(3)
+			c := slicedView(t, 4, 3, r)
+			c0 := denseValues(t, c)
+			if err := e.Outer(a, b, c); err != nil {
+				t.Fatalf("%s/%s: Outer error: %v", an, bn, err)
+			}
+			av, bv := denseValues(t, a), denseValues(t, b)
+			wantOuter := make([]float32, 0, 12)
+			for _, x := range av {
+				for _, y := range bv {
+					wantOuter = append(wantOuter, c0[len(wantOuter)]+x*y)
+				}
+			}
+			if got := denseValues(t, c); !equalApprox(got, wantOuter, 1e-6) {
+				t.Fatalf("%s/%s: Outer got %v, want %v", an, bn, got, wantOuter)
+			}
+
+			st := e.Stats()
+			if st.Ops[OpInner].Accelerated != 1 || st.Ops[OpOuter].Accelerated != 1 || st.Pool.BytesInUse != 0 {
+				t.Fatalf("%s/%s: unexpected stats %+v", an, bn, st)
+			}
+		}
+	}
+}
+
+// Test the fallback paths through the tensor package's own entry points,
+// which reach the engine via the operands' Engine().
+func TestVectorOpsFallback(t *testing.T) {
+	r := rand.New(rand.NewSource(73))
+	engines := []struct {
+		name   string
+		opts   []Option
+		reason FallbackReason
+	}{
+		{"device", []Option{withBackend(newRefBackend())}, ReasonNone},
+		{"disabled", []Option{WithOpEnabled(OpMatVecMul, false), WithOpEnabled(OpInner, false), WithOpEnabled(OpOuter, false)}, ReasonDisabled},
+		{"device error", []Option{withBackend(newFailingBackend(fault{status: 1, corrupt: true}))}, ReasonDeviceError},
+	}
+	for _, eng := range engines {
+		e := NewMPSEng(append([]Option{WithMinFLOPs(0)}, eng.opts...)...)
+		withE := func(d *tensor.Dense) *tensor.Dense {
+			return tensor.New(tensor.WithShape(d.Shape().Clone()...), tensor.WithBacking(d.Data()), tensor.WithEngine(e))
+		}
+		a, x, y := withE(randomF32(r, 3, 4)), withE(randomF32(r, 4)), withE(randomF32(r, 3))
+
+		mv, err := tensor.MatVecMul(a, x)
+		if err != nil {
+			t.Fatalf("%s: MatVecMul error: %v", eng.name, err)
+		}
+		var std tensor.StdEng
+		want := tensor.New(tensor.WithShape(3), tensor.Of(tensor.Float32))
+		if err := std.MatVecMul(a, x, want); err != nil {
+			t.Fatalf("StdEng.MatVecMul error: %v", err)
+		}
+		if !equalApprox(mv.Data().([]float32), want.Data().([]float32), 1e-5) {
+			t.Fatalf("%s: MatVecMul got %v, want %v", eng.name, mv.Data(), want.Data())
+		}
+
+		ip, err := tensor.Inner(x, x)
+		if err != nil {
+			t.Fatalf("%s: Inner error: %v", eng.name, err)
+		}
+		wantIP, _ := std.Inner(x, x)
+		if math.Abs(float64(ip.(float32)-wantIP.(float32))) > 1e-5 {
+			t.Fatalf("%s: Inner got %v, want %v", eng.name, ip, wantIP)
+		}
+
+		op, err := tensor.Outer(y, x)
+		if err != nil {
+			t.Fatalf("%s: Outer error: %v", eng.name, err)
+		}
+		wantOp := tensor.New(tensor.WithShape(3, 4), tensor.Of(tensor.Float32))
+		if err := std.Outer(y, x, wantOp); err != nil {
+			t.Fatalf("StdEng.Outer error: %v", err)
+		}
+		if !equalApprox(op.Data().([]float32), wantOp.Data().([]float32), 1e-6) {
+			t.Fatalf("%s: Outer got %v, want %v", eng.name, op.Data(), wantOp.Data())
+		}
+
+		st := e.Stats()
+		for _, o := range []Op{OpMatVecMul, OpInner, OpOuter} {
+			if eng.reason == ReasonNone {
+				if st.Ops[o].Accelerated != 1 {
+					t.Fatalf("%s: %v not accelerated: %+v", eng.name, o, st.Ops[o])
+				}
+			} else if st.Ops[o].Fallbacks[eng.reason] != 1 {
+				t.Fatalf("%s: expected one %v fallback for %v: %+v", eng.name, eng.reason, o, st.Ops[o])
+			}
+		}
+		e.Close()
+	}
+}
+
+// Test that Outer adds to a non-zero prealloc, as StdEng.Outer does, on
+// the device and on every fallback.
+func TestOuterAccumulates(t *testing.T) {
+	engines := []struct {
+		name   string
+		opts   []Option
+		reason FallbackReason
+	}{
+		{"device", []Option{withBackend(newRefBackend()), WithMinFLOPs(0)}, ReasonNone},
+		{"size threshold", []Option{withBackend(newRefBackend())}, ReasonSizeThreshold},
+		{"disabled", []Option{WithOpEnabled(OpOuter, false)}, ReasonDisabled},
+		{"device error", []Option{withBackend(newFailingBackend(fault{status: 1, corrupt: true})), WithMinFLOPs(0)}, ReasonDeviceError},
+	}
+	for _, eng := range engines {
+		e := NewMPSEng(eng.opts...)
+		a := tensor.New(tensor.WithShape(2), tensor.WithBacking([]float32{1, 2}))
+		b := tensor.New(tensor.WithShape(2), tensor.WithBacking([]float32{3, 4}))
+		c := tensor.New(tensor.WithShape(2, 2), tensor.WithBacking([]float32{100, 100, 100, 100}))
+		if err := e.Outer(a, b, c); err != nil {
+			t.Fatalf("%s: Outer error: %v", eng.name, err)
+		}
+		if got, want := denseValues(t, c), []float32{103, 104, 106, 108}; !equalApprox(got, want, 0) {
+			t.Fatalf("%s: Outer got %v, want %v", eng.name, got, want)
+		}
+
+		st := e.Stats().Ops[OpOuter]
+		if eng.reason == ReasonNone {
+			if st.Accelerated != 1 {
+				t.Fatalf("%s: Outer not accelerated: %+v", eng.name, st)
+			}
+		} else if st.Fallbacks[eng.reason] != 1 {
+			t.Fatalf("%s: expected one %v fallback: %+v", eng.name, eng.reason, st)
+		}
+		e.Close()
+	}
+}
+
+func TestVectorOpsErrors(t *testing.T) {
+	e := newRefEngine(t, WithStrict(true))
+	f32 := func(shape ...int) *tensor.Dense {
+		return tensor.New(tensor.WithShape(shape...), tensor.Of(tensor.Float32))
+	}
+	if err := e.MatVecMul(f32(3, 4), f32(5), f32(3)); err == nil {
+		t.Fatalf("MatVecMul accepted mismatched shapes")
+	}
+	if err := e.MatVecMul(f32(3, 4), f32(4), f32(4)); err == nil {
+		t.Fatalf("MatVecMul accepted a mismatched prealloc")
+	}
+	if _, err := e.Inner(f32(3), f32(4)); err == nil {
+		t.Fatalf("Inner accepted mismatched shapes")
+	}
+	if err := e.Outer(f32(3), f32(4), f32(4, 3)); err == nil {
+		t.Fatalf("Outer accepted a mismatched prealloc")
+	}
+
+	f64 := tensor.New(tensor.WithShape(4), tensor.Of(tensor.Float64))
+	_, err := e.Inner(f64, f64)
+	var fe *FallbackError
+	if !errors.As(err, &fe) || fe.Op != OpInner || fe.Reason != ReasonDtype {
+		t.Fatalf("expected dtype FallbackError, got %v", err)
+	}
+}